@@ -0,0 +1,69 @@
+// Package dnstest starts fake nameservers for the tests of the packages looking up DNS records.
+package dnstest
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// StartNameserver starts a recursive-like nameserver on UDP answering from records, in zone file format,
+// and following CNAMEs. It returns its address and is shut down with the test.
+func StartNameserver(t testing.TB, records ...string) string {
+	t.Helper()
+
+	var rrs []dns.RR
+	for _, s := range records {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rrs = append(rrs, rr)
+	}
+
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+
+		q := r.Question[0]
+		name := q.Name
+		found := false
+		for i := 0; i < 8; i++ {
+			var next string
+			for _, rr := range rrs {
+				if rr.Header().Name != name {
+					continue
+				}
+				found = true
+				if rr.Header().Rrtype == q.Qtype {
+					m.Answer = append(m.Answer, rr)
+				} else if cname, ok := rr.(*dns.CNAME); ok {
+					m.Answer = append(m.Answer, rr)
+					next = cname.Target
+				}
+			}
+			if next == "" || q.Qtype == dns.TypeCNAME {
+				break
+			}
+			name = next
+		}
+		if !found {
+			m.Rcode = dns.RcodeNameError
+		}
+		w.WriteMsg(m)
+	})
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	started := make(chan struct{})
+	s := &dns.Server{PacketConn: pc, Handler: handler, NotifyStartedFunc: func() { close(started) }}
+	go s.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { s.Shutdown() })
+
+	return pc.LocalAddr().String()
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net"
 	"strings"
 	"unicode/utf8"
 
@@ -19,17 +20,91 @@ func FormatHelloServerName(servername string) (string, error) {
 
 	servername = strings.Trim(servername, ".") // golang.org/issue/18114
 
+	// some clients wrongly send IP literals in the SNI
+	if ip, ok := FormatIP(servername); ok {
+		return ip, nil
+	}
+
 	return servername, nil
 }
 
 // ExtractRootDomain extracts the EffectiveTLDPlusOne, see https://godoc.org/golang.org/x/net/publicsuffix#EffectiveTLDPlusOne
-// for more explanations
+// for more explanations. An IP address is its own root domain.
 func ExtractRootDomain(domain string) (string, error) {
+	if ip, ok := FormatIP(domain); ok {
+		return ip, nil
+	}
 	return publicsuffix.EffectiveTLDPlusOne(domain)
 }
 
+// FormatIP returns the canonical form of an IPv4 or IPv6 literal, square brackets removed,
+// and false if s is not an IP address
+func FormatIP(s string) (string, bool) {
+	ip := net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(s, "["), "]"))
+	if ip == nil {
+		return "", false
+	}
+	return ip.String(), true
+}
+
+// LocalIP returns the canonical local IP address of conn, which identifies a TLS connection without SNI
+func LocalIP(conn net.Conn) (string, error) {
+	if conn == nil {
+		return "", errors.New("missing connection")
+	}
+
+	host, _, err := net.SplitHostPort(conn.LocalAddr().String())
+	if err != nil {
+		return "", err
+	}
+
+	ip, ok := FormatIP(host)
+	if !ok {
+		return "", fmt.Errorf("invalid local address %s", host)
+	}
+
+	return ip, nil
+}
+
+// IPFromReverseName converts a reverse DNS name, for example 4.3.2.1.in-addr.arpa, back to its canonical IP address.
+// It is the SNI sent by CAs when validating IP identifiers with tls-alpn-01, see RFC 8738.
+func IPFromReverseName(name string) (string, bool) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+
+	switch {
+	case strings.HasSuffix(name, ".in-addr.arpa"):
+		labels := strings.Split(strings.TrimSuffix(name, ".in-addr.arpa"), ".")
+		if len(labels) != 4 {
+			return "", false
+		}
+		for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+			labels[i], labels[j] = labels[j], labels[i]
+		}
+		return FormatIP(strings.Join(labels, "."))
+
+	case strings.HasSuffix(name, ".ip6.arpa"):
+		nibbles := strings.Split(strings.TrimSuffix(name, ".ip6.arpa"), ".")
+		if len(nibbles) != 32 {
+			return "", false
+		}
+		var b strings.Builder
+		for i := len(nibbles) - 1; i >= 0; i-- {
+			if len(nibbles[i]) != 1 {
+				return "", false
+			}
+			b.WriteString(nibbles[i])
+			if i > 0 && i%4 == 0 {
+				b.WriteByte(':')
+			}
+		}
+		return FormatIP(b.String())
+	}
+
+	return "", false
+}
+
 func VerifyTXT(domain, token string) (bool, error) {
-	records, err := GoogleResolver.LookupTXT(context.Background(), domain)
+	records, err := DNSResolver.LookupTXT(context.Background(), domain)
 	if err != nil {
 		return false, fmt.Errorf("%v: %v", domain, err)
 	}
@@ -43,6 +118,19 @@ func VerifyTXT(domain, token string) (bool, error) {
 	return false, nil
 }
 
+// LookupCNAMETarget follows the CNAME records of fqdn and returns the canonical name they end up at,
+// or fqdn itself if it is not an alias
+func LookupCNAMETarget(fqdn string) (string, error) {
+	fqdn = strings.ToLower(strings.TrimSuffix(fqdn, ".")) + "."
+
+	target, err := DNSResolver.LookupCNAME(context.Background(), fqdn)
+	if err != nil {
+		return "", fmt.Errorf("%v: %v", fqdn, err)
+	}
+
+	return strings.ToLower(target), nil
+}
+
 func EqualDomain(d1, d2 string) bool {
 	// Normalize domains by converting to lowercase
 	d1 = strings.ToLower(d1)
@@ -102,3 +190,27 @@ func wildcardMatch(pattern, str string) bool {
 
 	return strings.HasSuffix(str, parts[len(parts)-1])
 }
+
+// MatchCertificateDomain reports whether host is covered by pattern, pattern being a DNS name
+// of a certificate. Following RFC 6125, a wildcard is only allowed as the complete left-most label
+// and matches exactly one label, so *.example.com covers www.example.com but neither example.com
+// nor a.b.example.com.
+func MatchCertificateDomain(pattern, host string) bool {
+	pattern = strings.ToLower(strings.TrimSuffix(pattern, "."))
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	if pattern == host {
+		return true
+	}
+
+	if !strings.HasPrefix(pattern, "*.") {
+		return false
+	}
+
+	dot := strings.IndexByte(host, '.')
+	if dot <= 0 {
+		return false
+	}
+
+	return host[dot+1:] == pattern[2:]
+}
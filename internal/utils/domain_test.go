@@ -0,0 +1,86 @@
+package utils
+
+import "testing"
+
+func TestMatchCertificateDomain(t *testing.T) {
+	tests := []struct {
+		pattern, host string
+		want          bool
+	}{
+		{"example.com", "example.com", true},
+		{"example.com", "www.example.com", false},
+		{"www.example.com", "example.com", false},
+		{"*.example.com", "www.example.com", true},
+		{"*.example.com", "api.example.com", true},
+		{"*.example.com", "example.com", false},
+		{"*.example.com", "a.b.example.com", false},
+		{"*.example.com", ".example.com", false},
+		{"*.example.com", "www.example.org", false},
+		{"*.www.example.com", "www.example.com", false},
+		{"w*.example.com", "www.example.com", false},
+		{"Example.COM", "example.com", true},
+		{"*.example.com", "WWW.Example.Com", true},
+		{"example.com.", "example.com", true},
+		{"*.example.com", "www.example.com.", true},
+	}
+
+	for _, tt := range tests {
+		if got := MatchCertificateDomain(tt.pattern, tt.host); got != tt.want {
+			t.Errorf("MatchCertificateDomain(%q, %q): expected %v, got %v", tt.pattern, tt.host, tt.want, got)
+		}
+	}
+}
+
+func TestFormatIP(t *testing.T) {
+	tests := []struct {
+		s, want string
+		ok      bool
+	}{
+		{"192.0.2.1", "192.0.2.1", true},
+		{"2001:db8::1", "2001:db8::1", true},
+		{"[2001:db8::1]", "2001:db8::1", true},
+		{"2001:0DB8:0000:0000:0000:0000:0000:0001", "2001:db8::1", true},
+		{"::ffff:192.0.2.1", "192.0.2.1", true},
+		{"example.com", "", false},
+		{"192.0.2", "", false},
+		{"192.0.2.256", "", false},
+		{"", "", false},
+	}
+
+	for _, tt := range tests {
+		got, ok := FormatIP(tt.s)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("FormatIP(%q): expected %q %v, got %q %v", tt.s, tt.want, tt.ok, got, ok)
+		}
+	}
+}
+
+func TestIPFromReverseName(t *testing.T) {
+	tests := []struct {
+		name, want string
+		ok         bool
+	}{
+		// the examples of RFC 8738
+		{"1.2.0.192.in-addr.arpa", "192.0.2.1", true},
+		{"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa", "2001:db8::1", true},
+		{"1.2.0.192.IN-ADDR.ARPA.", "192.0.2.1", true},
+		{"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.B.D.0.1.0.0.2.ip6.arpa.", "2001:db8::1", true},
+		{"2.0.192.in-addr.arpa", "", false},
+		{"1.1.2.0.192.in-addr.arpa", "", false},
+		{"1.2.0.300.in-addr.arpa", "", false},
+		{"a.2.0.192.in-addr.arpa", "", false},
+		{"0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa", "", false},
+		{"10.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa", "", false},
+		{"g.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa", "", false},
+		{"in-addr.arpa", "", false},
+		{"example.com", "", false},
+		{"192.0.2.1", "", false},
+	}
+
+	for _, tt := range tests {
+		got, ok := IPFromReverseName(tt.name)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("IPFromReverseName(%q): expected %q %v, got %q %v", tt.name, tt.want, tt.ok, got, ok)
+		}
+	}
+}
@@ -1,17 +1,9 @@
 package utils
 
 import (
-	"context"
-	"net"
-	"time"
+	"github.com/arthurweinmann/go-https-hug/pkg/dnsresolver"
 )
 
-var GoogleResolver = &net.Resolver{
-	PreferGo: true,
-	Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
-		d := net.Dialer{
-			Timeout: 10 * time.Second,
-		}
-		return d.DialContext(ctx, network, "8.8.8.8:53")
-	},
-}
+// DNSResolver is used for TXT verifications, pre-flight checks and challenge delegation lookups.
+// It defaults to Google Public DNS, acme.Init replaces it with the resolver of its parameters.
+var DNSResolver = dnsresolver.Default()
@@ -1,7 +1,12 @@
 package acme
 
 import (
+	"crypto/tls"
 	"time"
+
+	"github.com/arthurweinmann/go-https-hug/internal/utils"
+	"github.com/arthurweinmann/go-https-hug/pkg/storage"
+	"github.com/go-acme/lego/v4/challenge/tlsalpn01"
 )
 
 type HTTPChallenger struct {
@@ -15,6 +20,57 @@ func (c *HTTPChallenger) CleanUp(domain, token, keyAuth string) error {
 	return settings.Store.DeleteKV("challenges/" + domain + "_" + token)
 }
 
+// GetChallenge returns the key authorization of the http-01 challenge of domain and token.
+// If it is not in our Store and InitParameters.Peers is set, the peers are asked for it.
 func GetChallenge(domain, token string) ([]byte, error) {
+	domain = formatChallengeDomain(domain)
+
+	keyauth, err := getLocalChallenge(domain, token)
+	if err == storage.ErrNotFound && settings.Peers != nil && len(settings.Peers.URLs) > 0 && isACMEToken(token) {
+		return getPeersChallenge(domain, token)
+	}
+
+	return keyauth, err
+}
+
+func getLocalChallenge(domain, token string) ([]byte, error) {
 	return settings.Store.GetKV("challenges/" + domain + "_" + token)
 }
+
+// TLSALPNChallenger solves tls-alpn-01 challenges. The challenge certificate is then
+// served by GetCertificate to the ClientHellos offering the acme-tls/1 protocol.
+type TLSALPNChallenger struct {
+}
+
+func (c *TLSALPNChallenger) Present(domain, token, keyAuth string) error {
+	return settings.Store.SetKV("challenges/tls-alpn-01/"+domain, []byte(keyAuth), 30*time.Minute)
+}
+
+func (c *TLSALPNChallenger) CleanUp(domain, token, keyAuth string) error {
+	return settings.Store.DeleteKV("challenges/tls-alpn-01/" + domain)
+}
+
+// GetTLSALPNChallengeCertificate returns the tls-alpn-01 challenge certificate of domain,
+// which may also be an IP address
+func GetTLSALPNChallengeCertificate(domain string) (*tls.Certificate, error) {
+	keyauth, err := settings.Store.GetKV("challenges/tls-alpn-01/" + domain)
+	if err != nil {
+		return nil, err
+	}
+	return tlsalpn01.ChallengeCert(domain, string(keyauth))
+}
+
+// IsTLSALPNChallengeHello reports whether hello comes from a CA validating a tls-alpn-01 challenge,
+// which offers acme-tls/1 as its only protocol, see RFC 8737
+func IsTLSALPNChallengeHello(hello *tls.ClientHelloInfo) bool {
+	return len(hello.SupportedProtos) == 1 && hello.SupportedProtos[0] == ACME_TLS_ALPN_PROTOCOL
+}
+
+// tlsALPNChallengeIdentifier returns the domain name or IP address a tls-alpn-01 validation is about.
+// For IP addresses, the SNI is their reverse DNS name, see RFC 8738.
+func tlsALPNChallengeIdentifier(hello *tls.ClientHelloInfo) (string, error) {
+	if ip, ok := utils.IPFromReverseName(hello.ServerName); ok {
+		return ip, nil
+	}
+	return helloServerName(hello)
+}
@@ -0,0 +1,56 @@
+package acme
+
+import (
+	"crypto/tls"
+	"testing"
+)
+
+func TestIsTLSALPNChallengeHello(t *testing.T) {
+	tests := []struct {
+		name   string
+		protos []string
+		want   bool
+	}{
+		{name: "acme-tls/1", protos: []string{ACME_TLS_ALPN_PROTOCOL}, want: true},
+		{name: "none", protos: nil},
+		{name: "h2", protos: []string{"h2"}},
+		{name: "h2 and acme-tls/1", protos: []string{"h2", ACME_TLS_ALPN_PROTOCOL}},
+		{name: "acme-tls/1 and http/1.1", protos: []string{ACME_TLS_ALPN_PROTOCOL, "http/1.1"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsTLSALPNChallengeHello(&tls.ClientHelloInfo{ServerName: "example.com", SupportedProtos: tt.protos}); got != tt.want {
+				t.Fatalf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestTLSALPNChallengeIdentifier(t *testing.T) {
+	tests := []struct {
+		servername string
+		want       string
+		wantErr    bool
+	}{
+		{servername: "example.com", want: "example.com"},
+		{servername: "WWW.Example.com.", want: "www.example.com"},
+		{servername: "1.2.0.192.in-addr.arpa", want: "192.0.2.1"},
+		{servername: "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa", want: "2001:db8::1"},
+		// not a reverse name, the SNI is then used as is
+		{servername: "2.0.192.in-addr.arpa", want: "2.0.192.in-addr.arpa"},
+		{servername: "", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.servername, func(t *testing.T) {
+			got, err := tlsALPNChallengeIdentifier(&tls.ClientHelloInfo{ServerName: tt.servername, SupportedProtos: []string{ACME_TLS_ALPN_PROTOCOL}})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if got != tt.want {
+				t.Fatalf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
@@ -1,5 +1,23 @@
 package acme
 
+import "github.com/go-acme/lego/v4/challenge/tlsalpn01"
+
 const (
 	ACME_CHALLENGE_URL_PREFIX = "/.well-known/acme-challenge/"
+
+	// ACME_PEER_CHALLENGE_URL_PREFIX is the path of the requests between peers for http-01 challenges, see PeersConfig
+	ACME_PEER_CHALLENGE_URL_PREFIX = "/.well-known/https-hug/peer-challenge/"
+
+	// ACME_TLS_ALPN_PROTOCOL is the ALPN protocol negotiated by CAs validating tls-alpn-01 challenges
+	ACME_TLS_ALPN_PROTOCOL = tlsalpn01.ACMETLS1Protocol
+)
+
+// ACME profiles offered by Let's Encrypt, see https://letsencrypt.org/docs/profiles/
+const (
+	// ProfileClassic is the default profile, with 90-day certificates
+	ProfileClassic = "classic"
+	// ProfileTLSServer is like ProfileClassic but only for TLS server authentication
+	ProfileTLSServer = "tlsserver"
+	// ProfileShortLived issues 6-day certificates, it is required for IP address certificates
+	ProfileShortLived = "shortlived"
 )
@@ -0,0 +1,114 @@
+package acme
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/arthurweinmann/go-https-hug/internal/utils"
+	"github.com/go-acme/lego/v4/challenge"
+)
+
+var ErrNoChallengeDelegation = errors.New("the dns-01 challenge is not delegated")
+var ErrWrongChallengeDelegation = errors.New("the dns-01 challenge is delegated to the wrong name")
+
+// ChallengeDelegation describes where the TXT record of the dns-01 challenge of a domain is presented
+type ChallengeDelegation struct {
+	Domain string
+	// FQDN is _acme-challenge.<domain>.
+	FQDN string
+	// Target is the name the CNAME records of FQDN end up at, FQDN itself when there is none
+	Target string
+}
+
+// Delegated reports whether the _acme-challenge record of the domain is a CNAME to another name
+func (d *ChallengeDelegation) Delegated() bool {
+	return d.Target != d.FQDN
+}
+
+// LookupChallengeDelegation follows the CNAME records of _acme-challenge.<domain>
+func LookupChallengeDelegation(domain string) (*ChallengeDelegation, error) {
+	domain = strings.ToLower(strings.TrimSuffix(strings.TrimPrefix(domain, "*."), "."))
+	fqdn := "_acme-challenge." + domain + "."
+
+	target, err := utils.LookupCNAMETarget(fqdn)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ChallengeDelegation{
+		Domain: domain,
+		FQDN:   fqdn,
+		Target: target,
+	}, nil
+}
+
+// VerifyChallengeDelegation tells whether the customer owning domain set up the delegation of its dns-01 challenge,
+// that is a CNAME record from _acme-challenge.<domain> to target, a name in a zone our DNSProvider manages.
+// It returns ErrNoChallengeDelegation or ErrWrongChallengeDelegation, wrapped with the record to create, when it is not the case.
+func VerifyChallengeDelegation(domain, target string) (*ChallengeDelegation, error) {
+	d, err := LookupChallengeDelegation(domain)
+	if err != nil {
+		return nil, err
+	}
+
+	target = strings.ToLower(strings.TrimSuffix(target, ".")) + "."
+
+	if !d.Delegated() {
+		return d, fmt.Errorf("%w: %s needs a CNAME record to %s", ErrNoChallengeDelegation, d.FQDN, target)
+	}
+
+	if d.Target != target {
+		return d, fmt.Errorf("%w: %s points at %s instead of %s", ErrWrongChallengeDelegation, d.FQDN, d.Target, target)
+	}
+
+	return d, nil
+}
+
+// delegatedDNSProvider follows the CNAME delegation of _acme-challenge records before calling a DNSProvider.
+// When the delegation target is itself an _acme-challenge record, for example
+// _acme-challenge.customer.com CNAME _acme-challenge.customer.acme.example.net,
+// the provider is called for the aliased domain, customer.acme.example.net, so that any provider
+// presents the TXT record in the delegated zone, even the ones that do not follow CNAMEs on their own.
+type delegatedDNSProvider struct {
+	p challenge.Provider
+}
+
+func (d *delegatedDNSProvider) Present(domain, token, keyAuth string) error {
+	return d.p.Present(d.alias(domain), token, keyAuth)
+}
+
+func (d *delegatedDNSProvider) CleanUp(domain, token, keyAuth string) error {
+	return d.p.CleanUp(d.alias(domain), token, keyAuth)
+}
+
+func (d *delegatedDNSProvider) Timeout() (timeout, interval time.Duration) {
+	if t, ok := d.p.(challenge.ProviderTimeout); ok {
+		return t.Timeout()
+	}
+	return 2 * time.Minute, 2 * time.Second
+}
+
+func (d *delegatedDNSProvider) alias(domain string) string {
+	del, err := LookupChallengeDelegation(domain)
+	if err != nil {
+		// the provider may still follow the CNAME on its own
+		logger.Error("could not look up challenge delegation", slog.String("domain", domain), slog.String("error", err.Error()))
+		return domain
+	}
+
+	if !del.Delegated() {
+		return domain
+	}
+
+	logger.Info("dns-01 challenge is delegated", slog.String("fqdn", del.FQDN), slog.String("target", del.Target))
+
+	if strings.HasPrefix(del.Target, "_acme-challenge.") {
+		return strings.TrimSuffix(strings.TrimPrefix(del.Target, "_acme-challenge."), ".")
+	}
+
+	// lego providers present the TXT record at the EffectiveFQDN, which follows the CNAME records
+	return domain
+}
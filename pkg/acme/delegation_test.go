@@ -0,0 +1,116 @@
+package acme
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/arthurweinmann/go-https-hug/internal/dnstest"
+	"github.com/arthurweinmann/go-https-hug/internal/utils"
+	"github.com/arthurweinmann/go-https-hug/pkg/dnsresolver"
+)
+
+// useNameserver makes utils.DNSResolver query the nameserver at addr for the duration of the test
+func useNameserver(t *testing.T, addr string) {
+	t.Helper()
+
+	resolver, err := dnsresolver.New(&dnsresolver.Config{Nameservers: []string{addr}, Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prevResolver := utils.DNSResolver
+	utils.DNSResolver = resolver
+	t.Cleanup(func() { utils.DNSResolver = prevResolver })
+}
+
+var delegations = []string{
+	"_acme-challenge.customer.com. 60 IN CNAME _acme-challenge.customer.acme.example.net.",
+	"_acme-challenge.hops.com. 60 IN CNAME _acme-challenge.hops.example.org.",
+	"_acme-challenge.hops.example.org. 60 IN CNAME _acme-challenge.hops.acme.example.net.",
+	"_acme-challenge.other.com. 60 IN CNAME other.challenges.example.net.",
+	"_acme-challenge.wrong.com. 60 IN CNAME _acme-challenge.wrong.elsewhere.net.",
+}
+
+func TestVerifyChallengeDelegation(t *testing.T) {
+	useSettings(t, &InitParameters{})
+	useNameserver(t, dnstest.StartNameserver(t, delegations...))
+
+	tests := []struct {
+		domain, target string
+		err            error
+	}{
+		{domain: "customer.com", target: "_acme-challenge.customer.acme.example.net"},
+		{domain: "*.Customer.com.", target: "_ACME-challenge.customer.acme.example.net."},
+		{domain: "hops.com", target: "_acme-challenge.hops.acme.example.net"},
+		{domain: "plain.com", target: "_acme-challenge.plain.acme.example.net", err: ErrNoChallengeDelegation},
+		{domain: "wrong.com", target: "_acme-challenge.wrong.acme.example.net", err: ErrWrongChallengeDelegation},
+		{domain: "hops.com", target: "_acme-challenge.hops.example.org", err: ErrWrongChallengeDelegation},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.domain+" "+tt.target, func(t *testing.T) {
+			d, err := VerifyChallengeDelegation(tt.domain, tt.target)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("expected %v, got %v", tt.err, err)
+			}
+			if d == nil || d.FQDN != "_acme-challenge."+d.Domain+"." {
+				t.Fatalf("unexpected delegation %+v", d)
+			}
+			if d.Delegated() != (tt.err != ErrNoChallengeDelegation) {
+				t.Fatalf("unexpected delegation %+v", d)
+			}
+		})
+	}
+}
+
+// recordingProvider records the domains its challenges are presented for
+type recordingProvider struct {
+	presented, cleaned []string
+}
+
+func (p *recordingProvider) Present(domain, token, keyAuth string) error {
+	p.presented = append(p.presented, domain)
+	return nil
+}
+
+func (p *recordingProvider) CleanUp(domain, token, keyAuth string) error {
+	p.cleaned = append(p.cleaned, domain)
+	return nil
+}
+
+func TestDelegatedDNSProvider(t *testing.T) {
+	useSettings(t, &InitParameters{})
+	useNameserver(t, dnstest.StartNameserver(t, delegations...))
+
+	tests := []struct {
+		domain, want string
+	}{
+		// _acme-challenge targets are presented for the aliased domain
+		{domain: "customer.com", want: "customer.acme.example.net"},
+		{domain: "hops.com", want: "hops.acme.example.net"},
+		// the EffectiveFQDN computed by lego providers follows the other ones
+		{domain: "other.com", want: "other.com"},
+		{domain: "plain.com", want: "plain.com"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.domain, func(t *testing.T) {
+			p := &recordingProvider{}
+			d := &delegatedDNSProvider{p: p}
+
+			err := d.Present(tt.domain, "token", "keyauth")
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = d.CleanUp(tt.domain, "token", "keyauth")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(p.presented) != 1 || p.presented[0] != tt.want || len(p.cleaned) != 1 || p.cleaned[0] != tt.want {
+				t.Fatalf("expected %s to be presented and cleaned up, got %v and %v", tt.want, p.presented, p.cleaned)
+			}
+		})
+	}
+}
@@ -11,32 +11,60 @@ import (
 )
 
 // GetCertificate is for integration into a golang HTTPS server
-// Your HTTPS server then searches for existing certificates automatically
+// Your HTTPS server then searches for existing certificates automatically.
+// The certificate served must cover the requested server name, otherwise a new one is issued
+// if the server name is part of the AuthorizedDomains.
+// ClientHellos without SNI are served the certificate of the local IP address
+// the client connected to, if it is part of the AuthorizedIPs.
 func GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
 	logger.Info("GetCertificate", slog.String("helloServerName", hello.ServerName))
 
-	d, err := utils.FormatHelloServerName(hello.ServerName)
+	if IsTLSALPNChallengeHello(hello) {
+		return tlsALPNChallengeCertificate(hello)
+	}
+
+	d, err := helloServerName(hello)
 	if err != nil {
-		return nil, fmt.Errorf("FormatHelloServerName: %v", err)
+		return nil, err
 	}
 
-	rootdomain, err := utils.ExtractRootDomain(d)
+	return getCertificate(d)
+}
+
+// helloServerName returns the formatted SNI of hello or, when there is none,
+// the local IP address of the connection
+func helloServerName(hello *tls.ClientHelloInfo) (string, error) {
+	if hello.ServerName == "" {
+		ip, err := utils.LocalIP(hello.Conn)
+		if err != nil {
+			return "", fmt.Errorf("missing domain name and LocalIP: %v", err)
+		}
+		return ip, nil
+	}
+
+	d, err := utils.FormatHelloServerName(hello.ServerName)
 	if err != nil {
-		return nil, fmt.Errorf("ExtractRootDomain: %v", err)
+		return "", fmt.Errorf("FormatHelloServerName: %v", err)
 	}
 
-	cert, priv, err := RetrieveCertificate(rootdomain)
+	return d, nil
+}
+
+func tlsALPNChallengeCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	d, err := tlsALPNChallengeIdentifier(hello)
 	if err != nil {
-		return nil, fmt.Errorf("RetrieveCertificate: %v", err)
+		return nil, err
 	}
 
-	// TODO: cache those
-	tlscert, err := GenerateCert(cert, priv)
+	cert, err := GetTLSALPNChallengeCertificate(d)
 	if err != nil {
-		return nil, fmt.Errorf("GenerateCert: %v", err)
+		logger.Error("GetTLSALPNChallengeCertificate", slog.String("identifier", d), slog.String("err", err.Error()))
+		return nil, fmt.Errorf("GetTLSALPNChallengeCertificate: %v", err)
 	}
 
-	return tlscert, nil
+	logger.Info("served tls-alpn-01 challenge for", slog.String("identifier", d))
+
+	return cert, nil
 }
 
 type whiteListedGetCertificate struct {
@@ -52,6 +80,9 @@ func NewWhiteListedGetCertificate(whiteList []string) (WhiteListedGetCertificate
 		perRootDomain: map[string][]string{},
 	}
 	for _, d := range whiteList {
+		if ip, ok := utils.FormatIP(d); ok {
+			d = ip
+		}
 		ret.whiteList[strings.ToLower(d)] = true
 		rootdomain, err := utils.ExtractRootDomain(d)
 		if err != nil {
@@ -65,10 +96,14 @@ func NewWhiteListedGetCertificate(whiteList []string) (WhiteListedGetCertificate
 func (wlgc WhiteListedGetCertificate) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
 	logger.Info("GetCertificate", slog.String("helloServerName", hello.ServerName))
 
-	d, err := utils.FormatHelloServerName(hello.ServerName)
+	if IsTLSALPNChallengeHello(hello) {
+		return tlsALPNChallengeCertificate(hello)
+	}
+
+	d, err := helloServerName(hello)
 	if err != nil {
 		logger.Error("error formatting hello servername", slog.String("error", err.Error()))
-		return nil, fmt.Errorf("FormatHelloServerName: %v", err)
+		return nil, err
 	}
 
 	rootdomain, err := utils.ExtractRootDomain(d)
@@ -77,46 +112,28 @@ func (wlgc WhiteListedGetCertificate) GetCertificate(hello *tls.ClientHelloInfo)
 		return nil, fmt.Errorf("ExtractRootDomain: %v", err)
 	}
 
-	cert, priv, err := RetrieveCertificate(rootdomain)
-	if err != nil && err != ErrCertificateNotFound && err != ErrCertificateExpired {
-		logger.Error("error retrieving certificate", slog.String("error", err.Error()))
-		return nil, fmt.Errorf("RetrieveCertificate: %v", err)
-	}
-	if len(cert) > 0 {
-		// TODO: cache those
-		tlscert, err := GenerateCert(cert, priv)
-		if err != nil {
-			logger.Error("error generating certificate", slog.String("error", err.Error()))
-			return nil, fmt.Errorf("GenerateCert: %v", err)
+	return certificateForServerName(d, rootdomain, func() ([]string, error) {
+		if !wlgc.isWhiteListed(d) {
+			return nil, fmt.Errorf("domain %s is not whitelisted for ssl", d)
 		}
-		return tlscert, nil
-	}
 
-	if !wlgc.whiteList[d] {
-		var found bool
-		for wd := range wlgc.whiteList {
-			if utils.EqualDomain(wd, d) {
-				found = true
-				break
-			}
-		}
-		if !found {
-			logger.Error("unauthorized ssl domain name", slog.String("helloServerName", hello.ServerName))
-			return nil, fmt.Errorf("domain %s is not whitelisted for ssl", d)
+		domains := wlgc.perRootDomain[rootdomain]
+		if !CertificateDomainsCover(domains, d) {
+			domains = append(append([]string{}, domains...), d)
 		}
-	}
 
-	cert, priv, err = CreateCertificate(rootdomain, wlgc.perRootDomain[rootdomain], true)
-	if err != nil {
-		logger.Error("error creating certificate", slog.String("error", err.Error()))
-		return nil, fmt.Errorf("ExtractRootDomain: %v", err)
-	}
+		return domains, nil
+	})
+}
 
-	// TODO: cache those
-	tlscert, err := GenerateCert(cert, priv)
-	if err != nil {
-		logger.Error("error generating certificate", slog.String("error", err.Error()))
-		return nil, fmt.Errorf("GenerateCert: %v", err)
+func (wlgc WhiteListedGetCertificate) isWhiteListed(d string) bool {
+	if wlgc.whiteList[d] {
+		return true
+	}
+	for wd := range wlgc.whiteList {
+		if utils.EqualDomain(wd, d) {
+			return true
+		}
 	}
-	return tlscert, nil
+	return false
 }
@@ -3,16 +3,22 @@ package acme
 import (
 	"bytes"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/gob"
 	"errors"
 	"fmt"
+	"log/slog"
+	"net"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/arthurweinmann/go-https-hug/internal/utils"
 	"github.com/arthurweinmann/go-https-hug/pkg/storage"
+	"github.com/go-acme/lego/v4/certcrypto"
 	"github.com/go-acme/lego/v4/certificate"
+	"github.com/go-acme/lego/v4/challenge"
+	"github.com/go-acme/lego/v4/challenge/dns01"
 	"github.com/go-acme/lego/v4/lego"
 	"github.com/go-acme/lego/v4/registration"
 )
@@ -25,10 +31,13 @@ var client *lego.Client
 var reg *registration.Resource
 var createMu sync.RWMutex
 var httpChal *HTTPChallenger
+var domainClients map[string]*lego.Client
 
 func createHandler(us *ACMEUser, isnew bool) error {
 	var err error
 
+	domainClients = map[string]*lego.Client{}
+
 	legoconfig = lego.NewConfig(us)
 	legoconfig.CADirURL = lego.LEDirectoryProduction
 
@@ -38,18 +47,12 @@ func createHandler(us *ACMEUser, isnew bool) error {
 	}
 
 	httpChal = &HTTPChallenger{}
-	err = client.Challenge.SetHTTP01Provider(httpChal)
+	types, dnsProvider := challengesFor("")
+	err = setChallengeProviders(client, types, dnsProvider)
 	if err != nil {
 		return err
 	}
 
-	if settings.DNSChallenges {
-		err = client.Challenge.SetDNS01Provider(settings.DNSProvider)
-		if err != nil {
-			return err
-		}
-	}
-
 	if isnew {
 		// New users will need to register
 		reg, err = client.Registration.Register(registration.RegisterOptions{TermsOfServiceAgreed: true})
@@ -73,30 +76,182 @@ func createHandler(us *ACMEUser, isnew bool) error {
 	return nil
 }
 
+// defaultChallenges returns the challenge types enabled by the global settings
+func defaultChallenges() []challenge.Type {
+	types := []challenge.Type{challenge.HTTP01}
+	if settings.DNSChallenges {
+		types = append(types, challenge.DNS01)
+	}
+	if settings.TLSALPNChallenges {
+		types = append(types, challenge.TLSALPN01)
+	}
+	return types
+}
+
+// challengesFor returns the challenge types and the DNS provider used for the orders of rootdomain.
+// The DNS provider follows the CNAME delegations of _acme-challenge records, see delegatedDNSProvider.
+func challengesFor(rootdomain string) ([]challenge.Type, challenge.Provider) {
+	types, dnsProvider := defaultChallenges(), settings.DNSProvider
+
+	if dc := settings.DomainConfigs[rootdomain]; dc != nil {
+		if len(dc.Challenges) > 0 {
+			types = dc.Challenges
+		}
+		if dc.DNSProvider != nil {
+			dnsProvider = dc.DNSProvider
+		}
+	}
+
+	if dnsProvider != nil {
+		dnsProvider = &delegatedDNSProvider{p: dnsProvider}
+	}
+
+	return types, dnsProvider
+}
+
+func setChallengeProviders(c *lego.Client, types []challenge.Type, dnsProvider challenge.Provider) error {
+	for _, t := range types {
+		var err error
+		switch t {
+		case challenge.HTTP01:
+			err = c.Challenge.SetHTTP01Provider(httpChal)
+		case challenge.DNS01:
+			if dnsProvider == nil {
+				return fmt.Errorf("the dns-01 challenge needs a DNSProvider")
+			}
+			err = c.Challenge.SetDNS01Provider(dnsProvider, dns01Options()...)
+		case challenge.TLSALPN01:
+			err = c.Challenge.SetTLSALPN01Provider(&TLSALPNChallenger{})
+		default:
+			return fmt.Errorf("unsupported challenge type %s", t)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dns01Options makes lego check the propagation of dns-01 challenges with the Resolver of the settings, if any
+func dns01Options() []dns01.ChallengeOption {
+	if settings.Resolver == nil {
+		return nil
+	}
+
+	opts := []dns01.ChallengeOption{
+		dns01.AddDNSTimeout(utils.DNSResolver.Timeout()),
+		dns01.WrapPreCheck(func(domain, fqdn, value string, check dns01.PreCheckFunc) (bool, error) {
+			return utils.VerifyTXT(fqdn, value)
+		}),
+	}
+
+	// lego follows the CNAMEs of _acme-challenge records with plain DNS nameservers only
+	if ns := utils.DNSResolver.Nameservers(); len(ns) > 0 {
+		opts = append(opts, dns01.AddRecursiveNameservers(ns))
+	}
+
+	return opts
+}
+
+// clientFor returns the lego client solving the challenges of rootdomain, lego choosing among the
+// enabled challenges for every authorization. Root domains with their own challenge policy in
+// DomainConfigs get their own client, sharing our ACME account.
+func clientFor(rootdomain string) (*lego.Client, error) {
+	dc := settings.DomainConfigs[rootdomain]
+	if dc == nil || (len(dc.Challenges) == 0 && dc.DNSProvider == nil) {
+		return client, nil
+	}
+
+	createMu.RLock()
+	c, ok := domainClients[rootdomain]
+	createMu.RUnlock()
+	if ok {
+		return c, nil
+	}
+
+	createMu.Lock()
+	defer createMu.Unlock()
+
+	if c, ok := domainClients[rootdomain]; ok {
+		return c, nil
+	}
+
+	c, err := lego.NewClient(legoconfig)
+	if err != nil {
+		return nil, err
+	}
+
+	types, dnsProvider := challengesFor(rootdomain)
+	err = setChallengeProviders(c, types, dnsProvider)
+	if err != nil {
+		return nil, fmt.Errorf("challenges of %s: %v", rootdomain, err)
+	}
+
+	domainClients[rootdomain] = c
+
+	return c, nil
+}
+
+// CreateCertificate issues a certificate for domains and stores it under rootdomain. With lock, it returns nils
+// if the certificate is already being issued, and the stored certificate if it covers domains and is not due
+// for renewal, another node having issued it since it was read.
 func CreateCertificate(rootdomain string, domains []string, lock bool) ([]byte, []byte, error) {
 	var certificates *certificate.Resource
 	var err error
 
+	var l *certLock
 	if lock {
-		ok, err := settings.Store.LockCert(rootdomain, 5*time.Minute)
+		l, err = lockCert(rootdomain)
+		if err == storage.ErrLockHeld {
+			return nil, nil, nil
+		}
 		if err != nil {
 			return nil, nil, err
 		}
-		if !ok {
-			return nil, nil, nil
+		defer l.Unlock()
+
+		// another node may have issued it since we read the record, from a cache which may be stale
+		if cert, key, ok := currentCertificate(rootdomain, domains); ok {
+			return cert, key, nil
+		}
+	}
+
+	if settings.PreflightChecks {
+		err = Preflight(domains)
+		if err != nil {
+			return nil, nil, err
 		}
-		defer settings.Store.UnlockCert(rootdomain)
 	}
 
-	certificates, err = client.Certificate.Obtain(certificate.ObtainRequest{
+	c, err := clientFor(rootdomain)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// someone else may be issuing the same certificate since our lease expired, during the preflight checks
+	if l != nil && l.Lost() {
+		return nil, nil, fmt.Errorf("%s: %w", rootdomain, ErrLockLost)
+	}
+
+	profile := profileFor(rootdomain)
+
+	certificates, err = c.Certificate.Obtain(certificate.ObtainRequest{
 		Domains: domains,
 		Bundle:  true,
+		Profile: profile,
 	})
 	if err != nil {
 		return nil, nil, err
 	}
 
-	err = storeCertificate(rootdomain, domains, certificates.Certificate, certificates.PrivateKey)
+	// even if our lease expired meanwhile, the certificate is stored unless one issued under a later lease was
+	var token uint64
+	var epoch string
+	if l != nil {
+		token, epoch = l.Token(), l.Epoch()
+	}
+
+	err = storeCertificate(rootdomain, domains, profile, certificates.Certificate, certificates.PrivateKey, token, epoch)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -104,41 +259,135 @@ func CreateCertificate(rootdomain string, domains []string, lock bool) ([]byte,
 	return certificates.Certificate, certificates.PrivateKey, nil
 }
 
-func getCertificate(domain string) (*tls.Certificate, error) {
-	cert, priv, err := RetrieveCertificate(domain)
+// getCertificate returns a certificate covering servername, issuing one for the root domain and its
+// authorized subdomains when none of the stored certificates does.
+func getCertificate(servername string) (*tls.Certificate, error) {
+	rootdomain, err := utils.ExtractRootDomain(servername)
 	if err != nil {
-		switch err {
-		case ErrCertificateNotFound, ErrCertificateExpired:
-		default:
-			return nil, fmt.Errorf("RetrieveCertificate: %v", err)
-		}
+		return nil, fmt.Errorf("ExtractRootDomain: %v", err)
+	}
+	rootdomain = strings.ToLower(rootdomain)
 
-		rootdomain, err := utils.ExtractRootDomain(domain)
-		if err != nil {
-			return nil, err
+	return certificateForServerName(servername, rootdomain, func() ([]string, error) {
+		if _, ok := utils.FormatIP(servername); ok {
+			if !authorizedIPs[servername] {
+				return nil, fmt.Errorf("The IP address %s is not authorized", servername)
+			}
+			return []string{servername}, nil
 		}
-		rootdomain = strings.ToLower(rootdomain)
-
-		var domains []string
 
 		authd, ok := settings.AuthorizedDomains[rootdomain]
 		if !ok {
-			return nil, fmt.Errorf("The root domain %s is not authorized", domain)
+			return nil, fmt.Errorf("The root domain %s is not authorized", rootdomain)
 		}
 
-		domains = append(domains, rootdomain)
-		domains = append(domains, authd...)
+		domains := append([]string{rootdomain}, authd...)
+		if !CertificateDomainsCover(domains, servername) {
+			return nil, fmt.Errorf("The domain %s is not authorized", servername)
+		}
 
-		cert, priv, err = CreateCertificate(rootdomain, domains, true)
+		return domains, nil
+	})
+}
+
+// certificateForServerName looks up the certificate stored for rootdomain and checks that its SANs
+// cover servername. If there is no such certificate, if it expired or if it does not cover servername,
+// a new one is issued for the domains returned by authorized, merged with the ones of the stored certificate
+// so that we do not drop names it already served.
+func certificateForServerName(servername, rootdomain string, authorized func() ([]string, error)) (*tls.Certificate, error) {
+	rec, err := retrieveCertificateRecord(rootdomain)
+	if err != nil && err != ErrCertificateNotFound && err != ErrCertificateExpired {
+		logger.Error("error retrieving certificate", slog.String("error", err.Error()))
+		return nil, fmt.Errorf("RetrieveCertificate: %v", err)
+	}
+
+	if err == nil {
+		tlscert, err := GenerateCert(rec.Certificate, rec.PrivateKey)
 		if err != nil {
-			return nil, err
+			logger.Error("error generating certificate", slog.String("error", err.Error()))
+			return nil, fmt.Errorf("GenerateCert: %v", err)
 		}
-		if cert == nil {
-			return nil, nil
+
+		if CertificateCovers(tlscert.Leaf, servername) {
+			return tlscert, nil
 		}
+
+		logger.Info("stored certificate does not cover server name",
+			slog.String("helloServerName", servername), slog.String("rootDomain", rootdomain))
+	}
+
+	domains, err := authorized()
+	if err != nil {
+		logger.Error("unauthorized ssl domain name", slog.String("helloServerName", servername), slog.String("error", err.Error()))
+		return nil, err
+	}
+
+	if rec != nil {
+		domains = mergeDomains(rec.Domains, domains)
+	}
+
+	cert, priv, err := CreateCertificate(rootdomain, domains, true)
+	if err != nil {
+		logger.Error("error creating certificate", slog.String("error", err.Error()))
+		return nil, fmt.Errorf("CreateCertificate: %v", err)
+	}
+	if cert == nil {
+		return nil, fmt.Errorf("the certificate of %s is already being issued", rootdomain)
 	}
 
-	return GenerateCert(cert, priv)
+	// TODO: cache those
+	tlscert, err := GenerateCert(cert, priv)
+	if err != nil {
+		logger.Error("error generating certificate", slog.String("error", err.Error()))
+		return nil, fmt.Errorf("GenerateCert: %v", err)
+	}
+
+	return tlscert, nil
+}
+
+// CertificateCovers reports whether one of the DNS SANs of leaf, wildcards included, matches servername.
+// If servername is an IP address, it is matched against the IP SANs of leaf instead.
+func CertificateCovers(leaf *x509.Certificate, servername string) bool {
+	if leaf == nil {
+		return false
+	}
+
+	if ip := net.ParseIP(servername); ip != nil {
+		for _, lip := range leaf.IPAddresses {
+			if lip.Equal(ip) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return CertificateDomainsCover(leaf.DNSNames, servername)
+}
+
+// CertificateDomainsCover reports whether one of domains, wildcards included, matches servername.
+func CertificateDomainsCover(domains []string, servername string) bool {
+	for _, d := range domains {
+		if utils.MatchCertificateDomain(d, servername) {
+			return true
+		}
+	}
+	return false
+}
+
+func mergeDomains(lists ...[]string) []string {
+	seen := map[string]bool{}
+	var ret []string
+	for _, l := range lists {
+		for _, d := range l {
+			d = strings.ToLower(d)
+			if seen[d] {
+				continue
+			}
+			seen[d] = true
+			ret = append(ret, d)
+		}
+	}
+	return ret
 }
 
 func ToggleCertificate(domains []string) error {
@@ -162,33 +411,104 @@ func ToggleCertificate(domains []string) error {
 	return nil
 }
 
+// certificateRecord is what we store under certificates/<rootdomain>
+type certificateRecord struct {
+	// Deadline is when we start renewing the certificate
+	Deadline    int64
+	RootDomain  string
+	Domains     []string
+	Certificate []byte
+	PrivateKey  []byte
+
+	// Profile is the ACME profile the certificate was ordered with, empty for the CA default one
+	Profile string
+	// NotAfter is the expiration of the certificate, zero for records stored before we kept track of it
+	NotAfter int64
+	// LockToken is the fencing token of the lease under which the certificate was issued, zero if none
+	LockToken uint64
+	// LockEpoch is the epoch of LockToken, the tokens of another epoch are not compared to it
+	LockEpoch string
+}
+
 // TODO: store the list of subdomains too in order to recreate the cert if this list has changed
-func storeCertificate(rootdomain string, domains []string, certificate, privateKey []byte) error {
+// A non zero token is the fencing token of the lock held while issuing the certificate, the record is then
+// not stored if one issued under a later lease of the same epoch already was. Records of another epoch,
+// for example issued before moving to another Store, are replaced.
+func storeCertificate(rootdomain string, domains []string, profile string, certificate, privateKey []byte, token uint64, epoch string) error {
+	notBefore, notAfter, err := certificateValidity(certificate)
+	if err != nil {
+		return err
+	}
+
 	var buf bytes.Buffer
 	enc := gob.NewEncoder(&buf)
 
-	err := enc.Encode(struct {
-		Deadline    int64
-		RootDomain  string
-		Domains     []string
-		Certificate []byte
-		PrivateKey  []byte
-	}{
-		Deadline:    time.Now().Add(744 * time.Hour).Unix(), // renew in a month do not wait the 3
+	err = enc.Encode(&certificateRecord{
+		Deadline:    renewalDeadline(notBefore, notAfter).Unix(),
 		RootDomain:  rootdomain,
 		Domains:     domains,
 		Certificate: certificate,
 		PrivateKey:  privateKey,
+		Profile:     profile,
+		NotAfter:    notAfter.Unix(),
+		LockToken:   token,
+		LockEpoch:   epoch,
 	})
 	if err != nil {
 		return err
 	}
 
 	b := buf.Bytes()
+	key := "certificates/" + rootdomain
 
-	err = settings.Store.SetKV("certificates/"+rootdomain, b, 0)
-	if err != nil {
-		return err
+	// with a Store able to compare and swap, the fencing check and the write are atomic
+	cas, ok := settings.Store.(storage.CompareAndSwapper)
+	if token == 0 && !ok {
+		err = settings.Store.SetKV(key, b, 0)
+		if err != nil {
+			return err
+		}
+	} else {
+		for attempt := 0; ; attempt++ {
+			// the fencing check and the swap must not use a cached value
+			prev, err := storage.GetFresh(settings.Store, key)
+			if err != nil && err != storage.ErrNotFound {
+				return err
+			}
+			if err == storage.ErrNotFound {
+				prev = nil
+			}
+
+			if token > 0 && prev != nil {
+				q := &certificateRecord{}
+				if gob.NewDecoder(bytes.NewReader(prev)).Decode(q) == nil && q.LockEpoch == epoch && q.LockToken > token {
+					return fmt.Errorf("%s: %w, a certificate issued under a later lease was stored", rootdomain, ErrLockLost)
+				}
+			}
+
+			if !ok {
+				err = settings.Store.SetKV(key, b, 0)
+				if err != nil {
+					return err
+				}
+				break
+			}
+
+			swapped, err := cas.CompareAndSwapKV(key, prev, b, 0)
+			if errors.Is(err, errors.ErrUnsupported) {
+				ok = false
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if swapped {
+				break
+			}
+			if attempt >= 3 {
+				return fmt.Errorf("%s: the certificate record keeps being updated concurrently", rootdomain)
+			}
+		}
 	}
 
 	if cache != nil {
@@ -199,7 +519,18 @@ func storeCertificate(rootdomain string, domains []string, certificate, privateK
 }
 
 func RetrieveCertificate(domain string) (certificate, privateKey []byte, err error) {
+	q, err := retrieveCertificateRecord(domain)
+	if err != nil {
+		return nil, nil, err
+	}
+	return q.Certificate, q.PrivateKey, nil
+}
+
+// retrieveCertificateRecord also returns the record along with ErrCertificateExpired
+// so that callers may reuse its list of domains to issue a new one.
+func retrieveCertificateRecord(domain string) (*certificateRecord, error) {
 	var b []byte
+	var err error
 
 	if cache != nil {
 		b = cache.Get(nil, []byte(domain))
@@ -211,7 +542,7 @@ func RetrieveCertificate(domain string) (certificate, privateKey []byte, err err
 			if err == storage.ErrNotFound {
 				err = ErrCertificateNotFound
 			}
-			return
+			return nil, err
 		}
 
 		if cache != nil {
@@ -221,34 +552,31 @@ func RetrieveCertificate(domain string) (certificate, privateKey []byte, err err
 
 	dec := gob.NewDecoder(bytes.NewReader(b))
 
-	var q struct {
-		Deadline    int64
-		RootDomain  string
-		Domains     []string
-		Certificate []byte
-		PrivateKey  []byte
-	}
-	err = dec.Decode(&q)
+	q := &certificateRecord{}
+	err = dec.Decode(q)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
-	deadline := time.Unix(q.Deadline, 0)
+	deadline, notAfter, err := q.validity()
+	if err != nil {
+		return nil, err
+	}
 	now := time.Now()
 
-	// renewal only
-	if now.After(deadline) {
+	// renewal only, a change of the configured profile also calls for a new certificate
+	if now.After(deadline) || q.Profile != profileFor(q.RootDomain) {
 		go func() {
-			ok, err := settings.Store.LockCert(q.RootDomain+"##@@##renewal", 5*time.Minute)
-			if err != nil {
-				fmt.Println("Could not lock certificate for renewal:", q.RootDomain, err)
+			l, err := lockCert(q.RootDomain + "##@@##renewal")
+			if err == storage.ErrLockHeld {
+				// another goroutine is already renewing
 				return
 			}
-			if !ok {
-				// another goroutine is already renewing
+			if err != nil {
+				fmt.Println("Could not lock certificate for renewal:", q.RootDomain, err)
 				return
 			}
-			defer settings.Store.UnlockCert(q.RootDomain + "##@@##renewal")
+			defer l.Unlock()
 
 			_, _, err = CreateCertificate(q.RootDomain, q.Domains, true)
 			if err != nil {
@@ -257,24 +585,88 @@ func RetrieveCertificate(domain string) (certificate, privateKey []byte, err err
 			}
 		}()
 
-		// Let's encrypt certificates are good for 3 months
-		if now.Sub(deadline) > 1116*time.Hour {
-			return nil, nil, ErrCertificateExpired
+		// Certificates lifetimes depend on the profile, from a few days for short-lived ones to 3 months
+		if now.After(notAfter) {
+			return q, ErrCertificateExpired
 		}
 	}
 
-	certificate = q.Certificate
-	privateKey = q.PrivateKey
+	return q, nil
+}
+
+// validity returns when the certificate of the record should be renewed and when it expires
+func (q *certificateRecord) validity() (deadline, notAfter time.Time, err error) {
+	if q.NotAfter != 0 {
+		return time.Unix(q.Deadline, 0), time.Unix(q.NotAfter, 0), nil
+	}
+
+	notBefore, notAfter, err := certificateValidity(q.Certificate)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+
+	return renewalDeadline(notBefore, notAfter), notAfter, nil
+}
+
+// currentCertificate returns the certificate stored for rootdomain if it covers domains and is not due for renewal,
+// reading it from the Store and not from a cache
+func currentCertificate(rootdomain string, domains []string) (certificate, privateKey []byte, ok bool) {
+	b, err := storage.GetFresh(settings.Store, "certificates/"+rootdomain)
+	if err != nil {
+		return nil, nil, false
+	}
+
+	q := &certificateRecord{}
+	err = gob.NewDecoder(bytes.NewReader(b)).Decode(q)
+	if err != nil {
+		return nil, nil, false
+	}
+
+	deadline, _, err := q.validity()
+	if err != nil || time.Now().After(deadline) || q.Profile != profileFor(rootdomain) {
+		return nil, nil, false
+	}
+	if len(mergeDomains(q.Domains, domains)) != len(mergeDomains(q.Domains)) {
+		return nil, nil, false
+	}
+
+	if cache != nil {
+		cache.Set([]byte(rootdomain), b)
+	}
+
+	return q.Certificate, q.PrivateKey, true
+}
 
-	return
+// renewalDeadline returns the time at which a certificate valid from notBefore to notAfter
+// should be renewed, that is when a third of its lifetime remains. This follows the recommendation
+// of Let's Encrypt and works for 90-day certificates as well as for 6-day short-lived ones.
+func renewalDeadline(notBefore, notAfter time.Time) time.Time {
+	return notAfter.Add(-notAfter.Sub(notBefore) / 3)
+}
+
+// certificateValidity returns the validity period of the leaf of a PEM encoded certificate bundle
+func certificateValidity(certificate []byte) (notBefore, notAfter time.Time, err error) {
+	leaf, err := certcrypto.ParsePEMCertificate(certificate)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	return leaf.NotBefore, leaf.NotAfter, nil
 }
 
 func GenerateCert(certificate []byte, privateKey []byte) (*tls.Certificate, error) {
-	// Leaf is nil when using this method, see if we need to provide id
-	// See https://stackoverflow.com/questions/43605755/whats-the-leaf-certificate-and-sub-certificate-used-for-and-how-to-use-them
 	cert, err := tls.X509KeyPair(certificate, privateKey)
 	if err != nil {
 		return nil, err
 	}
+
+	// Leaf is not always populated by tls.X509KeyPair, we need it to match the SANs against the requested server name
+	// See https://stackoverflow.com/questions/43605755/whats-the-leaf-certificate-and-sub-certificate-used-for-and-how-to-use-them
+	if cert.Leaf == nil {
+		cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	return &cert, nil
 }
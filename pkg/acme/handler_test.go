@@ -0,0 +1,508 @@
+package acme
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/arthurweinmann/go-https-hug/pkg/storage"
+	"github.com/arthurweinmann/go-https-hug/pkg/storage/stores/filesystem"
+	"github.com/arthurweinmann/go-https-hug/pkg/storage/stores/memory"
+	"github.com/arthurweinmann/go-https-hug/pkg/storage/stores/tiered"
+	"github.com/go-acme/lego/v4/challenge"
+	"github.com/go-acme/lego/v4/lego"
+)
+
+// testCertificate returns a PEM self-signed certificate for example.com valid from notBefore to notAfter
+func testCertificate(t *testing.T, notBefore, notAfter time.Time) []byte {
+	t.Helper()
+	cert, _ := testKeyPair(t, notBefore, notAfter, "example.com")
+	return cert
+}
+
+// testKeyPair returns a PEM self-signed certificate for names valid from notBefore to notAfter, and its PEM key
+func testKeyPair(t *testing.T, notBefore, notAfter time.Time, names ...string) (certificate, privateKey []byte) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		DNSNames:     names,
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// useSettings sets the settings of the package for the duration of the test, with a memory Store if p has none
+func useSettings(t *testing.T, p *InitParameters) {
+	t.Helper()
+
+	prevSettings, prevLogger, prevCache := settings, logger, cache
+	t.Cleanup(func() { settings, logger, cache = prevSettings, prevLogger, prevCache })
+
+	if p.Store == nil {
+		p.Store = memory.NewStore()
+	}
+	settings, logger, cache = p, slog.New(slog.NewJSONHandler(io.Discard, nil)), nil
+}
+
+func TestRenewedByAnotherNode(t *testing.T) {
+	useSettings(t, &InitParameters{})
+
+	// two nodes caching a shared Store
+	remote := memory.NewStore()
+	nodes := make([]storage.Store, 2)
+	for i := range nodes {
+		s, err := tiered.NewStore(&tiered.Config{Local: memory.NewStore(), Remote: remote, LocalTTL: time.Hour})
+		if err != nil {
+			t.Fatal(err)
+		}
+		nodes[i] = s
+	}
+
+	now := time.Now()
+	domains := []string{"example.com"}
+	due := testCertificate(t, now.Add(-80*24*time.Hour), now.Add(10*24*time.Hour))
+	renewed := testCertificate(t, now, now.Add(90*24*time.Hour))
+
+	// the first node caches a certificate due for renewal, which the other node renews
+	settings = &InitParameters{Store: nodes[0]}
+	err := storeCertificate("example.com", domains, "", due, []byte("key"), 1, "epoch")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	settings = &InitParameters{Store: nodes[1]}
+	err = storeCertificate("example.com", domains, "", renewed, []byte("renewed key"), 5, "epoch")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	settings = &InitParameters{Store: nodes[0]}
+	// not with retrieveCertificateRecord, which would start renewing it in the background
+	b, err := nodes[0].GetKV("certificates/example.com")
+	if err != nil || !bytes.Contains(b, due) {
+		t.Fatalf("expected the first node to read its stale copy, got %v", err)
+	}
+
+	// the first node does not order a certificate, which would fail without an ACME client
+	cert, key, err := CreateCertificate("example.com", domains, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(cert, renewed) || string(key) != "renewed key" {
+		t.Fatalf("expected the certificate renewed by the other node")
+	}
+
+	// the fencing check uses the record of the shared Store, not the cached one
+	err = storeCertificate("example.com", domains, "", due, []byte("key"), 3, "epoch")
+	if !errors.Is(err, ErrLockLost) {
+		t.Fatalf("expected ErrLockLost for an earlier lease, got %v", err)
+	}
+
+	err = storeCertificate("example.com", domains, "", renewed, []byte("later key"), 6, "epoch")
+	if err != nil {
+		t.Fatalf("expected a later lease to store its certificate, got %v", err)
+	}
+	b, err = remote.GetKV("certificates/example.com")
+	if err != nil || !bytes.Contains(b, []byte("later key")) {
+		t.Fatalf("expected the certificate of the later lease to be stored, got %v", err)
+	}
+}
+
+func TestMigratedLockStore(t *testing.T) {
+	useSettings(t, &InitParameters{})
+
+	fs, err := filesystem.NewStore(t.TempDir(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	domains := []string{"example.com"}
+	cert := testCertificate(t, now, now.Add(90*24*time.Hour))
+
+	// a certificate issued under many leases of the filesystem Store
+	var lease *storage.Lease
+	for range 3 {
+		lease, err = fs.LockCert("example.com", "a", time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = fs.UnlockCert(lease)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	settings = &InitParameters{Store: fs}
+	err = storeCertificate("example.com", domains, "", cert, []byte("key"), lease.Token, lease.Epoch)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the records are copied to another Store, whose lock tokens start over
+	b, err := fs.GetKV("certificates/example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	moved := memory.NewStore()
+	err = moved.SetKV("certificates/example.com", b, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := moved.LockCert("example.com", "a", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Token >= lease.Token {
+		t.Fatalf("expected the token of the new Store to be lower, got %d and %d", first.Token, lease.Token)
+	}
+	err = moved.UnlockCert(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := moved.LockCert("example.com", "a", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	settings = &InitParameters{Store: moved}
+	err = storeCertificate("example.com", domains, "", cert, []byte("renewed key"), second.Token, second.Epoch)
+	if err != nil {
+		t.Fatalf("expected the certificate to be stored under the lease of the new Store, got %v", err)
+	}
+
+	// within the epoch of the new Store, fencing applies again
+	err = storeCertificate("example.com", domains, "", cert, []byte("key"), first.Token, first.Epoch)
+	if !errors.Is(err, ErrLockLost) {
+		t.Fatalf("expected ErrLockLost for an earlier lease, got %v", err)
+	}
+}
+
+func TestMergeDomains(t *testing.T) {
+	tests := []struct {
+		name  string
+		lists [][]string
+		want  []string
+	}{
+		{name: "empty", lists: nil, want: nil},
+		{name: "one list", lists: [][]string{{"example.com", "www.example.com"}}, want: []string{"example.com", "www.example.com"}},
+		{name: "duplicates", lists: [][]string{{"example.com", "example.com"}}, want: []string{"example.com"}},
+		{name: "case", lists: [][]string{{"Example.COM", "example.com"}}, want: []string{"example.com"}},
+		{
+			// the domains of a stored record come first, the authorized ones are added
+			name:  "existing record",
+			lists: [][]string{{"example.com", "www.example.com"}, {"example.com", "API.example.com", "www.example.com"}},
+			want:  []string{"example.com", "www.example.com", "api.example.com"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mergeDomains(tt.lists...); !slices.Equal(got, tt.want) {
+				t.Fatalf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestCertificateForServerName(t *testing.T) {
+	errUnauthorized := errors.New("unauthorized")
+
+	tests := []struct {
+		name       string
+		names      []string
+		servername string
+		covered    bool
+	}{
+		{name: "exact", names: []string{"example.com"}, servername: "example.com", covered: true},
+		{name: "other name", names: []string{"example.com"}, servername: "www.example.com"},
+		{name: "wildcard", names: []string{"*.example.com"}, servername: "www.example.com", covered: true},
+		{name: "wildcard apex", names: []string{"*.example.com"}, servername: "example.com"},
+		{name: "wildcard two labels deep", names: []string{"*.example.com"}, servername: "a.b.example.com"},
+		{name: "wildcard and apex", names: []string{"example.com", "*.example.com"}, servername: "example.com", covered: true},
+		{name: "case", names: []string{"example.com"}, servername: "EXAMPLE.com", covered: true},
+		{name: "trailing dot", names: []string{"*.example.com"}, servername: "www.example.com.", covered: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useSettings(t, &InitParameters{})
+
+			now := time.Now()
+			cert, key := testKeyPair(t, now, now.Add(90*24*time.Hour), tt.names...)
+			err := storeCertificate("example.com", tt.names, "", cert, key, 0, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// a new certificate is only ordered for authorized domains, none here
+			var asked bool
+			tlscert, err := certificateForServerName(tt.servername, "example.com", func() ([]string, error) {
+				asked = true
+				return nil, errUnauthorized
+			})
+
+			if tt.covered {
+				if err != nil || asked {
+					t.Fatalf("expected the stored certificate, got %v, authorized called: %v", err, asked)
+				}
+				if !slices.Equal(tlscert.Leaf.DNSNames, tt.names) {
+					t.Fatalf("unexpected certificate for %v", tlscert.Leaf.DNSNames)
+				}
+				return
+			}
+
+			if !asked || err != errUnauthorized {
+				t.Fatalf("expected a new certificate to be requested, got %v, authorized called: %v", err, asked)
+			}
+		})
+	}
+}
+
+func TestRenewalDeadline(t *testing.T) {
+	day := 24 * time.Hour
+	notBefore := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		lifetime time.Duration
+		want     time.Duration
+	}{
+		{name: "90 days", lifetime: 90 * day, want: 60 * day},
+		{name: "6 days", lifetime: 6 * day, want: 4 * day},
+		{name: "1 hour", lifetime: time.Hour, want: 40 * time.Minute},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := renewalDeadline(notBefore, notBefore.Add(tt.lifetime))
+			if !got.Equal(notBefore.Add(tt.want)) {
+				t.Fatalf("expected a renewal %v after issuance, got %v", tt.want, got.Sub(notBefore))
+			}
+		})
+	}
+}
+
+func TestCurrentCertificate(t *testing.T) {
+	day := 24 * time.Hour
+
+	tests := []struct {
+		name      string
+		age       time.Duration
+		lifetime  time.Duration
+		profile   string
+		settings  *InitParameters
+		domains   []string
+		wantValid bool
+	}{
+		{name: "90 days", age: 10 * day, lifetime: 90 * day, settings: &InitParameters{}, wantValid: true},
+		{name: "90 days due", age: 70 * day, lifetime: 90 * day, settings: &InitParameters{}},
+		{name: "6 days", age: 3 * day, lifetime: 6 * day, profile: ProfileShortLived, settings: &InitParameters{Profile: ProfileShortLived}, wantValid: true},
+		{name: "6 days due", age: 5 * day, lifetime: 6 * day, profile: ProfileShortLived, settings: &InitParameters{Profile: ProfileShortLived}},
+		{name: "profile changed", age: 10 * day, lifetime: 90 * day, settings: &InitParameters{Profile: ProfileShortLived}},
+		{name: "profile dropped", age: 1 * day, lifetime: 6 * day, profile: ProfileShortLived, settings: &InitParameters{}},
+		{
+			name: "domain profile", age: 1 * day, lifetime: 6 * day, profile: ProfileShortLived,
+			settings:  &InitParameters{DomainConfigs: map[string]*DomainConfig{"example.com": {Profile: ProfileShortLived}}},
+			wantValid: true,
+		},
+		{
+			name: "domain profile changed", age: 10 * day, lifetime: 90 * day,
+			settings: &InitParameters{DomainConfigs: map[string]*DomainConfig{"example.com": {Profile: ProfileShortLived}}},
+		},
+		{name: "domain not covered", age: 10 * day, lifetime: 90 * day, settings: &InitParameters{}, domains: []string{"www.example.com"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useSettings(t, tt.settings)
+
+			notBefore := time.Now().Add(-tt.age)
+			cert := testCertificate(t, notBefore, notBefore.Add(tt.lifetime))
+			err := storeCertificate("example.com", []string{"example.com"}, tt.profile, cert, []byte("key"), 0, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			domains := append([]string{"example.com"}, tt.domains...)
+			_, _, ok := currentCertificate("example.com", domains)
+			if ok != tt.wantValid {
+				t.Fatalf("expected currentCertificate to return %v, got %v", tt.wantValid, ok)
+			}
+
+			// with neither renewal nor profile change due, no renewal is started in the background
+			if tt.wantValid {
+				q, err := retrieveCertificateRecord("example.com")
+				if err != nil || q.Profile != tt.profile {
+					t.Fatalf("unexpected record %+v, %v", q, err)
+				}
+			}
+		})
+	}
+}
+
+func TestChallengesFor(t *testing.T) {
+	global, custom := &testProvider{}, &testProvider{}
+
+	tests := []struct {
+		name     string
+		settings *InitParameters
+		types    []challenge.Type
+		provider challenge.Provider
+	}{
+		{name: "default", settings: &InitParameters{}, types: []challenge.Type{challenge.HTTP01}},
+		{
+			name:     "global",
+			settings: &InitParameters{DNSChallenges: true, TLSALPNChallenges: true, DNSProvider: global},
+			types:    []challenge.Type{challenge.HTTP01, challenge.DNS01, challenge.TLSALPN01},
+			provider: global,
+		},
+		{
+			name:     "other domain",
+			settings: &InitParameters{DNSChallenges: true, DNSProvider: global, DomainConfigs: map[string]*DomainConfig{"example.org": {Challenges: []challenge.Type{challenge.HTTP01}}}},
+			types:    []challenge.Type{challenge.HTTP01, challenge.DNS01},
+			provider: global,
+		},
+		{
+			name:     "domain challenges",
+			settings: &InitParameters{DNSProvider: global, DomainConfigs: map[string]*DomainConfig{"example.com": {Challenges: []challenge.Type{challenge.DNS01}}}},
+			types:    []challenge.Type{challenge.DNS01},
+			provider: global,
+		},
+		{
+			name:     "domain provider",
+			settings: &InitParameters{DNSChallenges: true, DNSProvider: global, DomainConfigs: map[string]*DomainConfig{"example.com": {DNSProvider: custom}}},
+			types:    []challenge.Type{challenge.HTTP01, challenge.DNS01},
+			provider: custom,
+		},
+		{
+			name:     "domain provider only",
+			settings: &InitParameters{DomainConfigs: map[string]*DomainConfig{"example.com": {Challenges: []challenge.Type{challenge.DNS01}, DNSProvider: custom}}},
+			types:    []challenge.Type{challenge.DNS01},
+			provider: custom,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useSettings(t, tt.settings)
+
+			types, provider := challengesFor("example.com")
+			if !slices.Equal(types, tt.types) {
+				t.Fatalf("expected the challenges %v, got %v", tt.types, types)
+			}
+
+			if tt.provider == nil {
+				if provider != nil {
+					t.Fatalf("expected no DNS provider, got %v", provider)
+				}
+				return
+			}
+			// the delegations of _acme-challenge records are followed
+			d, ok := provider.(*delegatedDNSProvider)
+			if !ok || d.p != tt.provider {
+				t.Fatalf("unexpected DNS provider %#v", provider)
+			}
+		})
+	}
+}
+
+func TestClientFor(t *testing.T) {
+	prevConfig, prevClient, prevClients := legoconfig, client, domainClients
+	t.Cleanup(func() { legoconfig, client, domainClients = prevConfig, prevClient, prevClients })
+
+	// lego clients only need the directory of the CA to be created
+	var ca *httptest.Server
+	ca = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"newNonce": %[1]q, "newAccount": %[1]q, "newOrder": %[1]q}`, ca.URL)
+	}))
+	defer ca.Close()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	legoconfig = lego.NewConfig(&ACMEUser{key: key})
+	legoconfig.CADirURL = ca.URL
+	legoconfig.HTTPClient = ca.Client()
+	client, err = lego.NewClient(legoconfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	domainClients = map[string]*lego.Client{}
+
+	useSettings(t, &InitParameters{
+		DomainConfigs: map[string]*DomainConfig{
+			"example.com": {Challenges: []challenge.Type{challenge.HTTP01}},
+			"example.org": {DNSProvider: &testProvider{}},
+			"example.net": {Profile: ProfileShortLived},
+			"example.dev": {Challenges: []challenge.Type{challenge.DNS01}},
+		},
+	})
+
+	for _, d := range []string{"example.io", "example.net"} {
+		c, err := clientFor(d)
+		if err != nil || c != client {
+			t.Fatalf("%s: expected the default client, got %v", d, err)
+		}
+	}
+
+	com, err := clientFor("example.com")
+	if err != nil || com == client {
+		t.Fatalf("expected a client of its own for example.com, got %v", err)
+	}
+	org, err := clientFor("example.org")
+	if err != nil || org == client || org == com {
+		t.Fatalf("expected a client of its own for example.org, got %v", err)
+	}
+
+	again, err := clientFor("example.com")
+	if err != nil || again != com {
+		t.Fatalf("expected the client of example.com to be reused, got %v", err)
+	}
+
+	// dns-01 without a DNSProvider is refused, and not cached
+	_, err = clientFor("example.dev")
+	if err == nil {
+		t.Fatal("expected an error for dns-01 without a DNSProvider")
+	}
+	if _, ok := domainClients["example.dev"]; ok {
+		t.Fatal("expected the failed client not to be cached")
+	}
+	if len(domainClients) != 2 {
+		t.Fatalf("expected 2 cached clients, got %d", len(domainClients))
+	}
+}
@@ -12,14 +12,18 @@ import (
 	"log/slog"
 
 	"github.com/VictoriaMetrics/fastcache"
+	"github.com/arthurweinmann/go-https-hug/internal/utils"
+	"github.com/arthurweinmann/go-https-hug/pkg/dnsresolver"
 	"github.com/arthurweinmann/go-https-hug/pkg/logging"
 	"github.com/arthurweinmann/go-https-hug/pkg/storage"
+	"github.com/arthurweinmann/go-https-hug/pkg/tlspolicy"
 	"github.com/go-acme/lego/v4/challenge"
 )
 
 var cache *fastcache.Cache
 var settings *InitParameters
 var logger *slog.Logger
+var authorizedIPs map[string]bool
 
 type InitParameters struct {
 	// if zero, then we do not initialize any cache
@@ -36,12 +40,62 @@ type InitParameters struct {
 	DNSProvider   challenge.Provider
 	DNSChallenges bool
 
+	// Peers lets the nodes of a cluster which do not share a Store answer the http-01 challenges of each other.
+	// Optional.
+	Peers *PeersConfig
+
+	// If true, tls-alpn-01 challenges are solved by GetCertificate, so your HTTPS server must listen on port 443
+	// and advertise the ACME_TLS_ALPN_PROTOCOL in its tls.Config NextProtos.
+	TLSALPNChallenges bool
+
 	// Map of authorized root domain names and zero or more of their subdomains.
 	AuthorizedDomains map[string][]string
 
+	// IPv4 and IPv6 addresses we may get certificates for, if the CA allows it.
+	// They are served to the ClientHellos without SNI connecting to one of them.
+	// IP address certificates use the ProfileShortLived profile unless DomainConfigs says otherwise.
+	AuthorizedIPs []string
+
+	// Profile is the ACME profile used for orders, for example ProfileShortLived for 6-day certificates.
+	// If empty, the CA chooses its default profile.
+	Profile string
+
+	// Resolver configures the DNS resolver used to verify TXT records, run the pre-flight checks,
+	// follow challenge delegations and check the propagation of dns-01 challenges.
+	// If nil, Google Public DNS is used for our own checks and lego checks propagation on its own.
+	Resolver *dnsresolver.Config
+
+	// If true, CreateCertificate runs Preflight before creating an order and returns its PreflightErrors,
+	// this avoids spending failed validations at the CA on domains not pointing at us yet.
+	PreflightChecks bool
+
+	// Optional per root domain settings, overriding the global ones.
+	DomainConfigs map[string]*DomainConfig
+
+	// TLSPolicy sets the TLS versions, cipher suites, curves, ALPN protocols and session tickets of ServeHTTPS,
+	// for example tlspolicy.Intermediate(). The Go defaults are used if nil.
+	TLSPolicy *tlspolicy.Policy
+	// TLSPolicies overrides TLSPolicy for some domains, which may be wildcards such as *.example.com
+	TLSPolicies map[string]*tlspolicy.Policy
+
 	LogLevel logging.LogLevel
 }
 
+// DomainConfig holds the settings specific to the certificates of one root domain
+type DomainConfig struct {
+	// Profile overrides InitParameters.Profile for this root domain
+	Profile string
+
+	// Challenges restricts the challenge types used for this root domain, for example
+	// only challenge.DNS01 for domains behind a CDN or only challenge.HTTP01.
+	// If empty, the challenges enabled by InitParameters are used.
+	Challenges []challenge.Type
+
+	// DNSProvider overrides InitParameters.DNSProvider for this root domain,
+	// for zones hosted at another DNS provider
+	DNSProvider challenge.Provider
+}
+
 // Call Init before calling any other function
 func Init(param *InitParameters) error {
 	if param == nil {
@@ -78,8 +132,48 @@ func Init(param *InitParameters) error {
 		return fmt.Errorf("invalid certificate contact email address: %v", err)
 	}
 
-	if len(settings.AuthorizedDomains) == 0 {
-		return fmt.Errorf("We need at least one authorized root domain name")
+	if len(settings.AuthorizedDomains) == 0 && len(settings.AuthorizedIPs) == 0 {
+		return fmt.Errorf("We need at least one authorized root domain name or IP address")
+	}
+
+	for rootdomain := range settings.DomainConfigs {
+		types, dnsProvider := challengesFor(rootdomain)
+		for _, t := range types {
+			if t == challenge.DNS01 && dnsProvider == nil {
+				return fmt.Errorf("the root domain %s uses the dns-01 challenge without a DNSProvider", rootdomain)
+			}
+		}
+	}
+
+	err = tlsPolicies().Validate()
+	if err != nil {
+		return err
+	}
+
+	if settings.Peers != nil {
+		err = settings.Peers.validate()
+		if err != nil {
+			return err
+		}
+		peerLookups = make(chan struct{}, settings.Peers.maxConcurrentLookups())
+	}
+
+	if settings.Resolver != nil {
+		utils.DNSResolver, err = dnsresolver.New(settings.Resolver)
+		if err != nil {
+			return fmt.Errorf("invalid Resolver: %v", err)
+		}
+	}
+
+	lockOwner = newLockOwner()
+
+	authorizedIPs = map[string]bool{}
+	for _, a := range settings.AuthorizedIPs {
+		ip, ok := utils.FormatIP(a)
+		if !ok {
+			return fmt.Errorf("invalid authorized IP address %s", a)
+		}
+		authorizedIPs[ip] = true
 	}
 
 	us, err := loadACMEUserFromDisk()
@@ -118,3 +212,18 @@ func Init(param *InitParameters) error {
 	logger.Info("ACME initialized")
 	return nil
 }
+
+// profileFor returns the ACME profile to use when ordering a certificate for rootdomain
+func profileFor(rootdomain string) string {
+	if dc := settings.DomainConfigs[rootdomain]; dc != nil && dc.Profile != "" {
+		return dc.Profile
+	}
+	if _, ok := utils.FormatIP(rootdomain); ok {
+		return ProfileShortLived
+	}
+	return settings.Profile
+}
+
+func tlsPolicies() *tlspolicy.Policies {
+	return &tlspolicy.Policies{Default: settings.TLSPolicy, Domains: settings.TLSPolicies}
+}
@@ -0,0 +1,187 @@
+package acme
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/arthurweinmann/go-https-hug/pkg/storage"
+)
+
+// CertificateInfo describes a stored certificate
+type CertificateInfo struct {
+	RootDomain string
+	Domains    []string
+	Profile    string
+	NotAfter   time.Time
+	// RenewalDeadline is when we start renewing the certificate
+	RenewalDeadline time.Time
+}
+
+// ListCertificates returns the certificates of the Store. If the Store does not implement storage.Lister,
+// only the certificates of the root domains and IP addresses of the InitParameters are returned.
+func ListCertificates() ([]*CertificateInfo, error) {
+	rootdomains, err := storedRootDomains()
+	if err != nil {
+		return nil, err
+	}
+
+	var ret []*CertificateInfo
+	for _, rootdomain := range rootdomains {
+		b, err := settings.Store.GetKV("certificates/" + rootdomain)
+		if err == storage.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		q := &certificateRecord{}
+		err = gob.NewDecoder(bytes.NewReader(b)).Decode(q)
+		if err != nil {
+			logger.Error("invalid certificate record", slog.String("rootDomain", rootdomain), slog.String("error", err.Error()))
+			continue
+		}
+
+		notBefore, notAfter, err := certificateValidity(q.Certificate)
+		if err != nil {
+			logger.Error("invalid certificate", slog.String("rootDomain", rootdomain), slog.String("error", err.Error()))
+			continue
+		}
+
+		ret = append(ret, &CertificateInfo{
+			RootDomain:      q.RootDomain,
+			Domains:         q.Domains,
+			Profile:         q.Profile,
+			NotAfter:        notAfter,
+			RenewalDeadline: renewalDeadline(notBefore, notAfter),
+		})
+	}
+
+	return ret, nil
+}
+
+// storedRootDomains lists the root domains with a certificate in the Store,
+// or the configured ones if the Store cannot list its keys
+func storedRootDomains() ([]string, error) {
+	if lister, ok := settings.Store.(storage.Lister); ok {
+		keys, err := lister.ListKV("certificates/")
+		if err == nil {
+			ret := make([]string, 0, len(keys))
+			for _, k := range keys {
+				ret = append(ret, strings.TrimPrefix(k, "certificates/"))
+			}
+			return ret, nil
+		}
+		if !errors.Is(err, errors.ErrUnsupported) {
+			return nil, err
+		}
+	}
+
+	var ret []string
+	for rootdomain := range settings.AuthorizedDomains {
+		ret = append(ret, strings.ToLower(rootdomain))
+	}
+	for ip := range authorizedIPs {
+		ret = append(ret, ip)
+	}
+	return ret, nil
+}
+
+// CleanStaleChallenges deletes the challenge records which expired, or which are older than maxAge when
+// they have no expiration, for Stores which do not delete expired keys on their own.
+// It returns the number of records deleted, and does nothing if the Store does not implement
+// both storage.Lister and storage.Stater.
+func CleanStaleChallenges(maxAge time.Duration) (int, error) {
+	lister, ok := settings.Store.(storage.Lister)
+	if !ok {
+		return 0, nil
+	}
+	stater, ok := settings.Store.(storage.Stater)
+	if !ok {
+		return 0, nil
+	}
+
+	keys, err := lister.ListKV("challenges/")
+	if errors.Is(err, errors.ErrUnsupported) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+
+	var n int
+	for _, k := range keys {
+		info, err := stater.StatKV(k)
+		if err == storage.ErrNotFound {
+			continue
+		}
+		if errors.Is(err, errors.ErrUnsupported) {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+
+		stale := now.After(info.Expiration)
+		if info.Expiration.IsZero() {
+			stale = now.Sub(info.ModTime) > maxAge
+		}
+		if !stale {
+			continue
+		}
+
+		err = settings.Store.DeleteKV(k)
+		if err != nil && err != storage.ErrNotFound {
+			return n, err
+		}
+		n++
+	}
+
+	return n, nil
+}
+
+// StartRenewalScanner checks every interval, until ctx is done, which stored certificates are due for renewal
+// and renews them in the background, instead of waiting for a handshake to ask for them.
+// See ListCertificates for the certificates it knows about.
+func StartRenewalScanner(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			scanRenewals()
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func scanRenewals() {
+	certs, err := ListCertificates()
+	if err != nil {
+		logger.Error("could not list certificates for renewal", slog.String("error", err.Error()))
+		return
+	}
+
+	now := time.Now()
+	for _, c := range certs {
+		if now.After(c.RenewalDeadline) || c.Profile != profileFor(c.RootDomain) {
+			// starts the renewal in the background
+			_, err := retrieveCertificateRecord(c.RootDomain)
+			if err != nil && err != ErrCertificateExpired {
+				logger.Error("could not renew certificate", slog.String("rootDomain", c.RootDomain), slog.String("error", err.Error()))
+			}
+		}
+	}
+}
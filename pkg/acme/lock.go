@@ -0,0 +1,125 @@
+package acme
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/arthurweinmann/go-https-hug/pkg/storage"
+)
+
+// certLockTTL is the lifetime of our leases, they are renewed every third of it during slow issuances
+const certLockTTL = 2 * time.Minute
+
+// ErrLockLost is returned when the lease of a certificate lock could not be kept until the end of an issuance
+var ErrLockLost = errors.New("certificate lock lost during issuance")
+
+// lockOwner identifies this process as the owner of the leases it acquires, see Init
+var lockOwner string
+
+func newLockOwner() string {
+	hostname, _ := os.Hostname()
+
+	b := make([]byte, 8)
+	rand.Read(b)
+
+	return fmt.Sprintf("%s-%d-%s", hostname, os.Getpid(), hex.EncodeToString(b))
+}
+
+// certLock is a lease on the lock of a certificate, kept alive in the background until Unlock
+type certLock struct {
+	lease *storage.Lease
+
+	mu   sync.Mutex
+	lost bool
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// lockCert acquires the lock of domain, it returns storage.ErrLockHeld if someone else holds it
+func lockCert(domain string) (*certLock, error) {
+	lease, err := settings.Store.LockCert(domain, lockOwner, certLockTTL)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &certLock{
+		lease: lease,
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+
+	go l.keepalive()
+
+	return l, nil
+}
+
+func (l *certLock) keepalive() {
+	defer close(l.done)
+
+	ticker := time.NewTicker(certLockTTL / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+		}
+
+		// Lost reads the deadline concurrently, so we renew a copy of the lease
+		l.mu.Lock()
+		lease := *l.lease
+		l.mu.Unlock()
+
+		err := settings.Store.RenewCertLock(&lease, certLockTTL)
+		if err == nil {
+			l.mu.Lock()
+			l.lease.Deadline = lease.Deadline
+			l.mu.Unlock()
+			continue
+		}
+		if err == storage.ErrLeaseLost {
+			logger.Error("certificate lock lost", slog.String("domain", l.lease.Domain))
+			l.mu.Lock()
+			l.lost = true
+			l.mu.Unlock()
+			return
+		}
+		// the lease is still valid for a while, we retry on the next tick
+		logger.Error("could not renew certificate lock", slog.String("domain", l.lease.Domain), slog.String("error", err.Error()))
+	}
+}
+
+// Lost reports whether the lease expired, someone else may then hold the lock
+func (l *certLock) Lost() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.lost || time.Now().After(l.lease.Deadline)
+}
+
+// Token is the fencing token of the lease
+func (l *certLock) Token() uint64 {
+	return l.lease.Token
+}
+
+// Epoch is the epoch of the fencing token of the lease
+func (l *certLock) Epoch() string {
+	return l.lease.Epoch
+}
+
+func (l *certLock) Unlock() {
+	close(l.stop)
+	<-l.done
+
+	err := settings.Store.UnlockCert(l.lease)
+	if err != nil && err != storage.ErrLeaseLost {
+		logger.Error("could not release certificate lock", slog.String("domain", l.lease.Domain), slog.String("error", err.Error()))
+	}
+}
@@ -0,0 +1,235 @@
+package acme
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/arthurweinmann/go-https-hug/internal/utils"
+	"github.com/arthurweinmann/go-https-hug/pkg/storage"
+)
+
+const (
+	peerTimestampHeader = "X-Https-Hug-Timestamp"
+	peerSignatureHeader = "X-Https-Hug-Signature"
+
+	// peerMaxSkew is how far the timestamp of a peer request may be from our clock
+	peerMaxSkew = time.Minute
+
+	defaultPeerTimeout = 2 * time.Second
+
+	defaultMaxPeerLookups = 16
+)
+
+// peerLookups holds a slot per lookup of a challenge at the peers in progress, see PeersConfig.MaxConcurrentLookups
+var peerLookups chan struct{}
+
+// PeersConfig lets the nodes of a cluster which do not share a Store answer the http-01 challenges of each other,
+// so that the validation requests of the CA may reach any of them, for example behind a round-robin load balancer.
+type PeersConfig struct {
+	// URLs are the base URLs of the other nodes, where they serve ServeHTTP or a Router, for example http://10.0.0.2.
+	// The URL of this node may be included, so that every node uses the same list.
+	URLs []string
+
+	// Secret authenticates the requests between peers with HMAC-SHA256, it must be the same on every node
+	// and at least 32 bytes long
+	Secret []byte
+
+	// Timeout bounds the requests to the peers, 2 seconds by default
+	Timeout time.Duration
+
+	// Client makes the requests to the peers, for example with the RootCAs of https peer URLs, http.DefaultClient by default
+	Client *http.Client
+
+	// MaxConcurrentLookups bounds how many challenges may be looked up at the peers at once, 16 by default.
+	// Every request for a challenge which is not in our Store makes a request to each peer, beyond this bound
+	// they are answered with a 404 without asking the peers, so that they cannot be used to flood the cluster.
+	MaxConcurrentLookups int
+}
+
+func (c *PeersConfig) validate() error {
+	if len(c.Secret) < 32 {
+		return fmt.Errorf("the secret of the peers must be at least 32 bytes long")
+	}
+
+	for _, u := range c.URLs {
+		parsed, err := url.Parse(u)
+		if err != nil {
+			return fmt.Errorf("invalid peer URL %s: %v", u, err)
+		}
+		if (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return fmt.Errorf("invalid peer URL %s: expected an http or https URL", u)
+		}
+	}
+
+	return nil
+}
+
+func (c *PeersConfig) timeout() time.Duration {
+	if c.Timeout > 0 {
+		return c.Timeout
+	}
+	return defaultPeerTimeout
+}
+
+func (c *PeersConfig) client() *http.Client {
+	if c.Client != nil {
+		return c.Client
+	}
+	return http.DefaultClient
+}
+
+func (c *PeersConfig) maxConcurrentLookups() int {
+	if c.MaxConcurrentLookups > 0 {
+		return c.MaxConcurrentLookups
+	}
+	return defaultMaxPeerLookups
+}
+
+func peerSignature(secret []byte, domain, token, timestamp string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(domain + "\n" + token + "\n" + timestamp))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// getPeersChallenge asks every peer for the key authorization of the http-01 challenge of domain and token,
+// and returns the first one found, or storage.ErrNotFound, also returned when too many lookups are in progress
+func getPeersChallenge(domain, token string) ([]byte, error) {
+	peers := settings.Peers
+
+	select {
+	case peerLookups <- struct{}{}:
+		defer func() { <-peerLookups }()
+	default:
+		logger.Info("too many challenge lookups at the peers", slog.String("domain", domain))
+		return nil, storage.ErrNotFound
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), peers.timeout())
+	defer cancel()
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	signature := peerSignature(peers.Secret, domain, token, timestamp)
+
+	// the slower peers are still answering after we return
+	log := logger
+	client := peers.client()
+
+	found := make(chan []byte, len(peers.URLs))
+	for _, peer := range peers.URLs {
+		go func() {
+			keyauth, err := getPeerChallenge(ctx, client, peer, domain, token, timestamp, signature)
+			if err != nil {
+				log.Debug("could not get a challenge from a peer", slog.String("peer", peer), slog.String("err", err.Error()))
+			}
+			found <- keyauth
+		}()
+	}
+
+	for range peers.URLs {
+		keyauth := <-found
+		if keyauth != nil {
+			return keyauth, nil
+		}
+	}
+
+	return nil, storage.ErrNotFound
+}
+
+func getPeerChallenge(ctx context.Context, client *http.Client, peer, domain, token, timestamp, signature string) ([]byte, error) {
+	u := strings.TrimSuffix(peer, "/") + ACME_PEER_CHALLENGE_URL_PREFIX + url.PathEscape(token) + "?domain=" + url.QueryEscape(domain)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(peerTimestampHeader, timestamp)
+	req.Header.Set(peerSignatureHeader, signature)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	// key authorizations are a token and a thumbprint
+	return io.ReadAll(io.LimitReader(resp.Body, 1024))
+}
+
+// ServePeerChallenge answers the requests of the peers for the http-01 challenges of this node, which are made
+// to the paths starting with ACME_PEER_CHALLENGE_URL_PREFIX. ServeHTTP and Router call it on their own.
+// The challenge is only looked up in our Store, never forwarded again, so that requests cannot loop between peers.
+func ServePeerChallenge(w http.ResponseWriter, r *http.Request) {
+	if settings == nil || settings.Peers == nil || r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	token := strings.TrimPrefix(r.URL.Path, ACME_PEER_CHALLENGE_URL_PREFIX)
+	domain := r.URL.Query().Get("domain")
+	timestamp := r.Header.Get(peerTimestampHeader)
+
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || token == "" || domain == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	skew := time.Since(time.Unix(ts, 0))
+	expected := peerSignature(settings.Peers.Secret, domain, token, timestamp)
+	if skew > peerMaxSkew || skew < -peerMaxSkew || !hmac.Equal([]byte(expected), []byte(r.Header.Get(peerSignatureHeader))) {
+		logger.Info("rejected a peer challenge request", slog.String("remote", r.RemoteAddr))
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	keyauth, err := getLocalChallenge(domain, token)
+	if err != nil {
+		if err != storage.ErrNotFound {
+			logger.Error("certificates.ServePeerChallenge", slog.String("err", err.Error()))
+		}
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(keyauth)
+}
+
+// isACMEToken reports whether token may be the token of a challenge, base64url encoded, so that
+// the requests for random paths under ACME_CHALLENGE_URL_PREFIX are not forwarded to every peer
+func isACMEToken(token string) bool {
+	if len(token) < 16 || len(token) > 256 {
+		return false
+	}
+	for _, c := range token {
+		if (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') && (c < '0' || c > '9') && c != '-' && c != '_' {
+			return false
+		}
+	}
+	return true
+}
+
+// formatChallengeDomain returns the identifier under which the challenges of domain, which may be an IP address, are stored
+func formatChallengeDomain(domain string) string {
+	if ip, ok := utils.FormatIP(domain); ok {
+		return ip
+	}
+	return domain
+}
@@ -0,0 +1,196 @@
+package acme
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/arthurweinmann/go-https-hug/pkg/storage"
+	"github.com/arthurweinmann/go-https-hug/pkg/storage/stores/memory"
+)
+
+const (
+	testToken   = "9y1gGRZnE9Ya-tPs3BDT7A"
+	testKeyAuth = testToken + ".thumbprint"
+)
+
+var testSecret = []byte("0123456789abcdef0123456789abcdef")
+
+func setupPeers(t *testing.T, urls ...string) {
+	t.Helper()
+
+	prevSettings, prevLogger := settings, logger
+	t.Cleanup(func() { settings, logger = prevSettings, prevLogger })
+
+	settings = &InitParameters{
+		Store: memory.NewStore(),
+		Peers: &PeersConfig{URLs: urls, Secret: testSecret, Timeout: time.Second},
+	}
+	logger = slog.New(slog.NewJSONHandler(io.Discard, nil))
+
+	if err := settings.Peers.validate(); err != nil {
+		t.Fatal(err)
+	}
+	peerLookups = make(chan struct{}, settings.Peers.maxConcurrentLookups())
+}
+
+func TestGetChallengeFromPeers(t *testing.T) {
+	var requests atomic.Int32
+
+	// a peer holding the challenge, and one which does not
+	holder := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		expected := peerSignature(testSecret, r.URL.Query().Get("domain"), r.URL.Path[len(ACME_PEER_CHALLENGE_URL_PREFIX):], r.Header.Get(peerTimestampHeader))
+		if r.Header.Get(peerSignatureHeader) != expected || r.URL.Query().Get("domain") != "example.com" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Write([]byte(testKeyAuth))
+	}))
+	defer holder.Close()
+
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer other.Close()
+
+	setupPeers(t, other.URL, holder.URL)
+
+	keyauth, err := GetChallenge("example.com", testToken)
+	if err != nil || string(keyauth) != testKeyAuth {
+		t.Fatalf("expected the key authorization of the peer, got %q %v", keyauth, err)
+	}
+
+	// random paths are not forwarded
+	_, err = GetChallenge("example.com", "../../etc")
+	if err != storage.ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	if requests.Load() != 1 {
+		t.Fatalf("expected one request to the peer, got %d", requests.Load())
+	}
+
+	// a challenge of our own Store is not forwarded
+	err = (&HTTPChallenger{}).Present("example.org", testToken, "own")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyauth, err = GetChallenge("example.org", testToken)
+	if err != nil || string(keyauth) != "own" {
+		t.Fatalf("expected our key authorization, got %q %v", keyauth, err)
+	}
+	if requests.Load() != 1 {
+		t.Fatalf("expected no request to the peer, got %d", requests.Load())
+	}
+}
+
+func TestServePeerChallenge(t *testing.T) {
+	// the peers of this node do not have the challenge either, a peer request must not be forwarded to them
+	var forwarded atomic.Int32
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded.Add(1)
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer peer.Close()
+
+	setupPeers(t, peer.URL)
+
+	err := (&HTTPChallenger{}).Present("example.com", testToken, testKeyAuth)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serve := func(domain, token, signature string, timestamp time.Time) *httptest.ResponseRecorder {
+		ts := strconv.FormatInt(timestamp.Unix(), 10)
+		if signature == "" {
+			signature = peerSignature(testSecret, domain, token, ts)
+		}
+
+		r := httptest.NewRequest(http.MethodGet, ACME_PEER_CHALLENGE_URL_PREFIX+token+"?domain="+domain, nil)
+		r.Header.Set(peerTimestampHeader, ts)
+		r.Header.Set(peerSignatureHeader, signature)
+
+		w := httptest.NewRecorder()
+		(&challengesResolver{}).ServeHTTP(w, r)
+		return w
+	}
+
+	w := serve("example.com", testToken, "", time.Now())
+	if w.Code != http.StatusOK || w.Body.String() != testKeyAuth {
+		t.Fatalf("expected the key authorization, got %d %q", w.Code, w.Body.String())
+	}
+
+	if w := serve("example.com", testToken, "invalid", time.Now()); w.Code != http.StatusForbidden {
+		t.Fatalf("expected a forbidden invalid signature, got %d", w.Code)
+	}
+	if w := serve("example.com", testToken, "", time.Now().Add(-time.Hour)); w.Code != http.StatusForbidden {
+		t.Fatalf("expected a forbidden old request, got %d", w.Code)
+	}
+
+	if w := serve("example.org", testToken, "", time.Now()); w.Code != http.StatusNotFound {
+		t.Fatalf("expected a missing challenge, got %d", w.Code)
+	}
+	if forwarded.Load() != 0 {
+		t.Fatalf("expected the peer request not to be forwarded, got %d requests", forwarded.Load())
+	}
+}
+
+func TestPeersClientAndLookupsLimit(t *testing.T) {
+	received := make(chan struct{}, 2)
+	release := make(chan struct{})
+
+	// a peer served over TLS, which the default client does not trust, answering once released
+	peer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- struct{}{}
+		select {
+		case <-release:
+		case <-r.Context().Done():
+			return
+		}
+		w.Write([]byte(testKeyAuth))
+	}))
+	defer peer.Close()
+
+	setupPeers(t, peer.URL)
+	settings.Peers.Client = peer.Client()
+	settings.Peers.MaxConcurrentLookups = 1
+	peerLookups = make(chan struct{}, settings.Peers.maxConcurrentLookups())
+
+	type result struct {
+		keyauth []byte
+		err     error
+	}
+	done := make(chan result, 1)
+	go func() {
+		keyauth, err := GetChallenge("example.com", testToken)
+		done <- result{keyauth, err}
+	}()
+	<-received
+
+	// a second lookup while the first one is in progress is not forwarded
+	_, err := GetChallenge("example.org", testToken)
+	if err != storage.ErrNotFound {
+		t.Fatalf("expected ErrNotFound beyond MaxConcurrentLookups, got %v", err)
+	}
+	if len(received) != 0 {
+		t.Fatalf("expected no request to the peer beyond MaxConcurrentLookups")
+	}
+
+	close(release)
+
+	res := <-done
+	if res.err != nil || string(res.keyauth) != testKeyAuth {
+		t.Fatalf("expected the key authorization of the peer, got %q %v", res.keyauth, res.err)
+	}
+
+	// and the lookup released its slot
+	keyauth, err := GetChallenge("example.org", testToken)
+	if err != nil || string(keyauth) != testKeyAuth {
+		t.Fatalf("expected the key authorization of the peer, got %q %v", keyauth, err)
+	}
+}
@@ -0,0 +1,324 @@
+package acme
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/arthurweinmann/go-https-hug/internal/utils"
+	"github.com/go-acme/lego/v4/challenge"
+	"github.com/go-acme/lego/v4/challenge/dns01"
+)
+
+type PreflightStage string
+
+const (
+	// PreflightResolve means the domain name does not resolve
+	PreflightResolve PreflightStage = "resolve"
+	// PreflightPresent means we could not store or publish the probe
+	PreflightPresent PreflightStage = "present"
+	// PreflightRequest means the probe request to one of the addresses of the domain failed
+	PreflightRequest PreflightStage = "request"
+	// PreflightResponse means the probe request was answered by someone else than us
+	PreflightResponse PreflightStage = "response"
+	// PreflightPropagation means the probe TXT record did not propagate in time
+	PreflightPropagation PreflightStage = "propagation"
+)
+
+// PreflightError describes a failed pre-flight check of one domain
+type PreflightError struct {
+	Domain    string
+	Challenge challenge.Type
+	Stage     PreflightStage
+	// Address is the IP address probed, for http-01 checks
+	Address string
+	Err     error
+}
+
+func (e *PreflightError) Error() string {
+	if e.Address != "" {
+		return fmt.Sprintf("preflight %s check of %s failed at %s stage on %s: %v", e.Challenge, e.Domain, e.Stage, e.Address, e.Err)
+	}
+	return fmt.Sprintf("preflight %s check of %s failed at %s stage: %v", e.Challenge, e.Domain, e.Stage, e.Err)
+}
+
+func (e *PreflightError) Unwrap() error {
+	return e.Err
+}
+
+// PreflightErrors is returned by Preflight when at least one domain failed its checks
+type PreflightErrors []*PreflightError
+
+func (e PreflightErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, pe := range e {
+		msgs[i] = pe.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Preflight checks that the challenges of domains can be solved before we create an order, so that
+// a misconfiguration such as a DNS record not pointing at us yet does not cost a failed validation at the CA.
+// For http-01, the domain is resolved and a probe is requested on each of its addresses through the public
+// ACME_CHALLENGE_URL_PREFIX path, which must be answered by ServeHTTP or the Router.
+// For dns-01, a probe TXT record is presented with the DNSProvider and we wait for it to propagate.
+// The challenges checked are the ones enabled for the root domain, globally or in DomainConfigs.
+// It returns nil or PreflightErrors.
+func Preflight(domains []string) error {
+	var mu sync.Mutex
+	var errs PreflightErrors
+
+	// a domain and its wildcard share the same _acme-challenge TXT record, and DNSProviders replacing
+	// the record set would remove the probe of one when presenting or cleaning up the other
+	dnsLocks := &probeLocks{locks: map[string]*sync.Mutex{}}
+
+	var wg sync.WaitGroup
+	for _, d := range domains {
+		wg.Add(1)
+		go func(d string) {
+			defer wg.Done()
+			derrs := preflightDomain(d, dnsLocks)
+			if len(derrs) > 0 {
+				mu.Lock()
+				errs = append(errs, derrs...)
+				mu.Unlock()
+			}
+		}(d)
+	}
+	wg.Wait()
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// preflightDomain checks the challenges enabled for the root domain of domain, see challengesFor.
+// It returns no error as soon as one of them passes. tls-alpn-01 is not checked.
+func preflightDomain(domain string, dnsLocks *probeLocks) []*PreflightError {
+	rootdomain, err := utils.ExtractRootDomain(strings.TrimPrefix(domain, "*."))
+	if err != nil {
+		return []*PreflightError{{Domain: domain, Stage: PreflightResolve, Err: err}}
+	}
+	types, dnsProvider := challengesFor(strings.ToLower(rootdomain))
+
+	var errs []*PreflightError
+	var checked bool
+
+	for _, t := range types {
+		switch t {
+		case challenge.HTTP01:
+			if strings.HasPrefix(domain, "*.") {
+				continue
+			}
+			checked = true
+			err := preflightHTTP01(domain)
+			if err == nil {
+				return nil
+			}
+			errs = append(errs, err...)
+
+		case challenge.DNS01:
+			if _, ok := utils.FormatIP(domain); ok || dnsProvider == nil {
+				continue
+			}
+			checked = true
+			name := strings.ToLower(strings.TrimPrefix(domain, "*."))
+			unlock := dnsLocks.lock(name)
+			err := preflightDNS01(dnsProvider, name)
+			unlock()
+			if err == nil {
+				return nil
+			}
+			errs = append(errs, err)
+		}
+	}
+
+	if !checked && strings.HasPrefix(domain, "*.") {
+		errs = append(errs, &PreflightError{
+			Domain:    domain,
+			Challenge: challenge.DNS01,
+			Stage:     PreflightPresent,
+			Err:       fmt.Errorf("wildcard domains need the dns-01 challenge and a DNSProvider"),
+		})
+	}
+
+	for _, err := range errs {
+		logger.Error("preflight check failed", slog.String("error", err.Error()))
+	}
+
+	return errs
+}
+
+// probeLocks serializes the probes sharing a name
+type probeLocks struct {
+	mu    sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+func (l *probeLocks) lock(name string) (unlock func()) {
+	l.mu.Lock()
+	m, ok := l.locks[name]
+	if !ok {
+		m = &sync.Mutex{}
+		l.locks[name] = m
+	}
+	l.mu.Unlock()
+
+	m.Lock()
+	return m.Unlock
+}
+
+func preflightHTTP01(domain string) []*PreflightError {
+	domain = strings.ToLower(domain)
+
+	fail := func(stage PreflightStage, addr string, err error) []*PreflightError {
+		return []*PreflightError{{Domain: domain, Challenge: challenge.HTTP01, Stage: stage, Address: addr, Err: err}}
+	}
+
+	var addrs []string
+	if ip, ok := utils.FormatIP(domain); ok {
+		addrs = []string{ip}
+	} else {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		var err error
+		addrs, err = utils.DNSResolver.LookupHost(ctx, domain)
+		if err != nil {
+			return fail(PreflightResolve, "", err)
+		}
+		if len(addrs) == 0 {
+			return fail(PreflightResolve, "", fmt.Errorf("no address found"))
+		}
+	}
+
+	token, keyAuth := randomProbe(), randomProbe()
+
+	httpChal := &HTTPChallenger{}
+	err := httpChal.Present(domain, token, keyAuth)
+	if err != nil {
+		return fail(PreflightPresent, "", err)
+	}
+	defer httpChal.CleanUp(domain, token, keyAuth)
+
+	host := domain
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	url := "http://" + host + ACME_CHALLENGE_URL_PREFIX + token
+
+	// like the CA, every address must answer
+	var errs []*PreflightError
+	for _, addr := range addrs {
+		err := probeHTTP01(url, addr, keyAuth)
+		if err != nil {
+			err.Domain = domain
+			errs = append(errs, err)
+		}
+	}
+
+	return errs
+}
+
+func probeHTTP01(url, addr, keyAuth string) *PreflightError {
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, hostport string) (net.Conn, error) {
+				_, port, err := net.SplitHostPort(hostport)
+				if err != nil {
+					return nil, err
+				}
+				return dialer.DialContext(ctx, network, net.JoinHostPort(addr, port))
+			},
+			// CAs do not validate the certificate when following redirects to https, and we may not have one yet
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+		Timeout: 20 * time.Second,
+	}
+	defer client.CloseIdleConnections()
+
+	resp, err := client.Get(url)
+	if err != nil {
+		return &PreflightError{Challenge: challenge.HTTP01, Stage: PreflightRequest, Address: addr, Err: err}
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if err != nil {
+		return &PreflightError{Challenge: challenge.HTTP01, Stage: PreflightRequest, Address: addr, Err: err}
+	}
+
+	if resp.StatusCode != 200 || string(b) != keyAuth {
+		return &PreflightError{
+			Challenge: challenge.HTTP01,
+			Stage:     PreflightResponse,
+			Address:   addr,
+			Err:       fmt.Errorf("unexpected answer with status code %d, the domain may not point at us", resp.StatusCode),
+		}
+	}
+
+	return nil
+}
+
+func preflightDNS01(dnsProvider challenge.Provider, domain string) *PreflightError {
+	fail := func(stage PreflightStage, err error) *PreflightError {
+		return &PreflightError{Domain: domain, Challenge: challenge.DNS01, Stage: stage, Err: err}
+	}
+
+	token, keyAuth := randomProbe(), randomProbe()
+
+	err := dnsProvider.Present(domain, token, keyAuth)
+	if err != nil {
+		return fail(PreflightPresent, err)
+	}
+	defer dnsProvider.CleanUp(domain, token, keyAuth)
+
+	// the TXT record is looked up where the delegation of the challenge, if any, points at
+	del, err := LookupChallengeDelegation(domain)
+	if err != nil {
+		return fail(PreflightResolve, err)
+	}
+	info := dns01.GetChallengeInfo(domain, keyAuth)
+
+	timeout, interval := 2*time.Minute, 5*time.Second
+	if t, ok := dnsProvider.(challenge.ProviderTimeout); ok {
+		timeout, interval = t.Timeout()
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		ok, err := utils.VerifyTXT(del.Target, info.Value)
+		if ok {
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			if err == nil {
+				err = fmt.Errorf("TXT record %s not found after %s", del.Target, timeout)
+			}
+			return fail(PreflightPropagation, err)
+		}
+
+		time.Sleep(interval)
+	}
+}
+
+func randomProbe() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,182 @@
+package acme
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arthurweinmann/go-https-hug/pkg/dnsserver"
+	"github.com/arthurweinmann/go-https-hug/pkg/logging"
+	"github.com/arthurweinmann/go-https-hug/pkg/storage/stores/memory"
+	"github.com/go-acme/lego/v4/challenge"
+)
+
+// startDNSServer starts a dnsserver.Server answering for any name, which utils.DNSResolver
+// queries for the duration of the test, and returns the Provider presenting its records
+func startDNSServer(t *testing.T) *dnsserver.Provider {
+	t.Helper()
+
+	// do not follow CNAMEs through the system resolver when computing challenge records
+	t.Setenv("LEGO_DISABLE_CNAME_SUPPORT", "true")
+
+	store := memory.NewStore()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	s, err := dnsserver.NewServer(ctx, store, &dnsserver.Config{LogLevel: logging.NONE})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		pc.Close()
+		t.Fatal(err)
+	}
+	go s.Serve(pc, ln)
+
+	useNameserver(t, pc.LocalAddr().String())
+
+	return dnsserver.NewProvider(store)
+}
+
+// testProvider is a challenge.Provider failing to present, or not publishing anything, with a short propagation timeout
+type testProvider struct {
+	err error
+}
+
+func (p *testProvider) Present(domain, token, keyAuth string) error { return p.err }
+
+func (p *testProvider) CleanUp(domain, token, keyAuth string) error { return nil }
+
+func (p *testProvider) Timeout() (timeout, interval time.Duration) {
+	return 200 * time.Millisecond, 50 * time.Millisecond
+}
+
+func TestProbeHTTP01(t *testing.T) {
+	useSettings(t, &InitParameters{})
+
+	err := (&HTTPChallenger{}).Present("example.com", "token", "keyauth")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	us := httptest.NewServer(&challengesResolver{})
+	defer us.Close()
+
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("keyauth of someone else"))
+	}))
+	defer other.Close()
+
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	tests := []struct {
+		name   string
+		server *httptest.Server
+		token  string
+		stage  PreflightStage
+	}{
+		{name: "us", server: us, token: "token"},
+		{name: "missing challenge", server: us, token: "other", stage: PreflightResponse},
+		{name: "someone else", server: other, token: "token", stage: PreflightResponse},
+		{name: "unreachable", server: closed, token: "token", stage: PreflightRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, port, err := net.SplitHostPort(strings.TrimPrefix(tt.server.URL, "http://"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// the URL has the domain as host, the connection goes to addr
+			url := "http://example.com:" + port + ACME_CHALLENGE_URL_PREFIX + tt.token
+			perr := probeHTTP01(url, addr, "keyauth")
+
+			if tt.stage == "" {
+				if perr != nil {
+					t.Fatalf("expected the probe to pass, got %v", perr)
+				}
+				return
+			}
+			if perr == nil || perr.Stage != tt.stage || perr.Address != addr || perr.Challenge != challenge.HTTP01 {
+				t.Fatalf("expected a %s error on %s, got %v", tt.stage, addr, perr)
+			}
+		})
+	}
+}
+
+func TestPreflightDNS01(t *testing.T) {
+	provider := startDNSServer(t)
+	useSettings(t, &InitParameters{
+		DNSProvider: provider,
+		DomainConfigs: map[string]*DomainConfig{
+			"example.com": {Challenges: []challenge.Type{challenge.DNS01}},
+			"example.org": {Challenges: []challenge.Type{challenge.DNS01}, DNSProvider: &testProvider{}},
+		},
+	})
+
+	// a domain and its wildcard share the record of their probes
+	err := Preflight([]string{"example.com", "*.example.com", "www.example.com"})
+	if err != nil {
+		t.Fatalf("expected the probes to propagate, got %v", err)
+	}
+
+	err = Preflight([]string{"example.org"})
+	var errs PreflightErrors
+	if !errors.As(err, &errs) || len(errs) != 1 || errs[0].Stage != PreflightPropagation || errs[0].Challenge != challenge.DNS01 {
+		t.Fatalf("expected a propagation error, got %v", err)
+	}
+}
+
+func TestPreflightErrors(t *testing.T) {
+	startDNSServer(t)
+	errPresent := fmt.Errorf("could not present")
+	useSettings(t, &InitParameters{
+		DomainConfigs: map[string]*DomainConfig{
+			"example.org": {Challenges: []challenge.Type{challenge.DNS01}, DNSProvider: &testProvider{err: errPresent}},
+		},
+	})
+
+	err := Preflight([]string{"com", "*.example.com", "example.org"})
+
+	var errs PreflightErrors
+	if !errors.As(err, &errs) || len(errs) != 3 {
+		t.Fatalf("expected an error for each domain, got %v", err)
+	}
+
+	byDomain := map[string]*PreflightError{}
+	for _, e := range errs {
+		byDomain[e.Domain] = e
+	}
+
+	if e := byDomain["com"]; e == nil || e.Stage != PreflightResolve {
+		t.Fatalf("expected a resolve error for a public suffix, got %v", e)
+	}
+	// without a DNSProvider, wildcards cannot be checked
+	if e := byDomain["*.example.com"]; e == nil || e.Stage != PreflightPresent || e.Challenge != challenge.DNS01 {
+		t.Fatalf("expected a present error for a wildcard, got %v", e)
+	}
+	if e := byDomain["example.org"]; e == nil || e.Stage != PreflightPresent || !errors.Is(e, errPresent) {
+		t.Fatalf("expected the error of the DNSProvider, got %v", e)
+	}
+
+	for _, d := range []string{"com", "*.example.com", "example.org"} {
+		if !strings.Contains(err.Error(), d) {
+			t.Fatalf("expected the message to mention %s, got %q", d, err.Error())
+		}
+	}
+}
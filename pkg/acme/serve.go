@@ -62,6 +62,11 @@ type challengesResolver struct {
 func (s *challengesResolver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	stripedhost := utils.StripPort(r.Host)
 
+	if strings.HasPrefix(r.URL.Path, ACME_PEER_CHALLENGE_URL_PREFIX) {
+		ServePeerChallenge(w, r)
+		return
+	}
+
 	if strings.HasPrefix(r.URL.Path, ACME_CHALLENGE_URL_PREFIX) && len(r.URL.Path) > len(ACME_CHALLENGE_URL_PREFIX) {
 		keyauth, err := GetChallenge(stripedhost, r.URL.Path[len(ACME_CHALLENGE_URL_PREFIX):])
 		if err != nil {
@@ -95,6 +100,7 @@ func (s *challengesResolver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 // Serve is blocking
 // Example of addr is :443
+// The TLSPolicy and TLSPolicies of the InitParameters apply
 // logfilepath is optional and can be empty
 func ServeHTTPS(addr string, h http.Handler, logfilepath string) error {
 	conn, err := net.Listen("tcp", addr)
@@ -103,6 +109,8 @@ func ServeHTTPS(addr string, h http.Handler, logfilepath string) error {
 	}
 	tlsConfig := new(tls.Config)
 	tlsConfig.GetCertificate = GetCertificate
+	tlsConfig.NextProtos = []string{"http/1.1", ACME_TLS_ALPN_PROTOCOL}
+	tlsPolicies().Config(tlsConfig)
 	tlsListener := tls.NewListener(conn, tlsConfig)
 
 	var f *os.File
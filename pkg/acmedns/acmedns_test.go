@@ -0,0 +1,93 @@
+package acmedns
+
+import (
+	"errors"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/arthurweinmann/go-https-hug/pkg/dnsserver"
+	"github.com/arthurweinmann/go-https-hug/pkg/storage/stores/memory"
+	"github.com/go-acme/lego/v4/challenge/dns01"
+)
+
+func TestProviderAgainstServer(t *testing.T) {
+	t.Setenv("LEGO_DISABLE_CNAME_SUPPORT", "true")
+
+	serverStore := memory.NewStore()
+	clientStore := memory.NewStore()
+
+	s, err := NewServer(serverStore, &ServerConfig{Domain: "auth.example.org"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	p := NewProvider(ts.URL, clientStore)
+
+	// the first call registers the domain and asks for the CNAME record
+	err = p.Present("example.com", "token", "keyauth")
+	var cnameErr *CNAMERequiredError
+	if !errors.As(err, &cnameErr) {
+		t.Fatalf("expected a CNAMERequiredError, got %v", err)
+	}
+	if cnameErr.FQDN != "_acme-challenge.example.com." {
+		t.Fatalf("unexpected CNAME record name %s", cnameErr.FQDN)
+	}
+
+	acct, err := p.Account("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cnameErr.Target != acct.FullDomain+"." {
+		t.Fatalf("unexpected CNAME target %s for %s", cnameErr.Target, acct.FullDomain)
+	}
+
+	for i, keyAuth := range []string{"keyauth", "keyauth2", "keyauth3"} {
+		err = p.Present("example.com", "token", keyAuth)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		values, err := dnsserver.LookupTXT(serverStore, acct.FullDomain)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(values) != min(i+1, 2) || values[len(values)-1] != dns01.GetChallengeInfo("example.com", keyAuth).Value {
+			t.Fatalf("unexpected TXT values %v after update %d", values, i)
+		}
+	}
+
+	acct.Password = "wrong"
+	err = p.Update(acct, dns01.GetChallengeInfo("example.com", "keyauth").Value)
+	if err == nil {
+		t.Fatal("expected an error with a wrong password")
+	}
+}
+
+func TestAllowFrom(t *testing.T) {
+	store := memory.NewStore()
+
+	s, err := NewServer(store, &ServerConfig{Domain: "auth.example.org"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	_, err = s.Register("not a cidr")
+	if !errors.Is(err, ErrInvalidAllowFrom) {
+		t.Fatalf("expected ErrInvalidAllowFrom, got %v", err)
+	}
+
+	acct, err := s.Register("192.0.2.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := NewProvider(ts.URL, store)
+	err = p.Update(acct, dns01.GetChallengeInfo("example.com", "keyauth").Value)
+	if err == nil {
+		t.Fatal("expected an error when updating from outside of allowfrom")
+	}
+}
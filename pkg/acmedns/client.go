@@ -0,0 +1,191 @@
+// Package acmedns implements the acme-dns protocol, see https://github.com/joohoi/acme-dns,
+// which lets you solve dns-01 challenges without granting broad DNS API credentials:
+// every domain gets its own subdomain on the acme-dns server and credentials that may only update its TXT record.
+//
+// Provider is a challenge.Provider speaking the register/update HTTP API of an acme-dns server,
+// and Server is a compatible acme-dns server you may mount on a router.Router and pair with a dnsserver.Server.
+package acmedns
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/arthurweinmann/go-https-hug/pkg/storage"
+	"github.com/go-acme/lego/v4/challenge/dns01"
+)
+
+// Account holds the acme-dns credentials of a domain
+type Account struct {
+	Username   string   `json:"username"`
+	Password   string   `json:"password"`
+	FullDomain string   `json:"fulldomain"`
+	SubDomain  string   `json:"subdomain"`
+	AllowFrom  []string `json:"allowfrom"`
+}
+
+// CNAMERequiredError is returned by Provider.Present when a domain was just registered on the acme-dns server.
+// The CNAME record must be created before the challenge can be solved, acme.VerifyChallengeDelegation tells
+// whether it is done.
+type CNAMERequiredError struct {
+	Domain string
+	// FQDN is the name of the CNAME record to create, _acme-challenge.<domain>.
+	FQDN string
+	// Target is the acme-dns full domain of the account of Domain
+	Target string
+}
+
+func (e *CNAMERequiredError) Error() string {
+	return fmt.Sprintf("acme-dns: %s was registered, create the record %s CNAME %s before retrying", e.Domain, e.FQDN, e.Target)
+}
+
+type Provider struct {
+	serverURL string
+	store     storage.Store
+	client    *http.Client
+}
+
+// NewProvider returns a Provider for the acme-dns server at serverURL, for example https://auth.example.org.
+// The credentials of every domain are persisted in store under acmedns/clients/<domain>.json.
+func NewProvider(serverURL string, store storage.Store) *Provider {
+	return &Provider{
+		serverURL: strings.TrimSuffix(serverURL, "/"),
+		store:     store,
+		client: &http.Client{
+			Timeout: 30 * time.Second,
+		},
+	}
+}
+
+// Account returns the stored credentials of domain, or storage.ErrNotFound
+func (p *Provider) Account(domain string) (*Account, error) {
+	b, err := p.store.GetKV(clientAccountKey(domain))
+	if err != nil {
+		return nil, err
+	}
+
+	acct := &Account{}
+	err = json.Unmarshal(b, acct)
+	if err != nil {
+		return nil, err
+	}
+
+	return acct, nil
+}
+
+// Register creates an account for domain on the acme-dns server and stores it.
+// allowFrom optionally restricts the networks, in CIDR notation, allowed to update its record.
+func (p *Provider) Register(domain string, allowFrom ...string) (*Account, error) {
+	body, err := json.Marshal(map[string][]string{"allowfrom": allowFrom})
+	if err != nil {
+		return nil, err
+	}
+
+	acct := &Account{}
+	err = p.do("/register", nil, body, http.StatusCreated, acct)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := json.Marshal(acct)
+	if err != nil {
+		return nil, err
+	}
+
+	err = p.store.SetKV(clientAccountKey(domain), b, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return acct, nil
+}
+
+func (p *Provider) Present(domain, token, keyAuth string) error {
+	acct, err := p.Account(domain)
+	if err != nil {
+		if err != storage.ErrNotFound {
+			return err
+		}
+
+		acct, err = p.Register(domain)
+		if err != nil {
+			return err
+		}
+
+		return &CNAMERequiredError{
+			Domain: domain,
+			FQDN:   dns01.GetChallengeInfo(domain, keyAuth).FQDN,
+			Target: acct.FullDomain + ".",
+		}
+	}
+
+	return p.Update(acct, dns01.GetChallengeInfo(domain, keyAuth).Value)
+}
+
+// CleanUp does nothing, the acme-dns server only keeps the last two TXT values of an account
+func (p *Provider) CleanUp(domain, token, keyAuth string) error {
+	return nil
+}
+
+// Update sets the TXT record of the account
+func (p *Provider) Update(acct *Account, txt string) error {
+	body, err := json.Marshal(map[string]string{
+		"subdomain": acct.SubDomain,
+		"txt":       txt,
+	})
+	if err != nil {
+		return err
+	}
+
+	return p.do("/update", map[string]string{
+		"X-Api-User": acct.Username,
+		"X-Api-Key":  acct.Password,
+	}, body, http.StatusOK, nil)
+}
+
+func (p *Provider) do(path string, headers map[string]string, body []byte, expectedStatus int, out any) error {
+	req, err := http.NewRequest(http.MethodPost, p.serverURL+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != expectedStatus {
+		var e struct {
+			Error string `json:"error"`
+		}
+		json.Unmarshal(b, &e)
+		if e.Error == "" {
+			e.Error = strings.TrimSpace(string(b))
+		}
+		return fmt.Errorf("acme-dns %s: status code %d: %s", path, resp.StatusCode, e.Error)
+	}
+
+	if out != nil {
+		return json.Unmarshal(b, out)
+	}
+
+	return nil
+}
+
+func clientAccountKey(domain string) string {
+	return "acmedns/clients/" + strings.ToLower(strings.TrimPrefix(domain, "*.")) + ".json"
+}
@@ -0,0 +1,309 @@
+package acmedns
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/arthurweinmann/go-https-hug/internal/utils"
+	"github.com/arthurweinmann/go-https-hug/pkg/dnsserver"
+	"github.com/arthurweinmann/go-https-hug/pkg/router"
+	"github.com/arthurweinmann/go-https-hug/pkg/storage"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var ErrInvalidAllowFrom = errors.New("invalid allowfrom")
+
+type ServerConfig struct {
+	// Domain under which the subdomains of the accounts are created, for example auth.example.org.
+	// It must be delegated to a dnsserver.Server sharing the Store of the Server.
+	Domain string
+
+	// If true, /register is disabled and accounts must be created with Server.Register
+	DisableRegistration bool
+}
+
+// Server is an acme-dns compatible server. It stores the TXT records of its accounts in the format
+// of the dnsserver package, so that a dnsserver.Server sharing its Store answers them.
+// It implements http.Handler, and Server.Hijack may be used in the PerDomainHijack of a router.Router,
+// in which case the Router must accept requests without Origin header, for example with AllowOrigins set to *.
+type Server struct {
+	store               storage.Store
+	domain              string
+	disableRegistration bool
+}
+
+type serverAccount struct {
+	Username     string   `json:"username"`
+	PasswordHash []byte   `json:"passwordHash"`
+	SubDomain    string   `json:"subdomain"`
+	AllowFrom    []string `json:"allowfrom"`
+}
+
+func NewServer(store storage.Store, config *ServerConfig) (*Server, error) {
+	if store == nil {
+		return nil, fmt.Errorf("we need a Store")
+	}
+	if config.Domain == "" {
+		return nil, fmt.Errorf("we need a Domain")
+	}
+
+	return &Server{
+		store:               store,
+		domain:              strings.ToLower(strings.Trim(config.Domain, ".")),
+		disableRegistration: config.DisableRegistration,
+	}, nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == "/register" && r.Method == http.MethodPost && !s.disableRegistration:
+		s.register(w, r)
+	case r.URL.Path == "/update" && r.Method == http.MethodPost:
+		s.update(w, r)
+	case r.URL.Path == "/health" && r.Method == http.MethodGet:
+		w.WriteHeader(http.StatusOK)
+	default:
+		sendError(w, "not_found", http.StatusNotFound)
+	}
+}
+
+// Hijack serves the acme-dns API when it is used as a PerDomainHijack handler of a router.Router
+func (s *Server) Hijack(ctx context.Context, r *router.Router, spath []string, w http.ResponseWriter, req *http.Request, domain string) (next bool) {
+	if len(spath) != 1 {
+		return true
+	}
+
+	switch spath[0] {
+	case "register", "update", "health":
+		s.ServeHTTP(w, req)
+		return false
+	}
+
+	return true
+}
+
+// Register creates an account, allowFrom optionally restricts the networks, in CIDR notation, allowed to update its record
+func (s *Server) Register(allowFrom ...string) (*Account, error) {
+	for _, cidr := range allowFrom {
+		_, _, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("%w %s: %v", ErrInvalidAllowFrom, cidr, err)
+		}
+	}
+
+	password := randomString(30)
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), 10)
+	if err != nil {
+		return nil, err
+	}
+
+	sa := &serverAccount{
+		Username:     randomUUID(),
+		PasswordHash: hash,
+		SubDomain:    randomUUID(),
+		AllowFrom:    allowFrom,
+	}
+
+	b, err := json.Marshal(sa)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.store.SetKV(serverAccountKey(sa.Username), b, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Account{
+		Username:   sa.Username,
+		Password:   password,
+		FullDomain: sa.SubDomain + "." + s.domain,
+		SubDomain:  sa.SubDomain,
+		AllowFrom:  sa.AllowFrom,
+	}, nil
+}
+
+func (s *Server) register(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		AllowFrom []string `json:"allowfrom"`
+	}
+
+	b, err := io.ReadAll(io.LimitReader(r.Body, 1<<16))
+	if err != nil {
+		sendError(w, "malformed_json_payload", http.StatusBadRequest)
+		return
+	}
+	if len(b) > 0 {
+		err = json.Unmarshal(b, &body)
+		if err != nil {
+			sendError(w, "malformed_json_payload", http.StatusBadRequest)
+			return
+		}
+	}
+
+	acct, err := s.Register(body.AllowFrom...)
+	if err != nil {
+		if errors.Is(err, ErrInvalidAllowFrom) {
+			sendError(w, "invalid_allowfrom_cidr", http.StatusBadRequest)
+			return
+		}
+		sendError(w, "internal_error", http.StatusInternalServerError)
+		return
+	}
+
+	sendJSON(w, http.StatusCreated, acct)
+}
+
+func (s *Server) update(w http.ResponseWriter, r *http.Request) {
+	sa, err := s.account(r.Header.Get("X-Api-User"))
+	if err != nil {
+		if err == storage.ErrNotFound {
+			sendError(w, "forbidden", http.StatusUnauthorized)
+			return
+		}
+		sendError(w, "internal_error", http.StatusInternalServerError)
+		return
+	}
+
+	if bcrypt.CompareHashAndPassword(sa.PasswordHash, []byte(r.Header.Get("X-Api-Key"))) != nil {
+		sendError(w, "forbidden", http.StatusUnauthorized)
+		return
+	}
+
+	if !allowedFrom(sa.AllowFrom, r.RemoteAddr) {
+		sendError(w, "forbidden", http.StatusUnauthorized)
+		return
+	}
+
+	var body struct {
+		SubDomain string `json:"subdomain"`
+		TXT       string `json:"txt"`
+	}
+	err = json.NewDecoder(io.LimitReader(r.Body, 1<<16)).Decode(&body)
+	if err != nil {
+		sendError(w, "malformed_json_payload", http.StatusBadRequest)
+		return
+	}
+
+	if body.SubDomain != sa.SubDomain {
+		sendError(w, "bad_subdomain", http.StatusUnauthorized)
+		return
+	}
+
+	// the base64url encoded SHA-256 digest of a key authorization
+	if len(body.TXT) != 43 {
+		sendError(w, "bad_txt", http.StatusBadRequest)
+		return
+	}
+	if _, err := base64.RawURLEncoding.DecodeString(body.TXT); err != nil {
+		sendError(w, "bad_txt", http.StatusBadRequest)
+		return
+	}
+
+	err = s.setTXT(sa.SubDomain+"."+s.domain, body.TXT)
+	if err != nil {
+		sendError(w, "internal_error", http.StatusInternalServerError)
+		return
+	}
+
+	sendJSON(w, http.StatusOK, map[string]string{"txt": body.TXT})
+}
+
+// setTXT keeps the last two values of fqdn, so that a certificate covering both a domain and its wildcard can be validated
+func (s *Server) setTXT(fqdn, txt string) error {
+	return dnsserver.UpdateTXT(s.store, fqdn, func(values []string) []string {
+		values = append(values, txt)
+		if len(values) > 2 {
+			values = values[len(values)-2:]
+		}
+		return values
+	}, 0)
+}
+
+func (s *Server) account(username string) (*serverAccount, error) {
+	if username == "" || utils.ContainsDotDot(username) || strings.ContainsAny(username, "/\\") {
+		return nil, storage.ErrNotFound
+	}
+
+	b, err := s.store.GetKV(serverAccountKey(username))
+	if err != nil {
+		return nil, err
+	}
+
+	sa := &serverAccount{}
+	err = json.Unmarshal(b, sa)
+	if err != nil {
+		return nil, err
+	}
+
+	return sa, nil
+}
+
+func allowedFrom(cidrs []string, remoteAddr string) bool {
+	if len(cidrs) == 0 {
+		return true
+	}
+
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err == nil && n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func serverAccountKey(username string) string {
+	return "acmedns/server/" + username + ".json"
+}
+
+func sendJSON(w http.ResponseWriter, statusCode int, v any) {
+	b, err := router.JSONMarshal(v)
+	if err != nil {
+		sendError(w, "internal_error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	w.Write(b)
+}
+
+// sendError writes errors the way acme-dns does, which is what its clients parse
+func sendError(w http.ResponseWriter, code string, statusCode int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	b, _ := json.Marshal(map[string]string{"error": code})
+	w.Write(b)
+}
+
+func randomUUID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+func randomString(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)[:n]
+}
@@ -0,0 +1,323 @@
+// Package dnsresolver provides the DNS resolver used to verify TXT records, run pre-flight checks
+// and check the propagation of dns-01 challenges. It may use the resolver of the operating system,
+// plain DNS nameservers, DNS over TLS or DNS over HTTPS upstreams, so that it also works
+// in air-gapped and split-horizon networks.
+package dnsresolver
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+type Config struct {
+	// System uses the resolver of the operating system, other upstreams are then ignored
+	System bool
+
+	// Nameservers are plain DNS servers, as host or host:port, port 53 by default
+	Nameservers []string
+
+	// DoT are DNS over TLS upstreams, as host or host:port, port 853 by default.
+	// The host is also the TLS server name.
+	DoT []string
+
+	// DoH are DNS over HTTPS upstreams, for example https://cloudflare-dns.com/dns-query
+	DoH []string
+
+	// Timeout of each query, 10 seconds if zero
+	Timeout time.Duration
+}
+
+type Resolver struct {
+	system      *net.Resolver
+	upstreams   []upstream
+	nameservers []string
+	timeout     time.Duration
+}
+
+type upstream struct {
+	// one of udp, tcp-tls or https
+	proto string
+	addr  string
+}
+
+// Default returns the historical resolver of this module, Google Public DNS at 8.8.8.8
+func Default() *Resolver {
+	r, _ := New(&Config{Nameservers: []string{"8.8.8.8"}})
+	return r
+}
+
+func New(config *Config) (*Resolver, error) {
+	r := &Resolver{
+		timeout: config.Timeout,
+	}
+
+	if r.timeout == 0 {
+		r.timeout = 10 * time.Second
+	}
+
+	if config.System {
+		r.system = net.DefaultResolver
+
+		// Exchange still needs nameservers
+		cc, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+		if err == nil {
+			for _, s := range cc.Servers {
+				r.nameservers = append(r.nameservers, net.JoinHostPort(s, cc.Port))
+			}
+		}
+	} else {
+		for _, ns := range config.Nameservers {
+			r.nameservers = append(r.nameservers, withDefaultPort(ns, "53"))
+		}
+	}
+
+	for _, ns := range r.nameservers {
+		r.upstreams = append(r.upstreams, upstream{proto: "udp", addr: ns})
+	}
+
+	if !config.System {
+		for _, dot := range config.DoT {
+			r.upstreams = append(r.upstreams, upstream{proto: "tcp-tls", addr: withDefaultPort(dot, "853")})
+		}
+
+		for _, doh := range config.DoH {
+			if !strings.HasPrefix(doh, "https://") {
+				return nil, fmt.Errorf("invalid DNS over HTTPS upstream %s", doh)
+			}
+			r.upstreams = append(r.upstreams, upstream{proto: "https", addr: doh})
+		}
+	}
+
+	if r.system == nil && len(r.upstreams) == 0 {
+		return nil, fmt.Errorf("we need System or at least one upstream")
+	}
+
+	return r, nil
+}
+
+// Nameservers returns the plain DNS nameservers as host:port, for the resolvers which only support those
+func (r *Resolver) Nameservers() []string {
+	return r.nameservers
+}
+
+// Timeout returns the timeout of each query
+func (r *Resolver) Timeout() time.Duration {
+	return r.timeout
+}
+
+// Exchange sends the query m to the upstreams in order, until one of them answers
+func (r *Resolver) Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	if len(r.upstreams) == 0 {
+		return nil, fmt.Errorf("no upstream to send the query to")
+	}
+
+	var errs []error
+	for _, u := range r.upstreams {
+		resp, err := r.exchange(ctx, u, m)
+		if err == nil {
+			return resp, nil
+		}
+		errs = append(errs, fmt.Errorf("%s://%s: %v", u.proto, u.addr, err))
+
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	return nil, errors.Join(errs...)
+}
+
+func (r *Resolver) exchange(ctx context.Context, u upstream, m *dns.Msg) (*dns.Msg, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	switch u.proto {
+	case "https":
+		return r.exchangeHTTPS(ctx, u.addr, m)
+
+	case "tcp-tls":
+		host, _, _ := net.SplitHostPort(u.addr)
+		c := &dns.Client{Net: "tcp-tls", Timeout: r.timeout, TLSConfig: &tls.Config{ServerName: host}}
+		resp, _, err := c.ExchangeContext(ctx, m, u.addr)
+		return resp, err
+
+	default:
+		c := &dns.Client{Net: "udp", Timeout: r.timeout}
+		resp, _, err := c.ExchangeContext(ctx, m, u.addr)
+		if err == nil && resp.Truncated {
+			c.Net = "tcp"
+			resp, _, err = c.ExchangeContext(ctx, m, u.addr)
+		}
+		return resp, err
+	}
+}
+
+// exchangeHTTPS implements RFC 8484
+func (r *Resolver) exchangeHTTPS(ctx context.Context, url string, m *dns.Msg) (*dns.Msg, error) {
+	// the ID should be 0 for caching, see RFC 8484 section 4.1
+	q := m.Copy()
+	q.Id = 0
+
+	b, err := q.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status code %d", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 65535))
+	if err != nil {
+		return nil, err
+	}
+
+	ret := new(dns.Msg)
+	err = ret.Unpack(body)
+	if err != nil {
+		return nil, err
+	}
+	ret.Id = m.Id
+
+	return ret, nil
+}
+
+func (r *Resolver) query(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), qtype)
+	m.RecursionDesired = true
+	m.SetEdns0(4096, false)
+
+	resp, err := r.Exchange(ctx, m)
+	if err != nil {
+		return nil, &net.DNSError{Err: err.Error(), Name: name, IsTemporary: true}
+	}
+
+	switch resp.Rcode {
+	case dns.RcodeSuccess:
+		return resp, nil
+	case dns.RcodeNameError:
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	default:
+		return nil, &net.DNSError{Err: dns.RcodeToString[resp.Rcode], Name: name, IsTemporary: resp.Rcode == dns.RcodeServerFailure}
+	}
+}
+
+// LookupTXT returns the TXT records of name, following CNAMEs
+func (r *Resolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	if r.system != nil {
+		return r.system.LookupTXT(ctx, name)
+	}
+
+	resp, err := r.query(ctx, name, dns.TypeTXT)
+	if err != nil {
+		return nil, err
+	}
+
+	var ret []string
+	for _, rr := range resp.Answer {
+		if txt, ok := rr.(*dns.TXT); ok {
+			ret = append(ret, strings.Join(txt.Txt, ""))
+		}
+	}
+
+	return ret, nil
+}
+
+// LookupHost returns the IPv4 and IPv6 addresses of host, following CNAMEs
+func (r *Resolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	if r.system != nil {
+		return r.system.LookupHost(ctx, host)
+	}
+
+	var ret []string
+	var lastErr error
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		resp, err := r.query(ctx, host, qtype)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		for _, rr := range resp.Answer {
+			switch rr := rr.(type) {
+			case *dns.A:
+				ret = append(ret, rr.A.String())
+			case *dns.AAAA:
+				ret = append(ret, rr.AAAA.String())
+			}
+		}
+	}
+
+	if len(ret) == 0 {
+		if lastErr != nil {
+			return nil, lastErr
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+
+	return ret, nil
+}
+
+// LookupCNAME follows the CNAME records of name and returns the canonical name they end up at,
+// or name itself, as a fully qualified domain name, if it is not an alias
+func (r *Resolver) LookupCNAME(ctx context.Context, name string) (string, error) {
+	name = dns.Fqdn(strings.ToLower(name))
+
+	// bound the chain so that loops do not spin forever
+	for i := 0; i < 16; i++ {
+		resp, err := r.query(ctx, name, dns.TypeCNAME)
+		if err != nil {
+			var dnserr *net.DNSError
+			if errors.As(err, &dnserr) && dnserr.IsNotFound {
+				return name, nil
+			}
+			return "", err
+		}
+
+		var target string
+		for _, rr := range resp.Answer {
+			if cname, ok := rr.(*dns.CNAME); ok && strings.EqualFold(cname.Hdr.Name, name) {
+				target = strings.ToLower(cname.Target)
+			}
+		}
+
+		if target == "" || target == name {
+			return name, nil
+		}
+
+		name = target
+	}
+
+	return "", fmt.Errorf("too many CNAME records following %s", name)
+}
+
+func withDefaultPort(hostport, port string) string {
+	if _, _, err := net.SplitHostPort(hostport); err == nil {
+		return hostport
+	}
+	return net.JoinHostPort(strings.Trim(hostport, "[]"), port)
+}
@@ -0,0 +1,68 @@
+package dnsresolver
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/arthurweinmann/go-https-hug/internal/dnstest"
+)
+
+var zone = []string{
+	"_acme-challenge.example.com. 60 IN CNAME _acme-challenge.example.net.",
+	"_acme-challenge.example.net. 60 IN TXT \"value\"",
+	"www.example.com. 60 IN CNAME example.com.",
+	"example.com. 60 IN A 192.0.2.1",
+	"example.com. 60 IN AAAA 2001:db8::1",
+}
+
+func TestNameservers(t *testing.T) {
+	addr := dnstest.StartNameserver(t, zone...)
+
+	// the first nameserver does not answer, the second one must be used
+	r, err := New(&Config{Nameservers: []string{"127.0.0.1:1", addr}, Timeout: 500 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	txt, err := r.LookupTXT(ctx, "_acme-challenge.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(txt) != 1 || txt[0] != "value" {
+		t.Fatalf("unexpected TXT records %v", txt)
+	}
+
+	target, err := r.LookupCNAME(ctx, "_acme-challenge.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target != "_acme-challenge.example.net." {
+		t.Fatalf("unexpected CNAME target %s", target)
+	}
+
+	target, err = r.LookupCNAME(ctx, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target != "example.com." {
+		t.Fatalf("a name without CNAME should be its own target, got %s", target)
+	}
+
+	addrs, err := r.LookupHost(ctx, "www.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 2 {
+		t.Fatalf("unexpected addresses %v", addrs)
+	}
+
+	_, err = r.LookupTXT(ctx, "missing.example.com")
+	var dnserr *net.DNSError
+	if !errors.As(err, &dnserr) || !dnserr.IsNotFound {
+		t.Fatalf("expected a not found error, got %v", err)
+	}
+}
@@ -0,0 +1,37 @@
+package dnsserver
+
+import (
+	"time"
+
+	"github.com/arthurweinmann/go-https-hug/pkg/storage"
+	"github.com/go-acme/lego/v4/challenge/dns01"
+)
+
+// Provider is a challenge.Provider for the dns-01 challenge writing the TXT records in a storage.Store,
+// from which every Server sharing this Store answers them.
+// Use it as the DNSProvider of acme.InitParameters once the _acme-challenge records of your domains are delegated,
+// with NS or CNAME records, to the Servers.
+type Provider struct {
+	store storage.Store
+}
+
+func NewProvider(store storage.Store) *Provider {
+	return &Provider{
+		store: store,
+	}
+}
+
+func (p *Provider) Present(domain, token, keyAuth string) error {
+	info := dns01.GetChallengeInfo(domain, keyAuth)
+	return AddTXT(p.store, info.EffectiveFQDN, info.Value, RecordExpiration)
+}
+
+func (p *Provider) CleanUp(domain, token, keyAuth string) error {
+	info := dns01.GetChallengeInfo(domain, keyAuth)
+	return RemoveTXT(p.store, info.EffectiveFQDN, info.Value)
+}
+
+// Timeout returns the propagation timeout and polling interval, our records are available as soon as they are stored
+func (p *Provider) Timeout() (timeout, interval time.Duration) {
+	return time.Minute, 2 * time.Second
+}
@@ -0,0 +1,192 @@
+package dnsserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/arthurweinmann/go-https-hug/pkg/storage"
+)
+
+// TXT records are stored under challenges/dns/<fqdn> as a JSON records object, a name may hold several values,
+// for example when a certificate covers both a domain and its wildcard.
+
+// recordsMu serializes the updates of the records when the Store cannot compare and swap,
+// it does not protect them from other processes
+var recordsMu sync.Mutex
+
+// RecordExpiration is how long challenge records are kept if they are not cleaned up
+const RecordExpiration = 30 * time.Minute
+
+// KeepExpiration makes UpdateTXT keep the current expiration of the records
+const KeepExpiration time.Duration = -1
+
+// emptyExpiration is how long records without values are kept, they cannot be deleted with compare-and-swap
+const emptyExpiration = time.Minute
+
+const maxUpdateAttempts = 10
+
+// records keeps the expiration of the values, so that removing one of them does not change the one of the others
+type records struct {
+	Values []string
+	// Expiration is zero if the records do not expire
+	Expiration time.Time
+}
+
+func recordKey(fqdn string) string {
+	return "challenges/dns/" + formatFQDN(fqdn)
+}
+
+// formatFQDN lowercases fqdn and makes sure it ends with a dot
+func formatFQDN(fqdn string) string {
+	return strings.ToLower(strings.TrimSuffix(fqdn, ".")) + "."
+}
+
+// decodeRecords also reads the plain JSON arrays of values written by previous versions, which do not expire
+func decodeRecords(b []byte, now time.Time) (*records, error) {
+	r := &records{}
+
+	var err error
+	if len(b) > 0 && b[0] == '[' {
+		err = json.Unmarshal(b, &r.Values)
+	} else {
+		err = json.Unmarshal(b, r)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if !r.Expiration.IsZero() && !now.Before(r.Expiration) {
+		return &records{}, nil
+	}
+
+	return r, nil
+}
+
+// LookupTXT returns the TXT values stored for fqdn, or storage.ErrNotFound
+func LookupTXT(store storage.Store, fqdn string) ([]string, error) {
+	b, err := store.GetKV(recordKey(fqdn))
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := decodeRecords(b, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	if len(r.Values) == 0 {
+		return nil, storage.ErrNotFound
+	}
+
+	return r.Values, nil
+}
+
+// AddTXT adds value to the TXT records of fqdn, they expire after expiration if it is not zero
+func AddTXT(store storage.Store, fqdn, value string, expiration time.Duration) error {
+	return UpdateTXT(store, fqdn, func(values []string) []string {
+		if slices.Contains(values, value) {
+			return values
+		}
+		return append(values, value)
+	}, expiration)
+}
+
+// RemoveTXT removes value from the TXT records of fqdn, the others keep their expiration
+func RemoveTXT(store storage.Store, fqdn, value string) error {
+	return UpdateTXT(store, fqdn, func(values []string) []string {
+		return slices.DeleteFunc(values, func(v string) bool { return v == value })
+	}, KeepExpiration)
+}
+
+// SetTXT replaces the TXT records of fqdn with values, they expire after expiration if it is not zero
+func SetTXT(store storage.Store, fqdn string, values []string, expiration time.Duration) error {
+	return UpdateTXT(store, fqdn, func([]string) []string {
+		return values
+	}, expiration)
+}
+
+// UpdateTXT replaces the TXT records of fqdn with the ones returned by update, which is given the current ones
+// and may be called several times. They expire after expiration if it is positive, never if it is zero,
+// and keep their current expiration if it is KeepExpiration.
+// The records are updated with compare-and-swap if the Store implements storage.CompareAndSwapper,
+// so that several nodes sharing the Store may update them concurrently.
+func UpdateTXT(store storage.Store, fqdn string, update func(values []string) []string, expiration time.Duration) error {
+	key := recordKey(fqdn)
+
+	cas, ok := store.(storage.CompareAndSwapper)
+	if !ok {
+		recordsMu.Lock()
+		defer recordsMu.Unlock()
+	}
+
+	for attempt := 0; attempt < maxUpdateAttempts; attempt++ {
+		now := time.Now()
+
+		prev, err := store.GetKV(key)
+		if err != nil && err != storage.ErrNotFound {
+			return err
+		}
+		if err == storage.ErrNotFound {
+			prev = nil
+		}
+
+		cur := &records{}
+		if prev != nil {
+			cur, err = decodeRecords(prev, now)
+			if err != nil {
+				return err
+			}
+		}
+
+		next := &records{Values: update(slices.Clone(cur.Values)), Expiration: cur.Expiration}
+		switch {
+		case expiration > 0:
+			next.Expiration = now.Add(expiration)
+		case expiration == 0:
+			next.Expiration = time.Time{}
+		}
+		if len(next.Values) == 0 {
+			if prev == nil {
+				return nil
+			}
+			if next.Expiration.IsZero() || next.Expiration.After(now.Add(emptyExpiration)) {
+				next.Expiration = now.Add(emptyExpiration)
+			}
+		}
+
+		b, err := json.Marshal(next)
+		if err != nil {
+			return err
+		}
+
+		var ttl time.Duration
+		if !next.Expiration.IsZero() {
+			ttl = max(next.Expiration.Sub(now), time.Millisecond)
+		}
+
+		if !ok {
+			return store.SetKV(key, b, ttl)
+		}
+
+		swapped, err := cas.CompareAndSwapKV(key, prev, b, ttl)
+		if errors.Is(err, errors.ErrUnsupported) {
+			ok = false
+			recordsMu.Lock()
+			defer recordsMu.Unlock()
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if swapped {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("the TXT records of %s keep being updated concurrently", fqdn)
+}
@@ -0,0 +1,96 @@
+package dnsserver
+
+import (
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/arthurweinmann/go-https-hug/pkg/storage"
+	"github.com/arthurweinmann/go-https-hug/pkg/storage/stores/memory"
+)
+
+// racingStore runs race, the update of another node sharing the Store, after its first read of the records
+type racingStore struct {
+	*memory.Store
+	once sync.Once
+	race func()
+}
+
+func (s *racingStore) GetKV(key string) ([]byte, error) {
+	b, err := s.Store.GetKV(key)
+	s.once.Do(s.race)
+	return b, err
+}
+
+func TestConcurrentRecords(t *testing.T) {
+	shared := memory.NewStore()
+	fqdn := "_acme-challenge.example.com."
+
+	store := &racingStore{Store: shared, race: func() {
+		err := AddTXT(shared, fqdn, "wildcard", RecordExpiration)
+		if err != nil {
+			t.Error(err)
+		}
+	}}
+
+	err := AddTXT(store, fqdn, "apex", RecordExpiration)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	values, err := LookupTXT(shared, fqdn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(values)
+	if !slices.Equal(values, []string{"apex", "wildcard"}) {
+		t.Fatalf("expected the values of both nodes, got %v", values)
+	}
+}
+
+func TestRemoveKeepsExpiration(t *testing.T) {
+	store := memory.NewStore()
+
+	for fqdn, expiration := range map[string]time.Duration{"expiring.example.com": RecordExpiration, "persistent.example.com": 0} {
+		for _, v := range []string{"a", "b"} {
+			err := AddTXT(store, fqdn, v, expiration)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		before, err := store.StatKV(recordKey(fqdn))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = RemoveTXT(store, fqdn, "a")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		values, err := LookupTXT(store, fqdn)
+		if err != nil || !slices.Equal(values, []string{"b"}) {
+			t.Fatalf("%s: expected the remaining value, got %v %v", fqdn, values, err)
+		}
+
+		after, err := store.StatKV(recordKey(fqdn))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d := after.Expiration.Sub(before.Expiration).Abs(); d > time.Second || after.Expiration.IsZero() != (expiration == 0) {
+			t.Fatalf("%s: the expiration changed from %v to %v", fqdn, before.Expiration, after.Expiration)
+		}
+
+		// removing the last value leaves no record
+		err = RemoveTXT(store, fqdn, "b")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = LookupTXT(store, fqdn)
+		if err != storage.ErrNotFound {
+			t.Fatalf("%s: expected ErrNotFound, got %v", fqdn, err)
+		}
+	}
+}
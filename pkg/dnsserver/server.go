@@ -0,0 +1,296 @@
+// Package dnsserver is an embedded authoritative DNS server answering the TXT queries of dns-01 challenges
+// from records kept in a storage.Store, so that you do not depend on a third-party DNS API.
+// Delegate the _acme-challenge subdomains of your domains to it, for example with
+//
+//	_acme-challenge.example.com. NS acme-ns.example.net.
+//
+// or with a CNAME to a name in a zone delegated to it, and use a Provider as the acme DNSProvider.
+// Every node of a cluster sharing the Store can run a Server and answer the challenges.
+package dnsserver
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/arthurweinmann/go-https-hug/pkg/logging"
+	"github.com/arthurweinmann/go-https-hug/pkg/storage"
+	"github.com/miekg/dns"
+)
+
+type Config struct {
+	// Addr is the UDP and TCP address to listen on, :53 if empty
+	Addr string
+
+	// Zones we are authoritative for, names outside of them are refused.
+	// If empty, we answer for any name, which is fine when only _acme-challenge records are delegated to us.
+	Zones []string
+
+	// NS are the names of the nameservers of the Zones, for their NS and SOA records.
+	// If empty, the first Zone prefixed with ns. is used.
+	NS []string
+
+	// Hostmaster is the mailbox of the SOA records, hostmaster.<zone> if empty
+	Hostmaster string
+
+	// TTL of the answers, in seconds. Challenge records must not be cached for long, 0 means 10 seconds.
+	TTL uint32
+
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+
+	LogLevel logging.LogLevel
+}
+
+type Server struct {
+	ctx   context.Context
+	store storage.Store
+	addr  string
+
+	zones      []string
+	ns         []string
+	hostmaster string
+	ttl        uint32
+
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+
+	logger *slog.Logger
+}
+
+func NewServer(ctx context.Context, store storage.Store, config *Config) (*Server, error) {
+	if store == nil {
+		return nil, fmt.Errorf("we need a Store")
+	}
+
+	s := &Server{
+		ctx:          ctx,
+		store:        store,
+		addr:         config.Addr,
+		hostmaster:   config.Hostmaster,
+		ttl:          config.TTL,
+		readTimeout:  config.ReadTimeout,
+		writeTimeout: config.WriteTimeout,
+	}
+
+	if s.addr == "" {
+		s.addr = ":53"
+	}
+
+	if s.ttl == 0 {
+		s.ttl = 10
+	}
+
+	for _, z := range config.Zones {
+		s.zones = append(s.zones, formatFQDN(z))
+	}
+
+	for _, ns := range config.NS {
+		s.ns = append(s.ns, formatFQDN(ns))
+	}
+	if len(s.ns) == 0 && len(s.zones) > 0 {
+		s.ns = []string{"ns." + s.zones[0]}
+	}
+
+	if config.LogLevel != logging.NONE {
+		s.logger = slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
+			Level: config.LogLevel.Sloglevel(),
+		}))
+	} else {
+		s.logger = slog.New(slog.NewJSONHandler(io.Discard, nil))
+	}
+
+	return s, nil
+}
+
+// ListenAndServe listens on the UDP and TCP Addr of the config and blocks until the context of the Server is done
+func (s *Server) ListenAndServe() error {
+	pc, err := net.ListenPacket("udp", s.addr)
+	if err != nil {
+		return err
+	}
+
+	ln, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		pc.Close()
+		return err
+	}
+
+	return s.Serve(pc, ln)
+}
+
+// Serve answers the queries received on udp and tcp, either may be nil.
+// It blocks until the context of the Server is done or one of the listeners fails.
+func (s *Server) Serve(udp net.PacketConn, tcp net.Listener) error {
+	var servers []*dns.Server
+	cherr := make(chan error, 2)
+
+	if udp != nil {
+		servers = append(servers, &dns.Server{
+			PacketConn:   udp,
+			Handler:      s,
+			ReadTimeout:  s.readTimeout,
+			WriteTimeout: s.writeTimeout,
+		})
+	}
+	if tcp != nil {
+		servers = append(servers, &dns.Server{
+			Listener:     tcp,
+			Handler:      s,
+			ReadTimeout:  s.readTimeout,
+			WriteTimeout: s.writeTimeout,
+		})
+	}
+
+	for _, serv := range servers {
+		go func(serv *dns.Server) {
+			addr := ""
+			if serv.PacketConn != nil {
+				addr = "udp://" + serv.PacketConn.LocalAddr().String()
+			} else {
+				addr = "tcp://" + serv.Listener.Addr().String()
+			}
+			s.logger.Info("Listening", slog.String("addr", addr))
+			err := serv.ActivateAndServe()
+			s.logger.Info("Closing Listener", slog.String("addr", addr))
+			cherr <- err
+		}(serv)
+	}
+
+	var err error
+	select {
+	case err = <-cherr:
+		if err != nil {
+			s.logger.Error("Error from one of the dns servers", slog.String("error", err.Error()))
+		}
+	case <-s.ctx.Done():
+	}
+	s.logger.Info("Shutting down..")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for _, serv := range servers {
+		serv.ShutdownContext(ctx)
+	}
+
+	return err
+}
+
+func (s *Server) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Authoritative = true
+
+	if len(r.Question) != 1 || r.Opcode != dns.OpcodeQuery {
+		m.Rcode = dns.RcodeNotImplemented
+		w.WriteMsg(m)
+		return
+	}
+
+	q := r.Question[0]
+	name := strings.ToLower(q.Name)
+
+	s.logger.Debug("Received DNS query", slog.String("name", name), slog.String("type", dns.TypeToString[q.Qtype]))
+
+	zone, ok := s.zoneOf(name)
+	if !ok || q.Qclass != dns.ClassINET {
+		m.Authoritative = false
+		m.Rcode = dns.RcodeRefused
+		w.WriteMsg(m)
+		return
+	}
+
+	values, err := LookupTXT(s.store, name)
+	if err != nil && err != storage.ErrNotFound {
+		s.logger.Error("LookupTXT", slog.String("name", name), slog.String("error", err.Error()))
+		m.Rcode = dns.RcodeServerFailure
+		w.WriteMsg(m)
+		return
+	}
+
+	isApex := zone != "" && name == zone
+
+	switch {
+	case q.Qtype == dns.TypeTXT && len(values) > 0:
+		for _, v := range values {
+			m.Answer = append(m.Answer, &dns.TXT{
+				Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: s.ttl},
+				Txt: []string{v},
+			})
+		}
+
+	case isApex && q.Qtype == dns.TypeSOA:
+		m.Answer = append(m.Answer, s.soa(zone))
+
+	case isApex && q.Qtype == dns.TypeNS:
+		for _, ns := range s.ns {
+			m.Answer = append(m.Answer, &dns.NS{
+				Hdr: dns.RR_Header{Name: zone, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: s.ttl},
+				Ns:  ns,
+			})
+		}
+
+	case len(values) > 0 || isApex:
+		// the name exists, but not with this type
+
+	default:
+		m.Rcode = dns.RcodeNameError
+	}
+
+	if len(m.Answer) == 0 {
+		soaZone := zone
+		if soaZone == "" {
+			soaZone = name
+		}
+		m.Ns = append(m.Ns, s.soa(soaZone))
+	}
+
+	err = w.WriteMsg(m)
+	if err != nil {
+		s.logger.Error("WriteMsg", slog.String("error", err.Error()))
+	}
+}
+
+// zoneOf returns the most specific of our zones name belongs to, an empty zone when we answer for any name
+func (s *Server) zoneOf(name string) (string, bool) {
+	if len(s.zones) == 0 {
+		return "", true
+	}
+
+	var best string
+	for _, z := range s.zones {
+		if dns.IsSubDomain(z, name) && len(z) > len(best) {
+			best = z
+		}
+	}
+
+	return best, best != ""
+}
+
+func (s *Server) soa(zone string) *dns.SOA {
+	ns := zone
+	if len(s.ns) > 0 {
+		ns = s.ns[0]
+	}
+
+	mbox := s.hostmaster
+	if mbox == "" {
+		mbox = "hostmaster." + zone
+	}
+
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: zone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: s.ttl},
+		Ns:      ns,
+		Mbox:    formatFQDN(strings.Replace(mbox, "@", ".", 1)),
+		Serial:  uint32(time.Now().Unix()),
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		Minttl:  s.ttl,
+	}
+}
@@ -0,0 +1,150 @@
+package dnsserver
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/arthurweinmann/go-https-hug/pkg/logging"
+	"github.com/arthurweinmann/go-https-hug/pkg/storage/stores/memory"
+	"github.com/go-acme/lego/v4/challenge/dns01"
+	"github.com/miekg/dns"
+)
+
+func startServer(t *testing.T, config *Config) (*Provider, string) {
+	t.Helper()
+
+	// do not follow CNAMEs through the system resolver when computing challenge records
+	t.Setenv("LEGO_DISABLE_CNAME_SUPPORT", "true")
+
+	store := memory.NewStore()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	config.LogLevel = logging.NONE
+	s, err := NewServer(ctx, store, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		pc.Close()
+		t.Fatal(err)
+	}
+
+	go s.Serve(pc, ln)
+
+	return NewProvider(store), pc.LocalAddr().String()
+}
+
+func query(t *testing.T, network, addr, name string, qtype uint16) *dns.Msg {
+	t.Helper()
+
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), qtype)
+
+	c := &dns.Client{Net: network, Timeout: 2 * time.Second}
+
+	var r *dns.Msg
+	var err error
+	// the listeners may not be serving yet
+	for i := 0; i < 20; i++ {
+		r, _, err = c.Exchange(m, addr)
+		if err == nil {
+			return r
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("query %s %s: %v", name, dns.TypeToString[qtype], err)
+	return nil
+}
+
+func TestServeChallenge(t *testing.T) {
+	p, addr := startServer(t, &Config{})
+
+	err := p.Present("example.com", "token", "keyauth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := dns01.GetChallengeInfo("example.com", "keyauth")
+
+	for _, n := range []string{"udp", "tcp"} {
+		r := query(t, n, addr, "_acme-challenge.EXAMPLE.com", dns.TypeTXT)
+		if r.Rcode != dns.RcodeSuccess || !r.Authoritative || len(r.Answer) != 1 {
+			t.Fatalf("%s: unexpected answer %v", n, r)
+		}
+		if txt := r.Answer[0].(*dns.TXT).Txt[0]; txt != info.Value {
+			t.Fatalf("%s: got TXT %q, expected %q", n, txt, info.Value)
+		}
+	}
+
+	// a wildcard certificate presents a second value under the same name
+	err = p.Present("example.com", "token2", "keyauth2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := query(t, "udp", addr, "_acme-challenge.example.com", dns.TypeTXT)
+	if len(r.Answer) != 2 {
+		t.Fatalf("expected 2 TXT records, got %v", r.Answer)
+	}
+
+	err = p.CleanUp("example.com", "token", "keyauth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = p.CleanUp("example.com", "token2", "keyauth2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r = query(t, "udp", addr, "_acme-challenge.example.com", dns.TypeTXT)
+	if r.Rcode != dns.RcodeNameError {
+		t.Fatalf("expected NXDOMAIN after cleanup, got %v", r)
+	}
+}
+
+func TestResolverLookup(t *testing.T) {
+	p, addr := startServer(t, &Config{Zones: []string{"acme.example.net"}})
+
+	err := p.Present("customer.acme.example.net", "token", "keyauth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := dns01.GetChallengeInfo("customer.acme.example.net", "keyauth")
+
+	// make sure the server is up
+	query(t, "udp", addr, "acme.example.net", dns.TypeSOA)
+
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			d := net.Dialer{}
+			return d.DialContext(ctx, network, addr)
+		},
+	}
+
+	records, err := resolver.LookupTXT(context.Background(), info.FQDN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0] != info.Value {
+		t.Fatalf("got TXT %v, expected %q", records, info.Value)
+	}
+
+	r := query(t, "udp", addr, "acme.example.net", dns.TypeNS)
+	if len(r.Answer) != 1 || r.Answer[0].(*dns.NS).Ns != "ns.acme.example.net." {
+		t.Fatalf("unexpected NS answer %v", r.Answer)
+	}
+
+	r = query(t, "udp", addr, "_acme-challenge.example.org", dns.TypeTXT)
+	if r.Rcode != dns.RcodeRefused {
+		t.Fatalf("expected REFUSED outside of our zones, got %v", r)
+	}
+}
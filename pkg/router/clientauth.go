@@ -0,0 +1,213 @@
+package router
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/arthurweinmann/go-https-hug/internal/utils"
+	"github.com/arthurweinmann/go-https-hug/pkg/acme"
+)
+
+// ClientAuthPolicy makes the domains it is set on authenticate clients with TLS client certificates
+type ClientAuthPolicy struct {
+	// ClientCAs are the certificate authorities client certificates must chain to
+	ClientCAs *x509.CertPool
+
+	// If true, connections without a client certificate are rejected during the handshake.
+	// Otherwise a client certificate is optional, but verified when one is presented.
+	Required bool
+
+	// If not empty, the subject common name of the client certificate must be one of these
+	AllowedCommonNames []string
+	// If not empty, one of the DNS names of the client certificate must be one of these,
+	// which may be wildcards such as *.internal.example.com
+	AllowedDNSNames []string
+	// If not empty, one of the email addresses of the client certificate must be one of these
+	AllowedEmailAddresses []string
+	// If not empty, one of the URIs of the client certificate must be one of these, for example SPIFFE IDs
+	AllowedURIs []string
+
+	// Verify, if not nil, is called last with the verified client certificate and may reject it
+	Verify func(cert *x509.Certificate) error
+}
+
+func (p *ClientAuthPolicy) clientAuthType() tls.ClientAuthType {
+	if p.Required {
+		return tls.RequireAndVerifyClientCert
+	}
+	return tls.VerifyClientCertIfGiven
+}
+
+// verifyIdentity checks the rules of p against a client certificate already verified against ClientCAs
+func (p *ClientAuthPolicy) verifyIdentity(cert *x509.Certificate) error {
+	if len(p.AllowedCommonNames) > 0 && !slices.Contains(p.AllowedCommonNames, cert.Subject.CommonName) {
+		return fmt.Errorf("client certificate common name %q is not allowed", cert.Subject.CommonName)
+	}
+
+	if len(p.AllowedDNSNames) > 0 {
+		allowed := slices.ContainsFunc(cert.DNSNames, func(name string) bool {
+			return slices.ContainsFunc(p.AllowedDNSNames, func(pattern string) bool {
+				return utils.MatchCertificateDomain(pattern, name)
+			})
+		})
+		if !allowed {
+			return fmt.Errorf("client certificate DNS names %v are not allowed", cert.DNSNames)
+		}
+	}
+
+	if len(p.AllowedEmailAddresses) > 0 {
+		allowed := slices.ContainsFunc(cert.EmailAddresses, func(email string) bool {
+			return slices.ContainsFunc(p.AllowedEmailAddresses, func(a string) bool {
+				return strings.EqualFold(a, email)
+			})
+		})
+		if !allowed {
+			return fmt.Errorf("client certificate email addresses %v are not allowed", cert.EmailAddresses)
+		}
+	}
+
+	if len(p.AllowedURIs) > 0 {
+		var uris []string
+		for _, u := range cert.URIs {
+			uris = append(uris, u.String())
+		}
+		allowed := slices.ContainsFunc(uris, func(u string) bool {
+			return slices.Contains(p.AllowedURIs, u)
+		})
+		if !allowed {
+			return fmt.Errorf("client certificate URIs %v are not allowed", uris)
+		}
+	}
+
+	if p.Verify != nil {
+		return p.Verify(cert)
+	}
+
+	return nil
+}
+
+// clientAuthFor returns the client auth policy of domain, an exact match taking precedence over wildcards
+func (s *Router) clientAuthFor(domain string) *ClientAuthPolicy {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+
+	if p, ok := s.clientAuth[domain]; ok {
+		return p
+	}
+
+	for pattern, p := range s.clientAuth {
+		if strings.HasPrefix(pattern, "*.") && utils.MatchCertificateDomain(pattern, domain) {
+			return p
+		}
+	}
+
+	return nil
+}
+
+// clientAuthConfigs wraps the GetConfigForClient of base, if any, to apply the client auth policy of the SNI
+// on top of the tls.Config it returns. The tls.Config of every combination is derived once and reused.
+func (s *Router) clientAuthConfigs(base *tls.Config) {
+	if len(s.clientAuth) == 0 {
+		return
+	}
+
+	type key struct {
+		inner *tls.Config
+		p     *ClientAuthPolicy
+	}
+	var mu sync.Mutex
+	configs := map[key]*tls.Config{}
+
+	next := base.GetConfigForClient
+
+	base.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		var inner *tls.Config
+		if next != nil {
+			var err error
+			inner, err = next(hello)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		// the CA does not present client certificates when validating tls-alpn-01 challenges
+		if acme.IsTLSALPNChallengeHello(hello) {
+			return inner, nil
+		}
+
+		p := s.clientAuthFor(hello.ServerName)
+		if p == nil {
+			return inner, nil
+		}
+
+		if inner == nil {
+			inner = base
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		c, ok := configs[key{inner, p}]
+		if !ok {
+			c = inner.Clone()
+			c.GetConfigForClient = nil
+			c.ClientAuth = p.clientAuthType()
+			c.ClientCAs = p.ClientCAs
+			c.VerifyConnection = func(cs tls.ConnectionState) error {
+				if len(cs.VerifiedChains) == 0 {
+					return nil
+				}
+				return p.verifyIdentity(cs.VerifiedChains[0][0])
+			}
+			// a session resumed from a ticket issued under another policy would skip our verification
+			c.SessionTicketsDisabled = true
+
+			configs[key{inner, p}] = c
+		}
+
+		return c, nil
+	}
+}
+
+// checkClientAuth makes sure the client auth policy of the Host of req was applied to its connection,
+// so that a client may not handshake with the SNI of an open domain and then request one requiring
+// a client certificate. It sends an error and returns false otherwise.
+func (s *Router) checkClientAuth(w http.ResponseWriter, req *http.Request, domain string) bool {
+	p := s.clientAuthFor(domain)
+	if p == nil {
+		return true
+	}
+
+	if req.TLS == nil {
+		if p.Required {
+			s.sendError(w, "this domain requires a client certificate, please use https", "clientCertificateRequired", 403)
+			return false
+		}
+		return true
+	}
+
+	if s.clientAuthFor(req.TLS.ServerName) != p {
+		s.sendError(w, "the server name of this connection does not match the requested domain", "misdirectedRequest", http.StatusMisdirectedRequest)
+		return false
+	}
+
+	if p.Required && len(req.TLS.VerifiedChains) == 0 {
+		s.sendError(w, "this domain requires a client certificate", "clientCertificateRequired", 403)
+		return false
+	}
+
+	return true
+}
+
+// ClientCertificate returns the client certificate of req verified against the ClientAuthPolicy of its domain,
+// or nil if the client did not present one or the domain has no such policy
+func ClientCertificate(req *http.Request) *x509.Certificate {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 || len(req.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return req.TLS.VerifiedChains[0][0]
+}
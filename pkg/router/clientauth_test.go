@@ -0,0 +1,171 @@
+package router
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/arthurweinmann/go-https-hug/pkg/acme"
+)
+
+func issue(t *testing.T, template *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cert, key
+}
+
+func TestClientAuth(t *testing.T) {
+	ca, caKey := issue(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "test CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+
+	serverCert, serverKey := issue(t, &x509.Certificate{
+		DNSNames:    []string{"admin.test", "public.test"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca, caKey)
+
+	clientCert := func(cn string) tls.Certificate {
+		cert, key := issue(t, &x509.Certificate{
+			Subject:     pkix.Name{CommonName: cn},
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}, ca, caKey)
+		return tls.Certificate{Certificate: [][]byte{cert.Raw}, PrivateKey: key, Leaf: cert}
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+
+	identity := func(ctx context.Context, r *Router, spath []string, w http.ResponseWriter, req *http.Request, domain string) bool {
+		cn := "anonymous"
+		if cert := ClientCertificate(req); cert != nil {
+			cn = cert.Subject.CommonName
+		}
+		w.Write([]byte(cn))
+		return false
+	}
+
+	r, err := NewRouter(context.Background(), &RouterConfig{
+		AllowOrigins: []string{"*"},
+		ClientAuth: map[string]*ClientAuthPolicy{
+			"admin.test": {ClientCAs: pool, Required: true, AllowedCommonNames: []string{"alice"}},
+		},
+		PerDomainHijack: map[string][]func(ctx context.Context, r *Router, spath []string, w http.ResponseWriter, req *http.Request, domain string) bool{
+			"admin.test":  {identity},
+			"public.test": {identity},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := httptest.NewUnstartedServer(r)
+	ts.TLS = &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{serverCert.Raw}, PrivateKey: serverKey}},
+	}
+	r.clientAuthConfigs(ts.TLS)
+	ts.StartTLS()
+	defer ts.Close()
+
+	get := func(servername, host string, certs ...tls.Certificate) (int, string, error) {
+		client := &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+					return (&net.Dialer{}).DialContext(ctx, network, ts.Listener.Addr().String())
+				},
+				TLSClientConfig: &tls.Config{RootCAs: pool, ServerName: servername, Certificates: certs},
+			},
+		}
+		defer client.CloseIdleConnections()
+
+		resp, err := client.Get("https://" + host + "/")
+		if err != nil {
+			return 0, "", err
+		}
+		defer resp.Body.Close()
+
+		b, err := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(b), err
+	}
+
+	code, body, err := get("admin.test", "admin.test", clientCert("alice"))
+	if err != nil || code != 200 || body != "alice" {
+		t.Fatalf("expected alice to be authenticated, got %d %q %v", code, body, err)
+	}
+
+	_, _, err = get("admin.test", "admin.test")
+	if err == nil {
+		t.Fatalf("expected the handshake to fail without a client certificate")
+	}
+
+	_, _, err = get("admin.test", "admin.test", clientCert("bob"))
+	if err == nil {
+		t.Fatalf("expected the handshake to fail with a client certificate which is not allowed")
+	}
+
+	// only the CA validating a tls-alpn-01 challenge skips client authentication, it offers no other protocol
+	conn, err := tls.Dial("tcp", ts.Listener.Addr().String(), &tls.Config{
+		RootCAs:    pool,
+		ServerName: "admin.test",
+		NextProtos: []string{"h2", "http/1.1", acme.ACME_TLS_ALPN_PROTOCOL},
+	})
+	if err == nil {
+		// with TLS 1.3, the server rejects the missing certificate after the client completed its handshake
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		req, _ := http.NewRequest("GET", "https://admin.test/", nil)
+		if err = req.Write(conn); err == nil {
+			_, err = http.ReadResponse(bufio.NewReader(conn), req)
+		}
+		conn.Close()
+	}
+	if err == nil {
+		t.Fatalf("expected the handshake to fail without a client certificate when acme-tls/1 is one of the protocols")
+	}
+
+	code, body, err = get("public.test", "public.test")
+	if err != nil || code != 200 || body != "anonymous" {
+		t.Fatalf("expected public.test to be open, got %d %q %v", code, body, err)
+	}
+
+	code, _, err = get("public.test", "admin.test")
+	if err != nil || code != http.StatusMisdirectedRequest {
+		t.Fatalf("expected a misdirected request when the SNI is an open domain, got %d %v", code, err)
+	}
+}
@@ -19,6 +19,8 @@ import (
 	"github.com/arthurweinmann/go-https-hug/internal/utils"
 	"github.com/arthurweinmann/go-https-hug/pkg/acme"
 	"github.com/arthurweinmann/go-https-hug/pkg/logging"
+	"github.com/arthurweinmann/go-https-hug/pkg/tlspolicy"
+	"github.com/quic-go/quic-go/http3"
 )
 
 type Router struct {
@@ -43,6 +45,8 @@ type Router struct {
 	sendError func(w http.ResponseWriter, message string, code string, statusCode int)
 
 	ignoreNotWorldReadable bool
+	clientAuth             map[string]*ClientAuthPolicy
+	tlsPolicies            *tlspolicy.Policies
 
 	listenAddrs       []*RouterConfigAddr
 	readHeaderTimeout time.Duration
@@ -84,6 +88,17 @@ type RouterConfig struct {
 	// so even if you accidentally copy a sensitive file into the web root, it's unlikely to be served.
 	IgnoreNotWorldReadable bool
 
+	// ClientAuth maps domain names, which may be wildcards such as *.internal.example.com, to the policy
+	// authenticating their clients with TLS client certificates. Other domains do not request any.
+	// Handlers may retrieve the verified client certificate with ClientCertificate.
+	ClientAuth map[string]*ClientAuthPolicy
+
+	// TLSPolicy sets the TLS versions, cipher suites, curves, ALPN protocols and session tickets of the HTTPS listeners,
+	// for example tlspolicy.Intermediate(). The Go defaults are used if nil.
+	TLSPolicy *tlspolicy.Policy
+	// TLSPolicies overrides TLSPolicy for some domains, which may be wildcards such as *.example.com
+	TLSPolicies map[string]*tlspolicy.Policy
+
 	ListenAddrs       []*RouterConfigAddr
 	ReadHeaderTimeout time.Duration
 	ReadTimeout       time.Duration
@@ -96,6 +111,11 @@ type RouterConfig struct {
 type RouterConfigAddr struct {
 	Addr    string
 	IsHTTPS bool
+
+	// IsHTTP3 listens for HTTP/3 over QUIC on the UDP port of Addr, with the same certificates as HTTPS.
+	// It is usually set on a second addr with the same port as an IsHTTPS one. The IsHTTPS addrs advertise
+	// the IsHTTP3 ones reachable on their host with an Alt-Svc header. QUIC requires TLS 1.3, so TLS policies must allow it.
+	IsHTTP3 bool
 }
 
 func NewRouter(ctx context.Context, config *RouterConfig) (*Router, error) {
@@ -131,6 +151,13 @@ func NewRouter(ctx context.Context, config *RouterConfig) (*Router, error) {
 		idleTimeout:            config.IdleTimeout,
 		allowSSLOnDomains:      config.AllowSSLOnDomains,
 		doNoRedirectToHTTPS:    map[string]bool{},
+		clientAuth:             map[string]*ClientAuthPolicy{},
+		tlsPolicies:            &tlspolicy.Policies{Default: config.TLSPolicy, Domains: config.TLSPolicies},
+	}
+
+	err := r.tlsPolicies.Validate()
+	if err != nil {
+		return nil, err
 	}
 
 	if config.LogLevel != logging.NONE {
@@ -141,6 +168,25 @@ func NewRouter(ctx context.Context, config *RouterConfig) (*Router, error) {
 		r.logger = slog.New(slog.NewJSONHandler(io.Discard, nil))
 	}
 
+	for _, laddr := range config.ListenAddrs {
+		if laddr.IsHTTP3 && laddr.IsHTTPS {
+			return nil, fmt.Errorf("the listen addr %s may not be both IsHTTPS and IsHTTP3, use two addrs", laddr.Addr)
+		}
+		if laddr.IsHTTP3 || laddr.IsHTTPS {
+			_, _, err := net.SplitHostPort(laddr.Addr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid listen addr %s: %v", laddr.Addr, err)
+			}
+		}
+	}
+
+	for domain, p := range config.ClientAuth {
+		if p == nil || p.ClientCAs == nil {
+			return nil, fmt.Errorf("the client auth policy of %s needs ClientCAs", domain)
+		}
+		r.clientAuth[strings.ToLower(strings.TrimSuffix(domain, "."))] = p
+	}
+
 	for _, dnr := range config.DoNoRedirectToHTTPS {
 		r.doNoRedirectToHTTPS[dnr] = true
 	}
@@ -161,12 +207,56 @@ func NewRouter(ctx context.Context, config *RouterConfig) (*Router, error) {
 }
 
 func (s *Router) ListenAndServe() error {
+	getCertificate := acme.GetCertificate
+	if len(s.allowSSLOnDomains) > 0 {
+		whitelist, err := acme.NewWhiteListedGetCertificate(s.allowSSLOnDomains)
+		if err != nil {
+			return err
+		}
+		getCertificate = whitelist.GetCertificate
+	}
+
+	return s.listenAndServe(getCertificate)
+}
+
+// listenAndServe serves the listen addrs of the Router, with the certificates of getCertificate on HTTPS and HTTP/3 ones
+func (s *Router) listenAndServe(getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)) error {
 	var servers []*http.Server
+	var h3servers []*http3.Server
 	cherr := make(chan error, len(s.listenAddrs))
 	for _, laddr := range s.listenAddrs {
+		if laddr.IsHTTP3 {
+			tlsConfig := s.tlsConfig(getCertificate)
+
+			h3 := &http3.Server{
+				Addr:        laddr.Addr,
+				Handler:     s,
+				TLSConfig:   http3.ConfigureTLSConfig(tlsConfig),
+				IdleTimeout: s.idleTimeout,
+			}
+			h3servers = append(h3servers, h3)
+
+			go func(h3 *http3.Server) {
+				s.logger.Info("Listening", slog.String("addr", h3.Addr), slog.String("isHTTP3", "true"))
+				err := h3.ListenAndServe()
+				s.logger.Info("Closing Listener", slog.String("addr", h3.Addr))
+				if err != http.ErrServerClosed {
+					cherr <- err
+					return
+				}
+			}(h3)
+
+			continue
+		}
+
+		var handler http.Handler = s
+		if laddr.IsHTTPS {
+			handler = withAltSvc(s, s.altSvc(laddr.Addr))
+		}
+
 		servHTTP := &http.Server{
 			Addr:    laddr.Addr,
-			Handler: s,
+			Handler: handler,
 
 			ReadHeaderTimeout: s.readHeaderTimeout,
 			ReadTimeout:       s.readTimeout,
@@ -175,20 +265,7 @@ func (s *Router) ListenAndServe() error {
 		}
 		servers = append(servers, servHTTP)
 		if laddr.IsHTTPS {
-			var tlsConfig *tls.Config
-			if len(s.allowSSLOnDomains) == 0 {
-				tlsConfig = &tls.Config{
-					GetCertificate: acme.GetCertificate,
-				}
-			} else {
-				whitelist, err := acme.NewWhiteListedGetCertificate(s.allowSSLOnDomains)
-				if err != nil {
-					return err
-				}
-				tlsConfig = &tls.Config{
-					GetCertificate: whitelist.GetCertificate,
-				}
-			}
+			tlsConfig := s.tlsConfig(getCertificate)
 
 			ln, err := net.Listen("tcp", laddr.Addr)
 			if err != nil {
@@ -234,10 +311,75 @@ func (s *Router) ListenAndServe() error {
 	for _, serv := range servers {
 		serv.Shutdown(ctx)
 	}
+	for _, h3 := range h3servers {
+		h3.Shutdown(ctx)
+	}
 
 	return err
 }
 
+// altSvc returns the Alt-Svc header value of the HTTPS listener on addr, advertising the HTTP/3 listeners
+// on the same host, the one on the same port first, or "" if there are none
+func (s *Router) altSvc(addr string) string {
+	host, port, _ := net.SplitHostPort(addr)
+
+	var services []string
+	for _, laddr := range s.listenAddrs {
+		if !laddr.IsHTTP3 {
+			continue
+		}
+
+		h3host, h3port, _ := net.SplitHostPort(laddr.Addr)
+		if !strings.EqualFold(h3host, host) && !isUnspecifiedHost(h3host) {
+			continue
+		}
+
+		service := fmt.Sprintf(`h3=":%s"; ma=2592000`, h3port)
+		if h3port == port {
+			services = append([]string{service}, services...)
+		} else {
+			services = append(services, service)
+		}
+	}
+
+	return strings.Join(services, ", ")
+}
+
+func isUnspecifiedHost(host string) bool {
+	if host == "" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsUnspecified()
+}
+
+// withAltSvc lets browsers know they may upgrade to HTTP/3
+func withAltSvc(h http.Handler, altSvc string) http.Handler {
+	if altSvc == "" {
+		return h
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor < 3 {
+			w.Header().Set("Alt-Svc", altSvc)
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// tlsConfig returns the tls.Config of HTTPS and HTTP/3 listeners, with the certificates of getCertificate, the TLS policies and the client auth policies
+func (s *Router) tlsConfig(getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)) *tls.Config {
+	tlsConfig := &tls.Config{
+		GetCertificate: getCertificate,
+		NextProtos:     []string{"http/1.1", acme.ACME_TLS_ALPN_PROTOCOL},
+	}
+
+	s.tlsPolicies.Config(tlsConfig)
+	s.clientAuthConfigs(tlsConfig)
+
+	return tlsConfig
+}
+
 func (s *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	s.logger.Info("Serving request", slog.String("host", r.Host), slog.String("path", r.URL.Path))
 
@@ -248,6 +390,11 @@ func (s *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		r.URL.Path = "/" + r.URL.Path
 	}
 
+	if strings.HasPrefix(r.URL.Path, acme.ACME_PEER_CHALLENGE_URL_PREFIX) {
+		acme.ServePeerChallenge(w, r)
+		return
+	}
+
 	if strings.HasPrefix(r.URL.Path, acme.ACME_CHALLENGE_URL_PREFIX) && len(r.URL.Path) > len(acme.ACME_CHALLENGE_URL_PREFIX) {
 		keyauth, err := acme.GetChallenge(stripedhost, r.URL.Path[len(acme.ACME_CHALLENGE_URL_PREFIX):])
 		if err != nil {
@@ -276,6 +423,10 @@ func (s *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	if !s.checkClientAuth(w, r, stripedhost) {
+		return
+	}
+
 	origin := r.Header.Get("Origin")
 	if origin == "" {
 		if !s.allowAnyOrigin {
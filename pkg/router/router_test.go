@@ -0,0 +1,148 @@
+package router
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// freePort returns a port which was free on host, for TCP and UDP listeners
+func freePort(t *testing.T, host string) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", host+":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	return strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+}
+
+func TestHTTP3(t *testing.T) {
+	ca, caKey := issue(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "test CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+
+	serverCert, serverKey := issue(t, &x509.Certificate{
+		DNSNames:    []string{"example.test"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca, caKey)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+
+	// HTTPS and HTTP/3 on the same port, HTTPS alone on another port of the same host and on another host
+	h3Port := freePort(t, "127.0.0.1")
+	otherPort := freePort(t, "127.0.0.1")
+	otherHostPort := freePort(t, "127.0.0.2")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	r, err := NewRouter(ctx, &RouterConfig{
+		AllowOrigins: []string{"*"},
+		ListenAddrs: []*RouterConfigAddr{
+			{Addr: "127.0.0.1:" + h3Port, IsHTTPS: true},
+			{Addr: "127.0.0.1:" + h3Port, IsHTTP3: true},
+			{Addr: "127.0.0.1:" + otherPort, IsHTTPS: true},
+			{Addr: "127.0.0.2:" + otherHostPort, IsHTTPS: true},
+		},
+		PerDomainHijack: map[string][]func(ctx context.Context, r *Router, spath []string, w http.ResponseWriter, req *http.Request, domain string) bool{
+			"example.test": {func(ctx context.Context, r *Router, spath []string, w http.ResponseWriter, req *http.Request, domain string) bool {
+				w.Write([]byte(req.Proto))
+				return false
+			}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert := &tls.Certificate{Certificate: [][]byte{serverCert.Raw}, PrivateKey: serverKey}
+	getCertificate := func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		return cert, nil
+	}
+
+	served := make(chan error, 1)
+	go func() { served <- r.listenAndServe(getCertificate) }()
+	defer func() {
+		cancel()
+		if err := <-served; err != nil {
+			t.Error(err)
+		}
+	}()
+
+	get := func(rt http.RoundTripper, addr string) *http.Response {
+		t.Helper()
+
+		req, err := http.NewRequest("GET", "https://"+addr+"/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Host = "example.test"
+
+		var resp *http.Response
+		for i := 0; ; i++ {
+			resp, err = rt.RoundTrip(req)
+			if err == nil {
+				break
+			}
+			// the listeners may not be up yet
+			if i == 50 {
+				t.Fatal(err)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		defer resp.Body.Close()
+
+		b, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "HTTP/" + strconv.Itoa(resp.ProtoMajor) + "." + strconv.Itoa(resp.ProtoMinor); string(b) != want {
+			t.Fatalf("unexpected protocol %q, expected %q", b, want)
+		}
+
+		return resp
+	}
+
+	tr := &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool, ServerName: "example.test"}}
+	defer tr.CloseIdleConnections()
+
+	// HTTPS responses advertise the HTTP/3 listeners of their host
+	for addr, expected := range map[string]string{
+		"127.0.0.1:" + h3Port:        `h3=":` + h3Port + `"; ma=2592000`,
+		"127.0.0.1:" + otherPort:     `h3=":` + h3Port + `"; ma=2592000`,
+		"127.0.0.2:" + otherHostPort: "",
+	} {
+		resp := get(tr, addr)
+		if altsvc := resp.Header.Get("Alt-Svc"); altsvc != expected {
+			t.Fatalf("unexpected Alt-Svc header %q from %s, expected %q", altsvc, addr, expected)
+		}
+	}
+
+	// and the Router serves HTTP/3
+	h3 := &http3.Transport{TLSClientConfig: &tls.Config{RootCAs: pool, ServerName: "example.test"}}
+	defer h3.Close()
+
+	resp := get(h3, "127.0.0.1:"+h3Port)
+	if resp.ProtoMajor != 3 {
+		t.Fatalf("unexpected protocol %s", resp.Proto)
+	}
+	if resp.Header.Get("Alt-Svc") != "" {
+		t.Fatalf("HTTP/3 responses should not advertise HTTP/3")
+	}
+}
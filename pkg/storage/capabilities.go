@@ -0,0 +1,56 @@
+package storage
+
+import (
+	"errors"
+	"time"
+)
+
+// The interfaces below are optional capabilities of a Store. Features relying on them,
+// such as the certificates inventory, degrade gracefully when a Store does not implement them.
+// Wrappers of other Stores may implement them and return errors.ErrUnsupported when the wrapped
+// Store does not, which is handled as if they were not implemented.
+
+// Lister is implemented by the stores able to enumerate their keys
+type Lister interface {
+	// ListKV returns the keys starting with prefix, for example certificates/, in no particular order
+	ListKV(prefix string) ([]string, error)
+}
+
+type KeyInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+	// Expiration is when the key expires, zero if it does not
+	Expiration time.Time
+}
+
+// Stater is implemented by the stores able to return metadata about a key without reading its value
+type Stater interface {
+	// StatKV returns ErrNotFound if key does not exist
+	StatKV(key string) (*KeyInfo, error)
+}
+
+// CompareAndSwapper is implemented by the stores able to update a key atomically
+type CompareAndSwapper interface {
+	// CompareAndSwapKV sets key to value only if its current value is old, a nil old meaning that
+	// key must not exist. It returns false, without error, if the current value is different.
+	CompareAndSwapKV(key string, old, value []byte, expiration time.Duration) (bool, error)
+}
+
+// Refresher is implemented by the stores caching the values of another one, such as tiered.Store
+type Refresher interface {
+	// RefreshKV reads key from the Store holding the authoritative values, bypassing and updating the cache.
+	// It is meant for the reads which must not be stale, such as the ones followed by a CompareAndSwapKV.
+	RefreshKV(key string) ([]byte, error)
+}
+
+// GetFresh reads key with RefreshKV if s implements Refresher, with GetKV otherwise
+func GetFresh(s Store, key string) ([]byte, error) {
+	if r, ok := s.(Refresher); ok {
+		b, err := r.RefreshKV(key)
+		if !errors.Is(err, errors.ErrUnsupported) {
+			return b, err
+		}
+	}
+	return s.GetKV(key)
+}
@@ -0,0 +1,650 @@
+// Package storagetest checks that a storage.Store implements the semantics pkg/acme relies on.
+//
+// A custom Store is tested by calling RunConformance from one of its tests:
+//
+//	func TestConformance(t *testing.T) {
+//		storagetest.RunConformance(t, func(t *testing.T) (storage.Store, func(time.Duration)) {
+//			return NewStore(...), nil
+//		})
+//	}
+package storagetest
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/arthurweinmann/go-https-hug/pkg/storage"
+)
+
+// Factory returns a new Store, which must not share its keys and locks with the ones of previous calls.
+// It is called once per subtest, cleanups may be registered on t.
+// wait lets d elapse for the Store, for example to advance a fake clock, time.Sleep is used if it is nil.
+type Factory func(t *testing.T) (s storage.Store, wait func(d time.Duration))
+
+// ttl is the expiration and lease duration of the tests, short but far above the latency of a networked Store
+const ttl = 500 * time.Millisecond
+
+// RunConformance runs the conformance suite as subtests of t. The optional capabilities
+// Lister, Stater, CompareAndSwapper and Refresher are tested if the Store implements them,
+// and does not return errors.ErrUnsupported.
+func RunConformance(t *testing.T, factory Factory) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, s storage.Store, wait func(time.Duration))
+	}{
+		{"NotFound", testNotFound},
+		{"SetGetDelete", testSetGetDelete},
+		{"Keys", testKeys},
+		{"Expiration", testExpiration},
+		{"ConcurrentKV", testConcurrentKV},
+		{"LockExclusive", testLockExclusive},
+		{"LockTimeout", testLockTimeout},
+		{"LockRelease", testLockRelease},
+		{"ConcurrentLocks", testConcurrentLocks},
+		{"Lister", testLister},
+		{"Stater", testStater},
+		{"CompareAndSwap", testCompareAndSwap},
+		{"Refresher", testRefresher},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, wait := factory(t)
+			if wait == nil {
+				wait = time.Sleep
+			}
+			test.fn(t, s, wait)
+		})
+	}
+}
+
+func mustSet(t *testing.T, s storage.Store, key, value string, expiration time.Duration) {
+	t.Helper()
+	err := s.SetKV(key, []byte(value), expiration)
+	if err != nil {
+		t.Fatalf("SetKV %s: %v", key, err)
+	}
+}
+
+func expectValue(t *testing.T, s storage.Store, key, value string) {
+	t.Helper()
+	b, err := s.GetKV(key)
+	if err != nil {
+		t.Fatalf("GetKV %s: %v", key, err)
+	}
+	if string(b) != value {
+		t.Fatalf("GetKV %s: expected %q, got %q", key, value, b)
+	}
+}
+
+func expectNotFound(t *testing.T, s storage.Store, key string) {
+	t.Helper()
+	b, err := s.GetKV(key)
+	if err != storage.ErrNotFound {
+		t.Fatalf("GetKV %s: expected ErrNotFound, got %q %v", key, b, err)
+	}
+}
+
+func testNotFound(t *testing.T, s storage.Store, wait func(time.Duration)) {
+	expectNotFound(t, s, "certificates/example.com")
+
+	err := s.DeleteKV("certificates/example.com")
+	if err != storage.ErrNotFound {
+		t.Fatalf("DeleteKV of a missing key: expected ErrNotFound, got %v", err)
+	}
+}
+
+func testSetGetDelete(t *testing.T, s storage.Store, wait func(time.Duration)) {
+	mustSet(t, s, "certificates/example.com", "cert", 0)
+	expectValue(t, s, "certificates/example.com", "cert")
+
+	mustSet(t, s, "certificates/example.com", "renewed", 0)
+	expectValue(t, s, "certificates/example.com", "renewed")
+
+	// the Store keeps its own copy of the values
+	value := []byte("binary\x00\xff")
+	err := s.SetKV("certificates/example.org", value, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value[0] = 'B'
+	b, err := s.GetKV("certificates/example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, []byte("binary\x00\xff")) {
+		t.Fatalf("expected the value to be unaltered, got %q", b)
+	}
+
+	err = s.DeleteKV("certificates/example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectNotFound(t, s, "certificates/example.com")
+	expectValue(t, s, "certificates/example.org", "binary\x00\xff")
+
+	err = s.DeleteKV("certificates/example.com")
+	if err != storage.ErrNotFound {
+		t.Fatalf("second DeleteKV: expected ErrNotFound, got %v", err)
+	}
+}
+
+// keys are the ones written by pkg/acme and the DNS packages
+var keys = []string{
+	"user/account.json",
+	"certificates/example.com",
+	"certificates/sub.example.com",
+	"challenges/example.com_9y1gGRZnE9Ya-tPs3BDT7A",
+	"challenges/tls-alpn-01/example.com",
+	"challenges/dns/_acme-challenge.example.com.",
+	"acmedns/clients/example.com.json",
+	"acmedns/server/8e5700ea-a4bf-4c59-8bd3-4e4c2a6f4f77.json",
+}
+
+func testKeys(t *testing.T, s storage.Store, wait func(time.Duration)) {
+	for _, k := range keys {
+		mustSet(t, s, k, k, 0)
+	}
+
+	for _, k := range keys {
+		expectValue(t, s, k, k)
+	}
+
+	// a key is not a prefix of another one
+	expectNotFound(t, s, "certificates/example")
+	expectNotFound(t, s, "challenges/tls-alpn-01")
+}
+
+func testExpiration(t *testing.T, s storage.Store, wait func(time.Duration)) {
+	mustSet(t, s, "challenges/expiring", "keyauth", ttl)
+	mustSet(t, s, "challenges/deleted", "keyauth", ttl)
+	mustSet(t, s, "challenges/persisted", "keyauth", ttl)
+	mustSet(t, s, "certificates/example.com", "cert", 0)
+
+	expectValue(t, s, "challenges/expiring", "keyauth")
+
+	// setting a key again replaces its expiration
+	mustSet(t, s, "challenges/persisted", "keyauth", 0)
+
+	wait(2 * ttl)
+
+	expectNotFound(t, s, "challenges/expiring")
+	expectValue(t, s, "challenges/persisted", "keyauth")
+	expectValue(t, s, "certificates/example.com", "cert")
+
+	err := s.DeleteKV("challenges/deleted")
+	if err != storage.ErrNotFound {
+		t.Fatalf("DeleteKV of an expired key: expected ErrNotFound, got %v", err)
+	}
+
+	// an expired key may be set again
+	mustSet(t, s, "challenges/expiring", "again", 0)
+	expectValue(t, s, "challenges/expiring", "again")
+}
+
+func testConcurrentKV(t *testing.T, s storage.Store, wait func(time.Duration)) {
+	const workers, rounds = 8, 10
+
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for i := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			own := "certificates/" + strconv.Itoa(i) + ".example.com"
+			for j := range rounds {
+				value := strconv.Itoa(j)
+
+				err := s.SetKV(own, []byte(value), 0)
+				if err != nil {
+					errs <- err
+					return
+				}
+				b, err := s.GetKV(own)
+				if err != nil || string(b) != value {
+					errs <- fmt.Errorf("GetKV %s: expected %q, got %q %v", own, value, b, err)
+					return
+				}
+
+				// every worker also writes the same key, whose readers must always see one of their values, whole
+				err = s.SetKV("certificates/shared", []byte(own), 0)
+				if err != nil {
+					errs <- err
+					return
+				}
+				b, err = s.GetKV("certificates/shared")
+				if err != nil {
+					errs <- fmt.Errorf("GetKV of a key being written: %v", err)
+					return
+				}
+				if !bytes.HasPrefix(b, []byte("certificates/")) || !bytes.HasSuffix(b, []byte(".example.com")) {
+					errs <- fmt.Errorf("GetKV of a key being written: unexpected value %q", b)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+
+	b, err := s.GetKV("certificates/shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(b, []byte("certificates/")) || !bytes.HasSuffix(b, []byte(".example.com")) {
+		t.Fatalf("unexpected shared value %q", b)
+	}
+}
+
+func testLockExclusive(t *testing.T, s storage.Store, wait func(time.Duration)) {
+	lease, err := s.LockCert("example.com", "a", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lease.Domain != "example.com" || lease.Owner != "a" || lease.Token == 0 || lease.Epoch == "" || !lease.Deadline.After(time.Now()) {
+		t.Fatalf("unexpected lease %+v", lease)
+	}
+
+	_, err = s.LockCert("example.com", "b", time.Minute)
+	if err != storage.ErrLockHeld {
+		t.Fatalf("expected ErrLockHeld for another owner, got %v", err)
+	}
+
+	// locks are not reentrant
+	_, err = s.LockCert("example.com", "a", time.Minute)
+	if err != storage.ErrLockHeld {
+		t.Fatalf("expected ErrLockHeld for the same owner, got %v", err)
+	}
+
+	// the locks of other domains are independent
+	other, err := s.LockCert("example.org", "b", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// keys and locks do not collide
+	expectNotFound(t, s, "example.com")
+	mustSet(t, s, "example.com", "value", 0)
+	_, err = s.LockCert("example.com", "b", time.Minute)
+	if err != storage.ErrLockHeld {
+		t.Fatalf("expected ErrLockHeld after setting a key of the same name, got %v", err)
+	}
+
+	for _, l := range []*storage.Lease{lease, other} {
+		err = s.UnlockCert(l)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func testLockTimeout(t *testing.T, s storage.Store, wait func(time.Duration)) {
+	first, err := s.LockCert("example.com", "a", ttl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	renewed, err := s.LockCert("example.org", "a", ttl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.RenewCertLock(renewed, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Until(renewed.Deadline) < ttl {
+		t.Fatalf("expected RenewCertLock to update the deadline, got %v", renewed.Deadline)
+	}
+
+	wait(2 * ttl)
+
+	// the renewed lease is still held
+	_, err = s.LockCert("example.org", "b", time.Minute)
+	if err != storage.ErrLockHeld {
+		t.Fatalf("expected ErrLockHeld on a renewed lease, got %v", err)
+	}
+
+	second, err := s.LockCert("example.com", "b", time.Minute)
+	if err != nil {
+		t.Fatalf("expected the expired lease to be taken over, got %v", err)
+	}
+	if second.Token <= first.Token {
+		t.Fatalf("fencing tokens must increase, got %d then %d", first.Token, second.Token)
+	}
+	if second.Epoch != first.Epoch {
+		t.Fatalf("the epoch of a lock must not change, got %q then %q", first.Epoch, second.Epoch)
+	}
+
+	// the expired holder may not touch the lease of the new one
+	err = s.RenewCertLock(first, time.Minute)
+	if err != storage.ErrLeaseLost {
+		t.Fatalf("RenewCertLock of a lost lease: expected ErrLeaseLost, got %v", err)
+	}
+	err = s.UnlockCert(first)
+	if err != storage.ErrLeaseLost {
+		t.Fatalf("UnlockCert of a lost lease: expected ErrLeaseLost, got %v", err)
+	}
+	_, err = s.LockCert("example.com", "a", time.Minute)
+	if err != storage.ErrLockHeld {
+		t.Fatalf("expected the new holder to keep the lock, got %v", err)
+	}
+
+	err = s.UnlockCert(second)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testLockRelease(t *testing.T, s storage.Store, wait func(time.Duration)) {
+	first, err := s.LockCert("example.com", "a", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.UnlockCert(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.UnlockCert(first)
+	if err != storage.ErrLeaseLost {
+		t.Fatalf("second UnlockCert: expected ErrLeaseLost, got %v", err)
+	}
+	err = s.RenewCertLock(first, time.Minute)
+	if err != storage.ErrLeaseLost {
+		t.Fatalf("RenewCertLock of a released lease: expected ErrLeaseLost, got %v", err)
+	}
+
+	second, err := s.LockCert("example.com", "b", time.Minute)
+	if err != nil {
+		t.Fatalf("expected the lock to be free, got %v", err)
+	}
+	if second.Token <= first.Token {
+		t.Fatalf("fencing tokens must increase after a release, got %d then %d", first.Token, second.Token)
+	}
+
+	// a lease with the right owner but a stale token does not hold the lock
+	stale := *second
+	stale.Token = first.Token
+	err = s.UnlockCert(&stale)
+	if err != storage.ErrLeaseLost {
+		t.Fatalf("UnlockCert with a stale token: expected ErrLeaseLost, got %v", err)
+	}
+
+	err = s.UnlockCert(second)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testConcurrentLocks(t *testing.T, s storage.Store, wait func(time.Duration)) {
+	const workers, rounds = 8, 5
+
+	// every worker increments a counter under the lock, an increment is lost if two of them hold it at once
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for i := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			owner := "owner-" + strconv.Itoa(i)
+			var lastToken uint64
+			for range rounds {
+				var lease *storage.Lease
+				for {
+					var err error
+					lease, err = s.LockCert("example.com", owner, time.Minute)
+					if err == nil {
+						break
+					}
+					if err != storage.ErrLockHeld {
+						errs <- err
+						return
+					}
+					time.Sleep(time.Millisecond)
+				}
+
+				if lease.Token <= lastToken {
+					errs <- fmt.Errorf("fencing tokens must increase, got %d then %d", lastToken, lease.Token)
+				}
+				lastToken = lease.Token
+
+				var n int
+				b, err := s.GetKV("counter")
+				if err == nil {
+					n, err = strconv.Atoi(string(b))
+				}
+				if err != nil && err != storage.ErrNotFound {
+					errs <- err
+					return
+				}
+
+				err = s.SetKV("counter", []byte(strconv.Itoa(n+1)), 0)
+				if err != nil {
+					errs <- err
+					return
+				}
+
+				err = s.UnlockCert(lease)
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+
+	expectValue(t, s, "counter", strconv.Itoa(workers*rounds))
+}
+
+func testLister(t *testing.T, s storage.Store, wait func(time.Duration)) {
+	l, ok := s.(storage.Lister)
+	if !ok {
+		t.Skip("the Store does not implement storage.Lister")
+	}
+	if _, err := l.ListKV("certificates/"); errors.Is(err, errors.ErrUnsupported) {
+		t.Skip("the Store does not support storage.Lister")
+	}
+
+	for _, k := range keys {
+		mustSet(t, s, k, k, 0)
+	}
+	mustSet(t, s, "certificates/expired.example.com", "cert", ttl)
+
+	list := func(prefix string) []string {
+		t.Helper()
+		ret, err := l.ListKV(prefix)
+		if err != nil {
+			t.Fatalf("ListKV %s: %v", prefix, err)
+		}
+		slices.Sort(ret)
+		return ret
+	}
+
+	expected := []string{"certificates/example.com", "certificates/expired.example.com", "certificates/sub.example.com"}
+	if ret := list("certificates/"); !slices.Equal(ret, expected) {
+		t.Fatalf("ListKV certificates/: expected %v, got %v", expected, ret)
+	}
+
+	// prefixes are not limited to directories
+	expected = []string{"challenges/example.com_9y1gGRZnE9Ya-tPs3BDT7A"}
+	if ret := list("challenges/example."); !slices.Equal(ret, expected) {
+		t.Fatalf("ListKV challenges/example.: expected %v, got %v", expected, ret)
+	}
+
+	if ret := list("missing/"); len(ret) != 0 {
+		t.Fatalf("ListKV missing/: expected no keys, got %v", ret)
+	}
+
+	wait(2 * ttl)
+
+	expected = []string{"certificates/example.com", "certificates/sub.example.com"}
+	if ret := list("certificates/"); !slices.Equal(ret, expected) {
+		t.Fatalf("ListKV certificates/ after an expiration: expected %v, got %v", expected, ret)
+	}
+
+	// the locks are not keys
+	if _, err := s.LockCert("example.com", "owner", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	expected = slices.Sorted(slices.Values(keys))
+	if ret := list(""); !slices.Equal(ret, expected) {
+		t.Fatalf("ListKV with an empty prefix: expected %v, got %v", expected, ret)
+	}
+}
+
+func testStater(t *testing.T, s storage.Store, wait func(time.Duration)) {
+	st, ok := s.(storage.Stater)
+	if !ok {
+		t.Skip("the Store does not implement storage.Stater")
+	}
+
+	_, err := st.StatKV("certificates/example.com")
+	if errors.Is(err, errors.ErrUnsupported) {
+		t.Skip("the Store does not support storage.Stater")
+	}
+	if err != storage.ErrNotFound {
+		t.Fatalf("StatKV of a missing key: expected ErrNotFound, got %v", err)
+	}
+
+	before := time.Now().Add(-time.Second)
+	mustSet(t, s, "certificates/example.com", "cert", 0)
+	mustSet(t, s, "challenges/example.com_token", "keyauth", ttl)
+
+	info, err := st.StatKV("certificates/example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Key != "certificates/example.com" || info.Size != 4 || !info.Expiration.IsZero() || info.ModTime.Before(before) {
+		t.Fatalf("unexpected key info %+v", info)
+	}
+
+	info, err = st.StatKV("challenges/example.com_token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != 7 || info.Expiration.Before(time.Now()) || info.Expiration.After(time.Now().Add(2*ttl)) {
+		t.Fatalf("unexpected key info %+v", info)
+	}
+
+	wait(2 * ttl)
+
+	_, err = st.StatKV("challenges/example.com_token")
+	if err != storage.ErrNotFound {
+		t.Fatalf("StatKV of an expired key: expected ErrNotFound, got %v", err)
+	}
+}
+
+func testCompareAndSwap(t *testing.T, s storage.Store, wait func(time.Duration)) {
+	c, ok := s.(storage.CompareAndSwapper)
+	if !ok {
+		t.Skip("the Store does not implement storage.CompareAndSwapper")
+	}
+	if _, err := c.CompareAndSwapKV("certificates/example.com", []byte("cert"), []byte("created"), 0); errors.Is(err, errors.ErrUnsupported) {
+		t.Skip("the Store does not support storage.CompareAndSwapper")
+	}
+
+	swap := func(key string, old []byte, value string, expected bool) {
+		t.Helper()
+		swapped, err := c.CompareAndSwapKV(key, old, []byte(value), 0)
+		if err != nil {
+			t.Fatalf("CompareAndSwapKV %s: %v", key, err)
+		}
+		if swapped != expected {
+			t.Fatalf("CompareAndSwapKV %s %q -> %q: expected %v, got %v", key, old, value, expected, swapped)
+		}
+	}
+
+	swap("certificates/example.com", []byte("cert"), "created", false)
+	expectNotFound(t, s, "certificates/example.com")
+
+	swap("certificates/example.com", nil, "cert", true)
+	expectValue(t, s, "certificates/example.com", "cert")
+
+	swap("certificates/example.com", nil, "again", false)
+	swap("certificates/example.com", []byte("stale"), "renewed", false)
+	expectValue(t, s, "certificates/example.com", "cert")
+
+	swap("certificates/example.com", []byte("cert"), "renewed", true)
+	expectValue(t, s, "certificates/example.com", "renewed")
+
+	// concurrent swaps from the same value: exactly one wins
+	const workers = 8
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	won := 0
+	for i := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			swapped, err := c.CompareAndSwapKV("certificates/example.com", []byte("renewed"), []byte(strconv.Itoa(i)), 0)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if swapped {
+				mu.Lock()
+				won++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if won != 1 {
+		t.Fatalf("expected exactly one concurrent swap to succeed, got %d", won)
+	}
+}
+
+func testRefresher(t *testing.T, s storage.Store, wait func(time.Duration)) {
+	r, ok := s.(storage.Refresher)
+	if !ok {
+		t.Skip("the Store does not implement storage.Refresher")
+	}
+
+	_, err := r.RefreshKV("certificates/example.com")
+	if errors.Is(err, errors.ErrUnsupported) {
+		t.Skip("the Store does not support storage.Refresher")
+	}
+	if err != storage.ErrNotFound {
+		t.Fatalf("RefreshKV of a missing key: expected ErrNotFound, got %v", err)
+	}
+
+	mustSet(t, s, "certificates/example.com", "cert", 0)
+
+	b, err := r.RefreshKV("certificates/example.com")
+	if err != nil || string(b) != "cert" {
+		t.Fatalf("RefreshKV: expected %q, got %q %v", "cert", b, err)
+	}
+	expectValue(t, s, "certificates/example.com", "cert")
+
+	err = s.DeleteKV("certificates/example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = r.RefreshKV("certificates/example.com")
+	if err != storage.ErrNotFound {
+		t.Fatalf("RefreshKV of a deleted key: expected ErrNotFound, got %v", err)
+	}
+	expectNotFound(t, s, "certificates/example.com")
+}
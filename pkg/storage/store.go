@@ -1,12 +1,21 @@
 package storage
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"time"
 )
 
 var ErrNotFound = errors.New("not found")
 
+// ErrLockHeld is returned by LockCert when another owner holds an unexpired lease on the lock
+var ErrLockHeld = errors.New("lock held by another owner")
+
+// ErrLeaseLost is returned by RenewCertLock and UnlockCert when the lease expired
+// and may since have been acquired by another owner
+var ErrLeaseLost = errors.New("lease lost")
+
 type Store interface {
 	// key may contain / and ., for example user/account.json
 	SetKV(key string, value []byte, expiration time.Duration) error
@@ -15,6 +24,45 @@ type Store interface {
 
 	DeleteKV(key string) error
 
-	LockCert(domain string, timeout time.Duration) (bool, error)
-	UnlockCert(domain string) error
+	// LockCert acquires the lock of domain for owner during ttl, or returns ErrLockHeld if
+	// another lease on it has not expired yet. Locks are not reentrant: the same owner
+	// gets ErrLockHeld as well, so that the goroutines of one process exclude each other.
+	LockCert(domain, owner string, ttl time.Duration) (*Lease, error)
+
+	// RenewCertLock extends lease to ttl from now, or returns ErrLeaseLost if it is not held anymore.
+	// On success, lease.Deadline is updated.
+	RenewCertLock(lease *Lease, ttl time.Duration) error
+
+	// UnlockCert releases lease, or returns ErrLeaseLost if it is not held anymore,
+	// in which case a later holder of the lock is left untouched.
+	UnlockCert(lease *Lease) error
+}
+
+// Lease is a lock held until its Deadline unless it is renewed
+type Lease struct {
+	Domain string
+	Owner  string
+
+	// Token is a fencing token, strictly increasing with every acquisition of the lock of Domain.
+	// Writes made under the lease may carry it so that a holder whose lease expired unknowingly
+	// cannot overwrite the work of a later one.
+	Token uint64
+
+	// Epoch identifies the lock record Token was issued from. Tokens of different epochs are not comparable,
+	// for example after moving to another Store, or when the record of an in-memory Store was lost.
+	Epoch string
+
+	Deadline time.Time
+}
+
+// NewEpoch returns a random Lease.Epoch, for the Stores to give to a lock record when they create it
+func NewEpoch() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Held reports whether the lease matches the current holder of the lock, at now
+func (l *Lease) Held(holder *Lease, now time.Time) bool {
+	return holder != nil && holder.Owner == l.Owner && holder.Token == l.Token && holder.Epoch == l.Epoch && now.Before(holder.Deadline)
 }
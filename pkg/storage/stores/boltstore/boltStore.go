@@ -0,0 +1,500 @@
+// Package boltstore implements a storage.Store on an embedded bbolt database, for single node servers.
+package boltstore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/arthurweinmann/go-https-hug/pkg/storage"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	_ storage.Store             = (*Store)(nil)
+	_ storage.Lister            = (*Store)(nil)
+	_ storage.Stater            = (*Store)(nil)
+	_ storage.CompareAndSwapper = (*Store)(nil)
+)
+
+var (
+	kvBucket          = []byte("kv")
+	expirationsBucket = []byte("expirations")
+	modtimesBucket    = []byte("modtimes")
+	locksBucket       = []byte("locks")
+)
+
+// Store keeps the values in the kv bucket and, under the same keys, their expiration and modification time,
+// in unix nanoseconds, in the expirations and modtimes buckets. Leases are in the locks bucket.
+type Store struct {
+	path   string
+	logger *slog.Logger
+
+	// mu is only held exclusively by Compact, which replaces db
+	mu sync.RWMutex
+	db *bolt.DB
+
+	stop chan struct{}
+}
+
+// lockRecord is the value of the locks bucket. Records are never deleted, so that their Token keeps increasing,
+// a released lease has a zero Deadline.
+type lockRecord struct {
+	Owner    string
+	Token    uint64
+	Epoch    string
+	Deadline time.Time
+}
+
+func (l *lockRecord) lease(domain string) *storage.Lease {
+	return &storage.Lease{Domain: domain, Owner: l.Owner, Token: l.Token, Epoch: l.Epoch, Deadline: l.Deadline}
+}
+
+type Config struct {
+	// Path of the database, created if needed. bbolt locks the file, so only one process may open it.
+	Path string
+
+	// WithGC deletes the expired keys every minute, otherwise they are only ignored by reads
+	WithGC bool
+
+	// Logger receives the errors of the GC, slog.Default() by default
+	Logger *slog.Logger
+}
+
+// NewStore opens or creates the database at config.Path
+func NewStore(config *Config) (*Store, error) {
+	if config.Path == "" {
+		return nil, fmt.Errorf("a database path is required")
+	}
+
+	s := &Store{
+		path:   config.Path,
+		logger: config.Logger,
+		stop:   make(chan struct{}),
+	}
+	if s.logger == nil {
+		s.logger = slog.Default()
+	}
+
+	err := s.open()
+	if err != nil {
+		return nil, err
+	}
+
+	if config.WithGC {
+		go s.gcLoop()
+	}
+
+	return s, nil
+}
+
+func (s *Store) open() error {
+	db, err := bolt.Open(s.path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return fmt.Errorf("could not open %s: %v", s.path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{kvBucket, expirationsBucket, modtimesBucket, locksBucket} {
+			_, err := tx.CreateBucketIfNotExists(b)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return err
+	}
+
+	s.db = db
+
+	return nil
+}
+
+// Close stops the GC and closes the database
+func (s *Store) Close() error {
+	close(s.stop)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.db.Close()
+}
+
+func (s *Store) view(fn func(tx *bolt.Tx) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.db.View(fn)
+}
+
+func (s *Store) update(fn func(tx *bolt.Tx) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.db.Update(fn)
+}
+
+func encodeTime(t time.Time) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(t.UnixNano()))
+	return b
+}
+
+func decodeTime(b []byte) time.Time {
+	if len(b) != 8 {
+		return time.Time{}
+	}
+	return time.Unix(0, int64(binary.BigEndian.Uint64(b)))
+}
+
+// live returns the value of key, or nil if it does not exist or expired
+func live(tx *bolt.Tx, key []byte, now time.Time) []byte {
+	v := tx.Bucket(kvBucket).Get(key)
+	if v == nil {
+		return nil
+	}
+
+	if e := tx.Bucket(expirationsBucket).Get(key); e != nil && !now.Before(decodeTime(e)) {
+		return nil
+	}
+
+	return v
+}
+
+func put(tx *bolt.Tx, key, value []byte, expiration time.Duration, now time.Time) error {
+	err := tx.Bucket(kvBucket).Put(key, value)
+	if err != nil {
+		return err
+	}
+
+	if expiration > 0 {
+		err = tx.Bucket(expirationsBucket).Put(key, encodeTime(now.Add(expiration)))
+	} else {
+		err = tx.Bucket(expirationsBucket).Delete(key)
+	}
+	if err != nil {
+		return err
+	}
+
+	return tx.Bucket(modtimesBucket).Put(key, encodeTime(now))
+}
+
+func del(tx *bolt.Tx, key []byte) error {
+	for _, b := range [][]byte{kvBucket, expirationsBucket, modtimesBucket} {
+		err := tx.Bucket(b).Delete(key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Store) SetKV(key string, value []byte, expiration time.Duration) error {
+	return s.update(func(tx *bolt.Tx) error {
+		return put(tx, []byte(key), value, expiration, time.Now())
+	})
+}
+
+func (s *Store) GetKV(key string) ([]byte, error) {
+	var ret []byte
+	err := s.view(func(tx *bolt.Tx) error {
+		v := live(tx, []byte(key), time.Now())
+		if v == nil {
+			return storage.ErrNotFound
+		}
+		// values are only valid during the transaction
+		ret = bytes.Clone(v)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (s *Store) DeleteKV(key string) error {
+	return s.update(func(tx *bolt.Tx) error {
+		found := live(tx, []byte(key), time.Now()) != nil
+
+		err := del(tx, []byte(key))
+		if err != nil {
+			return err
+		}
+
+		if !found {
+			return storage.ErrNotFound
+		}
+		return nil
+	})
+}
+
+func (s *Store) ListKV(prefix string) ([]string, error) {
+	var keys []string
+	err := s.view(func(tx *bolt.Tx) error {
+		now := time.Now()
+		p := []byte(prefix)
+
+		c := tx.Bucket(kvBucket).Cursor()
+		for k, _ := c.Seek(p); k != nil && bytes.HasPrefix(k, p); k, _ = c.Next() {
+			if live(tx, k, now) != nil {
+				keys = append(keys, string(k))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+func (s *Store) StatKV(key string) (*storage.KeyInfo, error) {
+	var info *storage.KeyInfo
+	err := s.view(func(tx *bolt.Tx) error {
+		v := live(tx, []byte(key), time.Now())
+		if v == nil {
+			return storage.ErrNotFound
+		}
+
+		info = &storage.KeyInfo{
+			Key:        key,
+			Size:       int64(len(v)),
+			ModTime:    decodeTime(tx.Bucket(modtimesBucket).Get([]byte(key))),
+			Expiration: decodeTime(tx.Bucket(expirationsBucket).Get([]byte(key))),
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+func (s *Store) CompareAndSwapKV(key string, old, value []byte, expiration time.Duration) (bool, error) {
+	var swapped bool
+	err := s.update(func(tx *bolt.Tx) error {
+		now := time.Now()
+
+		current := live(tx, []byte(key), now)
+		if (old == nil) != (current == nil) || !bytes.Equal(current, old) {
+			return nil
+		}
+
+		swapped = true
+		return put(tx, []byte(key), value, expiration, now)
+	})
+	if err != nil {
+		return false, err
+	}
+	return swapped, nil
+}
+
+func getLock(tx *bolt.Tx, domain string) (*lockRecord, error) {
+	v := tx.Bucket(locksBucket).Get([]byte(domain))
+	if v == nil {
+		return nil, nil
+	}
+
+	l := &lockRecord{}
+	err := json.Unmarshal(v, l)
+	if err != nil {
+		return nil, fmt.Errorf("invalid lease of %s: %v", domain, err)
+	}
+
+	return l, nil
+}
+
+func putLock(tx *bolt.Tx, domain string, l *lockRecord) error {
+	b, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(locksBucket).Put([]byte(domain), b)
+}
+
+func (s *Store) LockCert(domain, owner string, ttl time.Duration) (*storage.Lease, error) {
+	var lease *storage.Lease
+	err := s.update(func(tx *bolt.Tx) error {
+		now := time.Now()
+
+		prev, err := getLock(tx, domain)
+		if err != nil {
+			return err
+		}
+
+		var token uint64 = 1
+		var epoch string
+		if prev != nil {
+			if now.Before(prev.Deadline) {
+				return storage.ErrLockHeld
+			}
+			token = prev.Token + 1
+			epoch = prev.Epoch
+		}
+		// records written before epochs were kept get one as well
+		if epoch == "" {
+			epoch = storage.NewEpoch()
+		}
+
+		l := &lockRecord{Owner: owner, Token: token, Epoch: epoch, Deadline: now.Add(ttl)}
+
+		err = putLock(tx, domain, l)
+		if err != nil {
+			return err
+		}
+
+		lease = l.lease(domain)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return lease, nil
+}
+
+// updateLease sets the deadline of the lock of lease, if lease still holds it
+func (s *Store) updateLease(lease *storage.Lease, deadline time.Time) error {
+	return s.update(func(tx *bolt.Tx) error {
+		cur, err := getLock(tx, lease.Domain)
+		if err != nil {
+			return err
+		}
+
+		if cur == nil || !lease.Held(cur.lease(lease.Domain), time.Now()) {
+			return storage.ErrLeaseLost
+		}
+
+		cur.Deadline = deadline
+		return putLock(tx, lease.Domain, cur)
+	})
+}
+
+func (s *Store) RenewCertLock(lease *storage.Lease, ttl time.Duration) error {
+	deadline := time.Now().Add(ttl)
+
+	err := s.updateLease(lease, deadline)
+	if err != nil {
+		return err
+	}
+
+	lease.Deadline = deadline
+
+	return nil
+}
+
+func (s *Store) UnlockCert(lease *storage.Lease) error {
+	return s.updateLease(lease, time.Time{})
+}
+
+func (s *Store) gcLoop() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+		}
+
+		_, err := s.DeleteExpired()
+		if err != nil {
+			s.logger.Error("boltstore: could not delete expired keys", slog.String("error", err.Error()))
+		}
+	}
+}
+
+// DeleteExpired deletes the expired keys and returns how many were
+func (s *Store) DeleteExpired() (int, error) {
+	var n int
+	err := s.update(func(tx *bolt.Tx) error {
+		now := time.Now()
+
+		var expired [][]byte
+		err := tx.Bucket(expirationsBucket).ForEach(func(k, v []byte) error {
+			if !now.Before(decodeTime(v)) {
+				expired = append(expired, bytes.Clone(k))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, k := range expired {
+			err = del(tx, k)
+			if err != nil {
+				return err
+			}
+		}
+
+		n = len(expired)
+		return nil
+	})
+	return n, err
+}
+
+// Backup writes a consistent copy of the database to w, without blocking writes
+func (s *Store) Backup(w io.Writer) (int64, error) {
+	var n int64
+	err := s.view(func(tx *bolt.Tx) error {
+		var err error
+		n, err = tx.WriteTo(w)
+		return err
+	})
+	return n, err
+}
+
+// Compact rewrites the database to reclaim the space of deleted keys. Every other operation waits for it.
+func (s *Store) Compact() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tmp := s.path + ".compact"
+	os.Remove(tmp)
+
+	dst, err := bolt.Open(tmp, 0600, nil)
+	if err != nil {
+		return err
+	}
+
+	err = bolt.Compact(dst, s.db, 64*1024*1024)
+	if err != nil {
+		dst.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("could not compact %s: %v", s.path, err)
+	}
+
+	err = dst.Sync()
+	if err == nil {
+		err = dst.Close()
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	err = s.db.Close()
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmp, s.path)
+	if err != nil {
+		// keep serving from the original database
+		os.Remove(tmp)
+		if oerr := s.open(); oerr != nil {
+			return fmt.Errorf("could not replace %s: %v, nor reopen it: %v", s.path, err, oerr)
+		}
+		return fmt.Errorf("could not replace %s: %v", s.path, err)
+	}
+
+	return s.open()
+}
@@ -0,0 +1,108 @@
+package boltstore
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/arthurweinmann/go-https-hug/pkg/storage"
+	"github.com/arthurweinmann/go-https-hug/pkg/storage/storagetest"
+)
+
+func TestConformance(t *testing.T) {
+	storagetest.RunConformance(t, func(t *testing.T) (storage.Store, func(time.Duration)) {
+		s, err := NewStore(&Config{Path: filepath.Join(t.TempDir(), "store.db")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { s.Close() })
+		return s, nil
+	})
+}
+
+func TestPersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.db")
+
+	s, err := NewStore(&Config{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.SetKV("certificates/example.com", []byte("cert"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.SetKV("challenges/example.com_token", []byte("keyauth"), 100*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lease, err := s.LockCert("example.com", "a", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var backup bytes.Buffer
+	_, err = s.Backup(&backup)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// expirations and locks survive a restart
+	s, err = NewStore(&Config{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	_, err = s.LockCert("example.com", "b", time.Minute)
+	if err != storage.ErrLockHeld {
+		t.Fatalf("expected ErrLockHeld after a restart, got %v", err)
+	}
+	err = s.UnlockCert(lease)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+
+	_, err = s.GetKV("challenges/example.com_token")
+	if err != storage.ErrNotFound {
+		t.Fatalf("expected the challenge to expire, got %v", err)
+	}
+
+	n, err := s.DeleteExpired()
+	if err != nil || n != 1 {
+		t.Fatalf("expected one expired key to be deleted, got %d %v", n, err)
+	}
+
+	// the backup is a valid database
+	backupPath := filepath.Join(t.TempDir(), "backup.db")
+	err = os.WriteFile(backupPath, backup.Bytes(), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restored, err := NewStore(&Config{Path: backupPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+
+	b, err := restored.GetKV("certificates/example.com")
+	if err != nil || string(b) != "cert" {
+		t.Fatalf("unexpected value in the backup %q %v", b, err)
+	}
+}
@@ -0,0 +1,126 @@
+package filesystem
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// metaPrefix starts the names of the files and directories which are not keys, they are ignored by ListKV and the GC.
+// Keys must not have a path element starting with it.
+const metaPrefix = ".hug-"
+
+// tmpPrefix starts the names of the temporary files of writeFileAtomic
+const tmpPrefix = metaPrefix + "tmp-"
+
+// orphanAge is the age after which a temporary file is considered left over by a crash,
+// younger ones may belong to a write in progress in another process sharing the directory
+const orphanAge = time.Minute
+
+// privatePrefixes are the prefixes of the keys holding private keys or credentials, written with mode 0600
+var privatePrefixes = []string{"certificates/", "user/", "acmedns/"}
+
+func fileMode(key string) os.FileMode {
+	for _, p := range privatePrefixes {
+		if strings.HasPrefix(key, p) {
+			return 0600
+		}
+	}
+	return 0644
+}
+
+func isTempFile(path string) bool {
+	return strings.HasPrefix(filepath.Base(path), tmpPrefix)
+}
+
+func isMetaFile(path string) bool {
+	return strings.HasPrefix(filepath.Base(path), metaPrefix)
+}
+
+// writeFileAtomic replaces the file at p with data, so that readers see either the previous content or
+// the new one, and a crash leaves at most an orphaned temporary file next to it
+func writeFileAtomic(p string, data []byte, mode os.FileMode) error {
+	dir := filepath.Dir(p)
+
+	f, err := os.CreateTemp(dir, tmpPrefix+"*")
+	if err != nil {
+		return err
+	}
+
+	err = writeAndSync(f, data, mode)
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	err = os.Rename(f.Name(), p)
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	return syncDir(dir)
+}
+
+func writeAndSync(f *os.File, data []byte, mode os.FileMode) error {
+	err := f.Chmod(mode)
+	if err == nil {
+		_, err = f.Write(data)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// syncDir persists the entries of dir, such as a rename into it
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
+
+// removeOrphans deletes the temporary files older than orphanAge
+func (s *Store) removeOrphans() error {
+	now := time.Now()
+
+	return filepath.WalkDir(s.directory, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() || !isTempFile(path) {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			if os.IsNotExist(err) {
+				// renamed or removed meanwhile
+				return nil
+			}
+			return err
+		}
+
+		if now.Sub(info.ModTime()) < orphanAge {
+			return nil
+		}
+
+		err = os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("could not remove the orphaned temporary file %s: %v", path, err)
+		}
+
+		return nil
+	})
+}
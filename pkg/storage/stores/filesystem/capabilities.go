@@ -0,0 +1,127 @@
+package filesystem
+
+import (
+	"bytes"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/arthurweinmann/go-https-hug/pkg/storage"
+)
+
+var (
+	_ storage.Lister            = (*Store)(nil)
+	_ storage.Stater            = (*Store)(nil)
+	_ storage.CompareAndSwapper = (*Store)(nil)
+)
+
+func (s *Store) ListKV(prefix string) ([]string, error) {
+	// only walk the deepest directory containing every key with this prefix
+	root := s.directory
+	if i := strings.LastIndexByte(prefix, '/'); i >= 0 {
+		root = filepath.Join(s.directory, filepath.FromSlash(prefix[:i]))
+	}
+
+	now := time.Now()
+
+	var keys []string
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == root {
+				return filepath.SkipDir
+			}
+			return err
+		}
+
+		if isMetaFile(path) && path != root {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(s.directory, path)
+		if err != nil {
+			return err
+		}
+
+		key := filepath.ToSlash(rel)
+		if strings.HasPrefix(key, prefix) && !expired(path, now) {
+			keys = append(keys, key)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+func (s *Store) StatKV(key string) (*storage.KeyInfo, error) {
+	p := filepath.Join(s.directory, key)
+
+	info, err := os.Stat(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, storage.ErrNotFound
+		}
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, storage.ErrNotFound
+	}
+
+	exp, err := expiration(p)
+	if err != nil {
+		return nil, err
+	}
+	if !exp.IsZero() && !time.Now().Before(exp) {
+		return nil, storage.ErrNotFound
+	}
+
+	return &storage.KeyInfo{
+		Key:        key,
+		Size:       info.Size(),
+		ModTime:    info.ModTime(),
+		Expiration: exp,
+	}, nil
+}
+
+// CompareAndSwapKV is atomic with respect to the writes of the other processes sharing the directory as well
+func (s *Store) CompareAndSwapKV(key string, old, value []byte, expiration time.Duration) (bool, error) {
+	var swapped bool
+	err := s.withKVLock(func() error {
+		current, err := s.GetKV(key)
+		if err != nil && err != storage.ErrNotFound {
+			return err
+		}
+
+		if err == storage.ErrNotFound {
+			if old != nil {
+				return nil
+			}
+		} else if old == nil || !bytes.Equal(current, old) {
+			return nil
+		}
+
+		err = s.setKV(key, value, expiration)
+		if err != nil {
+			return err
+		}
+
+		swapped = true
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return swapped, nil
+}
@@ -30,6 +30,13 @@ func (s *Store) runGC(gclevel int) error {
 
 	fileArr := make([]*codeFile, 0)
 	err := filepath.Walk(s.directory, func(path string, info fs.FileInfo, err error) error {
+		// metadata files are not keys, and temporary ones may be renamed while walking
+		if isMetaFile(path) {
+			if info != nil && info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
 		if err != nil {
 			return err
 		}
@@ -63,19 +70,9 @@ func (s *Store) runGC(gclevel int) error {
 	sort.Slice(fileArr, func(i, j int) bool { return fileArr[i].lastmod < fileArr[j].lastmod })
 
 	for _, v := range fileArr {
-		s.lsMutex.Lock()
-		deadline, ok := s.expirations[v.fname]
-		s.lsMutex.Unlock()
-
-		if ok && time.Now().After(deadline) {
-			err := os.Remove(v.fname)
-			if err != nil {
-				return err
-			}
-
-			s.lsMutex.Lock()
-			delete(s.expirations, v.fname)
-			s.lsMutex.Unlock()
+		err := s.removeIfExpired(v.fname)
+		if err != nil {
+			return err
 		}
 	}
 
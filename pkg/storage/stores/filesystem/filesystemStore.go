@@ -16,24 +16,42 @@ const (
 	gcHard
 )
 
+// Store keeps every key in a file of directory. Expirations and leases are stored next to them, in files
+// named after metaPrefix, so that they survive restarts and are shared by the processes using directory.
 type Store struct {
-	directory   string
-	lockStore   map[string]bool
-	expirations map[string]time.Time
-	lsMutex     *sync.Mutex
-	withGC      bool
+	directory string
+	// kvMutex serializes the writes of this process, the flock of kvLockFile the ones of the processes sharing directory
+	kvMutex *sync.Mutex
+	withGC  bool
+}
+
+// kvLockFile is flocked by the writes of the keys and their expirations, so that CompareAndSwapKV is atomic
+// and the GC does not remove a value written after the expiration it read
+const kvLockFile = metaPrefix + "kv.lock"
+
+// withKVLock runs fn under the locks of the writes of the keys
+func (s *Store) withKVLock(fn func() error) error {
+	s.kvMutex.Lock()
+	defer s.kvMutex.Unlock()
+
+	return withFlock(filepath.Join(s.directory, kvLockFile), func(*os.File) error {
+		return fn()
+	})
 }
 
 func NewStore(directory string, withGC bool) (*Store, error) {
 	out := &Store{
-		directory:   directory,
-		expirations: map[string]time.Time{},
-		lockStore:   map[string]bool{},
-		lsMutex:     &sync.Mutex{},
-		withGC:      withGC,
+		directory: directory,
+		kvMutex:   &sync.Mutex{},
+		withGC:    withGC,
+	}
+
+	err := os.MkdirAll(filepath.Join(directory, locksDir), 0700)
+	if err != nil {
+		return nil, err
 	}
 
-	err := os.MkdirAll(directory, 0700)
+	err = out.removeOrphans()
 	if err != nil {
 		return nil, err
 	}
@@ -49,6 +67,12 @@ func NewStore(directory string, withGC bool) (*Store, error) {
 }
 
 func (s *Store) SetKV(key string, value []byte, expiration time.Duration) error {
+	return s.withKVLock(func() error {
+		return s.setKV(key, value, expiration)
+	})
+}
+
+func (s *Store) setKV(key string, value []byte, expiration time.Duration) error {
 	p := filepath.Join(s.directory, key)
 
 	err := os.MkdirAll(filepath.Dir(p), 0700)
@@ -56,91 +80,72 @@ func (s *Store) SetKV(key string, value []byte, expiration time.Duration) error
 		return err
 	}
 
-	_, err = os.Stat(p)
-	if err != nil && !os.IsNotExist(err) {
-		return err
-	}
-
-	if err == nil {
-		err = os.Remove(p)
-		if err != nil {
-			return err
-		}
-	}
-
-	err = os.WriteFile(p, value, 0644)
+	// the expiration is updated first, so that a crash in between cannot make a new value
+	// without expiration, such as a certificate, expire with the one of the previous value
+	err = setExpiration(p, expiration)
 	if err != nil {
 		return err
 	}
 
-	if expiration > 0 {
-		s.lsMutex.Lock()
-		defer s.lsMutex.Unlock()
-		s.expirations[p] = time.Now().Add(expiration)
-	}
-
-	return err
+	return writeFileAtomic(p, value, fileMode(key))
 }
 
 func (s *Store) GetKV(key string) ([]byte, error) {
-	b, err := os.ReadFile(filepath.Join(s.directory, key))
+	p := filepath.Join(s.directory, key)
+
+	if expired(p, time.Now()) {
+		return nil, storage.ErrNotFound
+	}
+
+	b, err := os.ReadFile(p)
 	if err != nil {
 		if os.IsNotExist(err) {
 			return nil, storage.ErrNotFound
 		}
+		// the key is a prefix of other ones, such as challenges/tls-alpn-01
+		if info, serr := os.Stat(p); serr == nil && info.IsDir() {
+			return nil, storage.ErrNotFound
+		}
 		return nil, err
 	}
 	return b, nil
 }
 
 func (s *Store) DeleteKV(key string) error {
+	return s.withKVLock(func() error {
+		return s.deleteKV(key)
+	})
+}
+
+func (s *Store) deleteKV(key string) error {
 	p := filepath.Join(s.directory, key)
 
-	_, err := os.Stat(p)
+	info, err := os.Stat(p)
 	if err != nil {
 		if os.IsNotExist(err) {
 			return storage.ErrNotFound
 		}
 		return err
 	}
+	if info.IsDir() {
+		return storage.ErrNotFound
+	}
+
+	expired := expired(p, time.Now())
 
 	err = os.Remove(p)
 	if err != nil {
 		return err
 	}
 
-	s.lsMutex.Lock()
-	defer s.lsMutex.Unlock()
-	delete(s.expirations, p)
-
-	return nil
-}
-
-func (s *Store) LockCert(domain string, timeout time.Duration) (bool, error) {
-	s.lsMutex.Lock()
-	defer s.lsMutex.Unlock()
-
-	if s.lockStore[domain] {
-		return false, nil
+	err = removeExpiration(p)
+	if err != nil {
+		return err
 	}
 
-	s.lockStore[domain] = true
-	go func() {
-		// TODO: handle the case where UnlockCert is called before the timeout expiring, which is fine
-		// but then this goroutine potentially removes the lock from a call that came just after the call to UnlockCert
-		// and before the timeout here expired
-		time.Sleep(timeout)
-		s.lsMutex.Lock()
-		defer s.lsMutex.Unlock()
-		delete(s.lockStore, domain)
-	}()
-
-	return true, nil
-}
+	if expired {
+		return storage.ErrNotFound
+	}
 
-func (s *Store) UnlockCert(domain string) error {
-	s.lsMutex.Lock()
-	defer s.lsMutex.Unlock()
-	delete(s.lockStore, domain)
 	return nil
 }
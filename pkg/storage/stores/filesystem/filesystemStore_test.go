@@ -0,0 +1,221 @@
+package filesystem
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/arthurweinmann/go-https-hug/pkg/storage"
+	"github.com/arthurweinmann/go-https-hug/pkg/storage/storagetest"
+)
+
+func TestConformance(t *testing.T) {
+	storagetest.RunConformance(t, func(t *testing.T) (storage.Store, func(time.Duration)) {
+		s, err := NewStore(t.TempDir(), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s, nil
+	})
+}
+
+func TestAtomicWrites(t *testing.T) {
+	dir := t.TempDir()
+
+	err := os.MkdirAll(filepath.Join(dir, "certificates"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	orphan := filepath.Join(dir, "certificates", tmpPrefix+"123")
+	inProgress := filepath.Join(dir, "certificates", tmpPrefix+"456")
+	for _, p := range []string{orphan, inProgress} {
+		err = os.WriteFile(p, []byte("partial"), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := time.Now().Add(-2 * orphanAge)
+	err = os.Chtimes(orphan, old, old)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewStore(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(orphan); !os.IsNotExist(err) {
+		t.Fatalf("expected the orphaned temporary file to be removed, got %v", err)
+	}
+	if _, err := os.Stat(inProgress); err != nil {
+		t.Fatalf("expected the recent temporary file to be kept, got %v", err)
+	}
+
+	err = s.SetKV("certificates/example.com", []byte("cert"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.SetKV("challenges/example.com_token", []byte("keyauth"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := s.ListKV("certificates/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0] != "certificates/example.com" {
+		t.Fatalf("expected temporary files not to be listed, got %v", keys)
+	}
+
+	for key, mode := range map[string]os.FileMode{"certificates/example.com": 0600, "challenges/example.com_token": 0644} {
+		info, err := os.Stat(filepath.Join(dir, key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != mode {
+			t.Fatalf("expected mode %v for %s, got %v", mode, key, info.Mode().Perm())
+		}
+	}
+}
+
+func TestSharedDirectory(t *testing.T) {
+	dir := t.TempDir()
+
+	// two stores on the same directory behave as two processes, or as a store before and after a restart
+	a, err := NewStore(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewStore(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = a.SetKV("challenges/example.com_token", []byte("keyauth"), 100*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = a.SetKV("certificates/example.com", []byte("cert"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lease, err := a.LockCert("example.com", "a", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = b.LockCert("example.com", "b", time.Minute)
+	if err != storage.ErrLockHeld {
+		t.Fatalf("expected ErrLockHeld from another store, got %v", err)
+	}
+
+	info, err := b.StatKV("challenges/example.com_token")
+	if err != nil || info.Expiration.IsZero() {
+		t.Fatalf("expected the expiration to be shared, got %+v %v", info, err)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+
+	_, err = b.GetKV("challenges/example.com_token")
+	if err != storage.ErrNotFound {
+		t.Fatalf("expected the challenge to expire in the other store, got %v", err)
+	}
+
+	err = b.runGC(gcSkip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{filepath.Join(dir, "challenges", "example.com_token"), expirationPath(filepath.Join(dir, "challenges", "example.com_token"))} {
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			t.Fatalf("expected the GC to remove %s, got %v", p, err)
+		}
+	}
+	if _, err := b.GetKV("certificates/example.com"); err != nil {
+		t.Fatalf("expected the GC to keep the certificate, got %v", err)
+	}
+
+	err = a.UnlockCert(lease)
+	if err != nil {
+		t.Fatal(err)
+	}
+	next, err := b.LockCert("example.com", "b", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next.Token <= lease.Token {
+		t.Fatalf("fencing tokens must increase across stores, got %d then %d", lease.Token, next.Token)
+	}
+
+	keys, err := b.ListKV("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0] != "certificates/example.com" {
+		t.Fatalf("expected metadata files not to be listed, got %v", keys)
+	}
+}
+
+func TestSharedCompareAndSwap(t *testing.T) {
+	dir := t.TempDir()
+
+	stores := make([]*Store, 2)
+	for i := range stores {
+		s, err := NewStore(dir, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stores[i] = s
+	}
+
+	// every store increments a counter with compare-and-swap, no increment may be lost
+	const increments = 50
+
+	var wg sync.WaitGroup
+	for _, s := range stores {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < increments; i++ {
+				for {
+					cur, err := s.GetKV("counter")
+					if err != nil && err != storage.ErrNotFound {
+						t.Error(err)
+						return
+					}
+					if err == storage.ErrNotFound {
+						cur = nil
+					}
+
+					n := 0
+					if cur != nil {
+						n, _ = strconv.Atoi(string(cur))
+					}
+
+					swapped, err := s.CompareAndSwapKV("counter", cur, []byte(strconv.Itoa(n+1)), 0)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					if swapped {
+						break
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	b, err := stores[0].GetKV("counter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != strconv.Itoa(increments*len(stores)) {
+		t.Fatalf("expected %d increments, got %s", increments*len(stores), b)
+	}
+}
@@ -0,0 +1,158 @@
+package filesystem
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/arthurweinmann/go-https-hug/pkg/storage"
+	"golang.org/x/sys/unix"
+)
+
+// locksDir is the directory of the lock files, one per domain, holding the JSON lockRecord of its lease
+const locksDir = metaPrefix + "locks"
+
+// lockRecord is never deleted, so that Token keeps increasing, a released lease has a zero Deadline
+type lockRecord struct {
+	Owner    string    `json:"owner"`
+	Token    uint64    `json:"token"`
+	Epoch    string    `json:"epoch"`
+	Deadline time.Time `json:"deadline"`
+}
+
+func (l *lockRecord) lease(domain string) *storage.Lease {
+	return &storage.Lease{Domain: domain, Owner: l.Owner, Token: l.Token, Epoch: l.Epoch, Deadline: l.Deadline}
+}
+
+// withLockFile runs fn on the record of the lock file of domain, under an exclusive flock so that the processes
+// sharing the directory see each other's leases. The record is written back if fn returns true.
+// flock is only held for the duration of fn, a lease is held until its deadline.
+func (s *Store) withLockFile(domain string, fn func(l *lockRecord) (bool, error)) error {
+	p := filepath.Join(s.directory, locksDir, domain)
+
+	return withFlock(p, func(f *os.File) error {
+		return updateLockFile(f, fn)
+	})
+}
+
+// withFlock runs fn with the file at p, created if needed, under an exclusive flock
+func withFlock(p string, fn func(f *os.File) error) error {
+	f, err := os.OpenFile(p, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	err = unix.Flock(int(f.Fd()), unix.LOCK_EX)
+	if err != nil {
+		return fmt.Errorf("could not flock %s: %v", p, err)
+	}
+	defer unix.Flock(int(f.Fd()), unix.LOCK_UN)
+
+	return fn(f)
+}
+
+func updateLockFile(f *os.File, fn func(l *lockRecord) (bool, error)) error {
+	p := f.Name()
+
+	b, err := io.ReadAll(f)
+	if err != nil {
+		return err
+	}
+
+	l := &lockRecord{}
+	if len(b) > 0 {
+		err = json.Unmarshal(b, l)
+		if err != nil {
+			return fmt.Errorf("invalid lock file %s: %v", p, err)
+		}
+	}
+
+	write, err := fn(l)
+	if err != nil || !write {
+		return err
+	}
+
+	b, err = json.Marshal(l)
+	if err != nil {
+		return err
+	}
+
+	// the record is rewritten in place, readers hold the flock as well
+	err = f.Truncate(0)
+	if err == nil {
+		_, err = f.WriteAt(b, 0)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+
+	return err
+}
+
+func (s *Store) LockCert(domain, owner string, ttl time.Duration) (*storage.Lease, error) {
+	var lease *storage.Lease
+	err := s.withLockFile(domain, func(l *lockRecord) (bool, error) {
+		now := time.Now()
+
+		// expired leases are simply overwritten, there is no timer which could remove a later holder
+		if now.Before(l.Deadline) {
+			return false, storage.ErrLockHeld
+		}
+
+		// the lock files of the versions of this store which did not keep an epoch get one, their
+		// tokens are then not compared to the ones certificates may have been written with
+		if l.Epoch == "" {
+			l.Epoch = storage.NewEpoch()
+		}
+		l.Token++
+		l.Owner = owner
+		l.Deadline = now.Add(ttl)
+
+		lease = l.lease(domain)
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return lease, nil
+}
+
+func (s *Store) RenewCertLock(lease *storage.Lease, ttl time.Duration) error {
+	var deadline time.Time
+	err := s.withLockFile(lease.Domain, func(l *lockRecord) (bool, error) {
+		now := time.Now()
+
+		if !lease.Held(l.lease(lease.Domain), now) {
+			return false, storage.ErrLeaseLost
+		}
+
+		deadline = now.Add(ttl)
+		l.Deadline = deadline
+
+		return true, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	lease.Deadline = deadline
+
+	return nil
+}
+
+func (s *Store) UnlockCert(lease *storage.Lease) error {
+	return s.withLockFile(lease.Domain, func(l *lockRecord) (bool, error) {
+		if !lease.Held(l.lease(lease.Domain), time.Now()) {
+			return false, storage.ErrLeaseLost
+		}
+
+		l.Deadline = time.Time{}
+
+		return true, nil
+	})
+}
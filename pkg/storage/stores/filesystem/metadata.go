@@ -0,0 +1,90 @@
+package filesystem
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// expPrefix starts the names of the sidecar files holding the expiration of the key file
+// of the same directory named after the rest, as unix nanoseconds
+const expPrefix = metaPrefix + "exp-"
+
+func expirationPath(p string) string {
+	return filepath.Join(filepath.Dir(p), expPrefix+filepath.Base(p))
+}
+
+// setExpiration writes the sidecar of the key file at p, or removes it if expiration is not positive
+func setExpiration(p string, expiration time.Duration) error {
+	if expiration <= 0 {
+		return removeExpiration(p)
+	}
+
+	deadline := time.Now().Add(expiration).UnixNano()
+
+	return writeFileAtomic(expirationPath(p), []byte(strconv.FormatInt(deadline, 10)), 0644)
+}
+
+func removeExpiration(p string) error {
+	err := os.Remove(expirationPath(p))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// expiration returns the expiration of the key file at p, zero if it does not expire
+func expiration(p string) (time.Time, error) {
+	b, err := os.ReadFile(expirationPath(p))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return time.Time{}, nil
+		}
+		return time.Time{}, err
+	}
+
+	n, err := strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return time.Unix(0, n), nil
+}
+
+// expired reports whether the key file at p has an expiration in the past, it is left for the GC to remove.
+// An unreadable expiration is considered in the past, the keys which expire being temporary.
+func expired(p string, now time.Time) bool {
+	deadline, err := expiration(p)
+	if err != nil {
+		return true
+	}
+	return !deadline.IsZero() && !now.Before(deadline)
+}
+
+// removeIfExpired deletes the key file at p and its sidecar if it expired. The expirations are read from disk,
+// so that the ones set before a restart or by another process are honored.
+func (s *Store) removeIfExpired(p string) error {
+	return s.withKVLock(func() error {
+		return removeIfExpired(p)
+	})
+}
+
+func removeIfExpired(p string) error {
+	deadline, err := expiration(p)
+	if err != nil {
+		return err
+	}
+
+	if deadline.IsZero() || time.Now().Before(deadline) {
+		return nil
+	}
+
+	err = os.Remove(p)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return removeExpiration(p)
+}
@@ -0,0 +1,243 @@
+// Package instrumented implements a storage.Store decorator recording the latency, errors, lock contention
+// and hit ratio of another Store, through a pluggable Metrics implementation and OpenTelemetry spans.
+package instrumented
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/arthurweinmann/go-https-hug/pkg/storage"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	_ storage.Store             = (*Store)(nil)
+	_ storage.Lister            = (*Store)(nil)
+	_ storage.Stater            = (*Store)(nil)
+	_ storage.CompareAndSwapper = (*Store)(nil)
+	_ storage.Refresher         = (*Store)(nil)
+)
+
+// ErrorKind classifies the result of an operation
+type ErrorKind string
+
+const (
+	KindNone        ErrorKind = ""
+	KindNotFound    ErrorKind = "not_found"
+	KindLockHeld    ErrorKind = "lock_held"
+	KindLeaseLost   ErrorKind = "lease_lost"
+	KindUnsupported ErrorKind = "unsupported"
+	KindOther       ErrorKind = "other"
+)
+
+func errorKind(err error) ErrorKind {
+	switch {
+	case err == nil:
+		return KindNone
+	case err == storage.ErrNotFound:
+		return KindNotFound
+	case err == storage.ErrLockHeld:
+		return KindLockHeld
+	case err == storage.ErrLeaseLost:
+		return KindLeaseLost
+	case errors.Is(err, errors.ErrUnsupported):
+		return KindUnsupported
+	default:
+		return KindOther
+	}
+}
+
+// Metrics receives the measures of a Store. Its methods are called synchronously and must be fast.
+type Metrics interface {
+	// ObserveOperation records an operation, op being the name of the Store method, such as GetKV,
+	// and kind the kind of its error, KindNone on success
+	ObserveOperation(op string, duration time.Duration, kind ErrorKind)
+
+	// ObserveLookup records whether a GetKV found its key. class is the first element of the key,
+	// such as certificates or challenges.
+	ObserveLookup(class string, hit bool)
+
+	// ObserveLockContention records a LockCert which found the lock held by another lease
+	ObserveLockContention()
+}
+
+type Config struct {
+	Store storage.Store
+
+	// Metrics is optional
+	Metrics Metrics
+
+	// Tracer is optional, if set every operation is a span. The Store interface does not carry contexts,
+	// so the spans are children of the one of SpanContext, if set, and roots otherwise.
+	Tracer trace.Tracer
+
+	SpanContext context.Context
+}
+
+// Store forwards to the optional capabilities of the decorated Store,
+// errors.ErrUnsupported is returned when it does not implement them.
+type Store struct {
+	store   storage.Store
+	metrics Metrics
+	tracer  trace.Tracer
+	ctx     context.Context
+}
+
+func NewStore(config *Config) (*Store, error) {
+	if config.Store == nil {
+		return nil, fmt.Errorf("a Store to instrument is required")
+	}
+
+	s := &Store{
+		store:   config.Store,
+		metrics: config.Metrics,
+		tracer:  config.Tracer,
+		ctx:     config.SpanContext,
+	}
+	if s.ctx == nil {
+		s.ctx = context.Background()
+	}
+
+	return s, nil
+}
+
+// keyClass returns the first element of key, the only part of it recorded as a metric label
+func keyClass(key string) string {
+	class, _, _ := strings.Cut(key, "/")
+	return class
+}
+
+// observe starts the measure of op, the returned function records it with the error of the operation
+func (s *Store) observe(op string, attrs ...attribute.KeyValue) func(err error) {
+	start := time.Now()
+
+	var span trace.Span
+	if s.tracer != nil {
+		_, span = s.tracer.Start(s.ctx, "storage."+op, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+	}
+
+	return func(err error) {
+		kind := errorKind(err)
+
+		if s.metrics != nil {
+			s.metrics.ObserveOperation(op, time.Since(start), kind)
+		}
+
+		if span != nil {
+			if kind != KindNone {
+				span.SetAttributes(attribute.String("storage.error_kind", string(kind)))
+			}
+			// a missing key or a held lock are answers, not failures
+			if kind == KindOther || kind == KindLeaseLost {
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+			}
+			span.End()
+		}
+	}
+}
+
+func (s *Store) SetKV(key string, value []byte, expiration time.Duration) error {
+	done := s.observe("SetKV", attribute.String("storage.key", key), attribute.Int("storage.size", len(value)))
+	err := s.store.SetKV(key, value, expiration)
+	done(err)
+	return err
+}
+
+func (s *Store) GetKV(key string) ([]byte, error) {
+	done := s.observe("GetKV", attribute.String("storage.key", key))
+	b, err := s.store.GetKV(key)
+	done(err)
+
+	if s.metrics != nil && (err == nil || err == storage.ErrNotFound) {
+		s.metrics.ObserveLookup(keyClass(key), err == nil)
+	}
+
+	return b, err
+}
+
+func (s *Store) DeleteKV(key string) error {
+	done := s.observe("DeleteKV", attribute.String("storage.key", key))
+	err := s.store.DeleteKV(key)
+	done(err)
+	return err
+}
+
+func (s *Store) LockCert(domain, owner string, ttl time.Duration) (*storage.Lease, error) {
+	done := s.observe("LockCert", attribute.String("storage.domain", domain), attribute.String("storage.owner", owner))
+	lease, err := s.store.LockCert(domain, owner, ttl)
+	done(err)
+
+	if s.metrics != nil && err == storage.ErrLockHeld {
+		s.metrics.ObserveLockContention()
+	}
+
+	return lease, err
+}
+
+func (s *Store) RenewCertLock(lease *storage.Lease, ttl time.Duration) error {
+	done := s.observe("RenewCertLock", attribute.String("storage.domain", lease.Domain))
+	err := s.store.RenewCertLock(lease, ttl)
+	done(err)
+	return err
+}
+
+func (s *Store) UnlockCert(lease *storage.Lease) error {
+	done := s.observe("UnlockCert", attribute.String("storage.domain", lease.Domain))
+	err := s.store.UnlockCert(lease)
+	done(err)
+	return err
+}
+
+func (s *Store) ListKV(prefix string) ([]string, error) {
+	l, ok := s.store.(storage.Lister)
+	if !ok {
+		return nil, errors.ErrUnsupported
+	}
+
+	done := s.observe("ListKV", attribute.String("storage.prefix", prefix))
+	keys, err := l.ListKV(prefix)
+	done(err)
+	return keys, err
+}
+
+func (s *Store) StatKV(key string) (*storage.KeyInfo, error) {
+	st, ok := s.store.(storage.Stater)
+	if !ok {
+		return nil, errors.ErrUnsupported
+	}
+
+	done := s.observe("StatKV", attribute.String("storage.key", key))
+	info, err := st.StatKV(key)
+	done(err)
+	return info, err
+}
+
+func (s *Store) CompareAndSwapKV(key string, old, value []byte, expiration time.Duration) (bool, error) {
+	c, ok := s.store.(storage.CompareAndSwapper)
+	if !ok {
+		return false, errors.ErrUnsupported
+	}
+
+	done := s.observe("CompareAndSwapKV", attribute.String("storage.key", key), attribute.Int("storage.size", len(value)))
+	swapped, err := c.CompareAndSwapKV(key, old, value, expiration)
+	done(err)
+	return swapped, err
+}
+
+func (s *Store) RefreshKV(key string) ([]byte, error) {
+	r, ok := s.store.(storage.Refresher)
+	if !ok {
+		return nil, errors.ErrUnsupported
+	}
+
+	done := s.observe("RefreshKV", attribute.String("storage.key", key))
+	b, err := r.RefreshKV(key)
+	done(err)
+	return b, err
+}
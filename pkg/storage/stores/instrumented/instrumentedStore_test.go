@@ -0,0 +1,133 @@
+package instrumented
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/arthurweinmann/go-https-hug/pkg/storage"
+	"github.com/arthurweinmann/go-https-hug/pkg/storage/storagetest"
+	"github.com/arthurweinmann/go-https-hug/pkg/storage/stores/memory"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+type recorder struct {
+	mu          sync.Mutex
+	operations  map[string]int
+	errors      map[ErrorKind]int
+	hits        map[string]int
+	misses      map[string]int
+	contentions int
+}
+
+func newRecorder() *recorder {
+	return &recorder{
+		operations: map[string]int{},
+		errors:     map[ErrorKind]int{},
+		hits:       map[string]int{},
+		misses:     map[string]int{},
+	}
+}
+
+func (r *recorder) ObserveOperation(op string, duration time.Duration, kind ErrorKind) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.operations[op]++
+	if kind != KindNone {
+		r.errors[kind]++
+	}
+}
+
+func (r *recorder) ObserveLookup(class string, hit bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if hit {
+		r.hits[class]++
+	} else {
+		r.misses[class]++
+	}
+}
+
+func (r *recorder) ObserveLockContention() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.contentions++
+}
+
+func TestConformance(t *testing.T) {
+	storagetest.RunConformance(t, func(t *testing.T) (storage.Store, func(time.Duration)) {
+		s, err := NewStore(&Config{Store: memory.NewStore(), Metrics: newRecorder()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s, nil
+	})
+}
+
+func TestInstrumentation(t *testing.T) {
+	spans := tracetest.NewSpanRecorder()
+	tracer := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans)).Tracer("test")
+	metrics := newRecorder()
+
+	s, err := NewStore(&Config{Store: memory.NewStore(), Metrics: metrics, Tracer: tracer})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.SetKV("certificates/example.com", []byte("cert"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.GetKV("certificates/example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.GetKV("challenges/example.com_token")
+	if err != storage.ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+
+	lease, err := s.LockCert("example.com", "a", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.LockCert("example.com", "b", time.Minute)
+	if err != storage.ErrLockHeld {
+		t.Fatalf("expected ErrLockHeld, got %v", err)
+	}
+	err = s.UnlockCert(lease)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.UnlockCert(lease)
+	if err != storage.ErrLeaseLost {
+		t.Fatalf("expected ErrLeaseLost, got %v", err)
+	}
+
+	if metrics.operations["GetKV"] != 2 || metrics.operations["LockCert"] != 2 || metrics.operations["UnlockCert"] != 2 {
+		t.Fatalf("unexpected operations %v", metrics.operations)
+	}
+	if metrics.errors[KindNotFound] != 1 || metrics.errors[KindLockHeld] != 1 || metrics.errors[KindLeaseLost] != 1 {
+		t.Fatalf("unexpected errors %v", metrics.errors)
+	}
+	if metrics.hits["certificates"] != 1 || metrics.misses["challenges"] != 1 {
+		t.Fatalf("unexpected lookups %v %v", metrics.hits, metrics.misses)
+	}
+	if metrics.contentions != 1 {
+		t.Fatalf("expected one lock contention, got %d", metrics.contentions)
+	}
+
+	ended := spans.Ended()
+	if len(ended) != 7 {
+		t.Fatalf("expected 7 spans, got %d", len(ended))
+	}
+	for _, span := range ended {
+		// only the lost lease is a failure, a missing key or a held lock are not
+		failed := span.Status().Code == codes.Error
+		if failed != (span.Name() == "storage.UnlockCert" && span == ended[len(ended)-1]) {
+			t.Fatalf("unexpected status %v of span %s", span.Status(), span.Name())
+		}
+	}
+}
@@ -0,0 +1,86 @@
+// Package prommetrics implements instrumented.Metrics with Prometheus collectors.
+package prommetrics
+
+import (
+	"time"
+
+	"github.com/arthurweinmann/go-https-hug/pkg/storage/stores/instrumented"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var _ instrumented.Metrics = (*Metrics)(nil)
+
+type Metrics struct {
+	durations   *prometheus.HistogramVec
+	errors      *prometheus.CounterVec
+	lookups     *prometheus.CounterVec
+	contentions prometheus.Counter
+}
+
+// NewMetrics registers the collectors on reg, prometheus.DefaultRegisterer if nil, with names starting with namespace:
+//
+//	<namespace>_store_operation_duration_seconds{operation}
+//	<namespace>_store_errors_total{operation, kind}
+//	<namespace>_store_lookups_total{class, result="hit"|"miss"}
+//	<namespace>_store_lock_contentions_total
+func NewMetrics(reg prometheus.Registerer, namespace string) (*Metrics, error) {
+	if reg == nil {
+		reg = prometheus.DefaultRegisterer
+	}
+
+	m := &Metrics{
+		durations: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "store",
+			Name:      "operation_duration_seconds",
+			Help:      "Latency of the Store operations.",
+			Buckets:   []float64{.0001, .0005, .001, .005, .01, .05, .1, .5, 1, 5},
+		}, []string{"operation"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "store",
+			Name:      "errors_total",
+			Help:      "Store operations which returned an error, by kind of error.",
+		}, []string{"operation", "kind"}),
+		lookups: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "store",
+			Name:      "lookups_total",
+			Help:      "GetKV calls by class of key and whether the key was found.",
+		}, []string{"class", "result"}),
+		contentions: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "store",
+			Name:      "lock_contentions_total",
+			Help:      "LockCert calls which found the lock held.",
+		}),
+	}
+
+	for _, c := range []prometheus.Collector{m.durations, m.errors, m.lookups, m.contentions} {
+		err := reg.Register(c)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return m, nil
+}
+
+func (m *Metrics) ObserveOperation(op string, duration time.Duration, kind instrumented.ErrorKind) {
+	m.durations.WithLabelValues(op).Observe(duration.Seconds())
+	if kind != instrumented.KindNone {
+		m.errors.WithLabelValues(op, string(kind)).Inc()
+	}
+}
+
+func (m *Metrics) ObserveLookup(class string, hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	m.lookups.WithLabelValues(class, result).Inc()
+}
+
+func (m *Metrics) ObserveLockContention() {
+	m.contentions.Inc()
+}
@@ -0,0 +1,78 @@
+package prommetrics
+
+import (
+	"testing"
+	"time"
+
+	"github.com/arthurweinmann/go-https-hug/pkg/storage"
+	"github.com/arthurweinmann/go-https-hug/pkg/storage/stores/instrumented"
+	"github.com/arthurweinmann/go-https-hug/pkg/storage/stores/memory"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestMetrics(t *testing.T) {
+	reg := prometheus.NewRegistry()
+
+	m, err := NewMetrics(reg, "https_hug")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := instrumented.NewStore(&instrumented.Config{Store: memory.NewStore(), Metrics: m})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.SetKV("certificates/example.com", []byte("cert"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.GetKV("certificates/example.com")
+	s.GetKV("certificates/example.org")
+	s.LockCert("example.com", "a", time.Minute)
+	_, err = s.LockCert("example.com", "b", time.Minute)
+	if err != storage.ErrLockHeld {
+		t.Fatalf("expected ErrLockHeld, got %v", err)
+	}
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	values := map[string]float64{}
+	for _, f := range families {
+		for _, metric := range f.GetMetric() {
+			name := f.GetName()
+			for _, l := range metric.GetLabel() {
+				name += "," + l.GetName() + "=" + l.GetValue()
+			}
+			switch {
+			case metric.Counter != nil:
+				values[name] = metric.GetCounter().GetValue()
+			case metric.Histogram != nil:
+				values[name] = float64(metric.GetHistogram().GetSampleCount())
+			}
+		}
+	}
+
+	for name, expected := range map[string]float64{
+		"https_hug_store_operation_duration_seconds,operation=GetKV":     2,
+		"https_hug_store_operation_duration_seconds,operation=SetKV":     1,
+		"https_hug_store_errors_total,kind=not_found,operation=GetKV":    1,
+		"https_hug_store_errors_total,kind=lock_held,operation=LockCert": 1,
+		"https_hug_store_lookups_total,class=certificates,result=hit":    1,
+		"https_hug_store_lookups_total,class=certificates,result=miss":   1,
+		"https_hug_store_lock_contentions_total":                         1,
+	} {
+		if values[name] != expected {
+			t.Errorf("expected %v for %s, got %v", expected, name, values[name])
+		}
+	}
+
+	// registering twice fails
+	_, err = NewMetrics(reg, "https_hug")
+	if err == nil {
+		t.Fatal("expected an error when registering the collectors twice")
+	}
+}
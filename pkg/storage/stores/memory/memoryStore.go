@@ -0,0 +1,331 @@
+// Package memory implements a storage.Store in process memory, for tests and ephemeral deployments.
+package memory
+
+import (
+	"bytes"
+	"encoding/gob"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/arthurweinmann/go-https-hug/pkg/storage"
+)
+
+var (
+	_ storage.Store             = (*Store)(nil)
+	_ storage.Lister            = (*Store)(nil)
+	_ storage.Stater            = (*Store)(nil)
+	_ storage.CompareAndSwapper = (*Store)(nil)
+)
+
+// sweepInterval is the minimum time between two sweeps of the expired keys, done along with writes
+const sweepInterval = time.Minute
+
+type entry struct {
+	Value      []byte
+	ModTime    time.Time
+	Expiration time.Time
+}
+
+func (e *entry) expired(now time.Time) bool {
+	return !e.Expiration.IsZero() && !now.Before(e.Expiration)
+}
+
+// lockRecord is never deleted, so that Token keeps increasing, a released lease has a zero Deadline
+type lockRecord struct {
+	Owner    string
+	Token    uint64
+	Epoch    string
+	Deadline time.Time
+}
+
+func (l *lockRecord) lease(domain string) *storage.Lease {
+	return &storage.Lease{Domain: domain, Owner: l.Owner, Token: l.Token, Epoch: l.Epoch, Deadline: l.Deadline}
+}
+
+// snapshot is the gob encoded content of Snapshot
+type snapshot struct {
+	KV    map[string]*entry
+	Locks map[string]*lockRecord
+}
+
+type Store struct {
+	mu        sync.Mutex
+	kv        map[string]*entry
+	locks     map[string]*lockRecord
+	lastSweep time.Time
+}
+
+func NewStore() *Store {
+	return &Store{
+		kv:        map[string]*entry{},
+		locks:     map[string]*lockRecord{},
+		lastSweep: time.Now(),
+	}
+}
+
+// get returns the entry of key if it has not expired, s.mu must be held
+func (s *Store) get(key string, now time.Time) *entry {
+	e, ok := s.kv[key]
+	if !ok {
+		return nil
+	}
+	if e.expired(now) {
+		delete(s.kv, key)
+		return nil
+	}
+	return e
+}
+
+// set stores a copy of value, s.mu must be held
+func (s *Store) set(key string, value []byte, expiration time.Duration, now time.Time) {
+	e := &entry{
+		Value:   bytes.Clone(value),
+		ModTime: now,
+	}
+	if e.Value == nil {
+		e.Value = []byte{}
+	}
+	if expiration > 0 {
+		e.Expiration = now.Add(expiration)
+	}
+	s.kv[key] = e
+
+	if now.Sub(s.lastSweep) > sweepInterval {
+		s.lastSweep = now
+		for k, e := range s.kv {
+			if e.expired(now) {
+				delete(s.kv, k)
+			}
+		}
+	}
+}
+
+func (s *Store) SetKV(key string, value []byte, expiration time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.set(key, value, expiration, time.Now())
+
+	return nil
+}
+
+func (s *Store) GetKV(key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e := s.get(key, time.Now())
+	if e == nil {
+		return nil, storage.ErrNotFound
+	}
+
+	return bytes.Clone(e.Value), nil
+}
+
+func (s *Store) DeleteKV(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.get(key, time.Now()) == nil {
+		return storage.ErrNotFound
+	}
+	delete(s.kv, key)
+
+	return nil
+}
+
+func (s *Store) ListKV(prefix string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+
+	var keys []string
+	for k := range s.kv {
+		if strings.HasPrefix(k, prefix) && s.get(k, now) != nil {
+			keys = append(keys, k)
+		}
+	}
+
+	return keys, nil
+}
+
+func (s *Store) StatKV(key string) (*storage.KeyInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e := s.get(key, time.Now())
+	if e == nil {
+		return nil, storage.ErrNotFound
+	}
+
+	return &storage.KeyInfo{
+		Key:        key,
+		Size:       int64(len(e.Value)),
+		ModTime:    e.ModTime,
+		Expiration: e.Expiration,
+	}, nil
+}
+
+func (s *Store) CompareAndSwapKV(key string, old, value []byte, expiration time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+
+	e := s.get(key, now)
+	if e == nil {
+		if old != nil {
+			return false, nil
+		}
+	} else if old == nil || !bytes.Equal(e.Value, old) {
+		return false, nil
+	}
+
+	s.set(key, value, expiration, now)
+
+	return true, nil
+}
+
+func (s *Store) LockCert(domain, owner string, ttl time.Duration) (*storage.Lease, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+
+	l, ok := s.locks[domain]
+	if !ok {
+		l = &lockRecord{Epoch: storage.NewEpoch()}
+		s.locks[domain] = l
+	}
+	if now.Before(l.Deadline) {
+		return nil, storage.ErrLockHeld
+	}
+
+	l.Owner = owner
+	l.Token++
+	l.Deadline = now.Add(ttl)
+
+	return l.lease(domain), nil
+}
+
+// held returns the lock record of lease if it still holds it, s.mu must be held
+func (s *Store) held(lease *storage.Lease) *lockRecord {
+	l, ok := s.locks[lease.Domain]
+	if !ok || !lease.Held(l.lease(lease.Domain), time.Now()) {
+		return nil
+	}
+	return l
+}
+
+func (s *Store) RenewCertLock(lease *storage.Lease, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	l := s.held(lease)
+	if l == nil {
+		return storage.ErrLeaseLost
+	}
+
+	l.Deadline = time.Now().Add(ttl)
+	lease.Deadline = l.Deadline
+
+	return nil
+}
+
+func (s *Store) UnlockCert(lease *storage.Lease) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	l := s.held(lease)
+	if l == nil {
+		return storage.ErrLeaseLost
+	}
+
+	l.Deadline = time.Time{}
+
+	return nil
+}
+
+// Snapshot writes the keys which have not expired and the locks to w
+func (s *Store) Snapshot(w io.Writer) error {
+	s.mu.Lock()
+	now := time.Now()
+	snap := &snapshot{KV: map[string]*entry{}, Locks: map[string]*lockRecord{}}
+	for k, e := range s.kv {
+		if !e.expired(now) {
+			c := *e
+			snap.KV[k] = &c
+		}
+	}
+	for d, l := range s.locks {
+		c := *l
+		snap.Locks[d] = &c
+	}
+	s.mu.Unlock()
+
+	return gob.NewEncoder(w).Encode(snap)
+}
+
+// Restore replaces the content of the Store with a Snapshot read from r
+func (s *Store) Restore(r io.Reader) error {
+	snap := &snapshot{}
+	err := gob.NewDecoder(r).Decode(snap)
+	if err != nil {
+		return err
+	}
+
+	if snap.KV == nil {
+		snap.KV = map[string]*entry{}
+	}
+	if snap.Locks == nil {
+		snap.Locks = map[string]*lockRecord{}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.kv = snap.KV
+	s.locks = snap.Locks
+
+	return nil
+}
+
+// SnapshotFile writes a Snapshot to path, replacing it atomically
+func (s *Store) SnapshotFile(path string) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	err = s.Snapshot(f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
+// RestoreFile restores the Snapshot at path, it returns storage.ErrNotFound if there is none
+func (s *Store) RestoreFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return storage.ErrNotFound
+		}
+		return err
+	}
+	defer f.Close()
+
+	return s.Restore(f)
+}
@@ -0,0 +1,82 @@
+package memory
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/arthurweinmann/go-https-hug/pkg/storage"
+	"github.com/arthurweinmann/go-https-hug/pkg/storage/storagetest"
+)
+
+func TestConformance(t *testing.T) {
+	storagetest.RunConformance(t, func(t *testing.T) (storage.Store, func(time.Duration)) {
+		return NewStore(), nil
+	})
+}
+
+func TestSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot")
+
+	s := NewStore()
+
+	err := s.RestoreFile(path)
+	if err != storage.ErrNotFound {
+		t.Fatalf("expected ErrNotFound without a snapshot, got %v", err)
+	}
+
+	err = s.SetKV("certificates/example.com", []byte("cert"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.SetKV("challenges/example.com_token", []byte("keyauth"), 100*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lease, err := s.LockCert("example.com", "a", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.SnapshotFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restored := NewStore()
+	err = restored.RestoreFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := restored.GetKV("certificates/example.com")
+	if err != nil || string(b) != "cert" {
+		t.Fatalf("unexpected restored value %q %v", b, err)
+	}
+
+	// locks and their tokens are restored
+	_, err = restored.LockCert("example.com", "b", time.Minute)
+	if err != storage.ErrLockHeld {
+		t.Fatalf("expected ErrLockHeld after a restore, got %v", err)
+	}
+	err = restored.UnlockCert(lease)
+	if err != nil {
+		t.Fatal(err)
+	}
+	next, err := restored.LockCert("example.com", "b", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next.Token <= lease.Token {
+		t.Fatalf("fencing tokens must increase after a restore, got %d then %d", lease.Token, next.Token)
+	}
+
+	// expirations are restored
+	time.Sleep(200 * time.Millisecond)
+
+	_, err = restored.GetKV("challenges/example.com_token")
+	if err != storage.ErrNotFound {
+		t.Fatalf("expected the challenge to expire, got %v", err)
+	}
+}
@@ -0,0 +1,297 @@
+// Package redis implements a storage.Store on Redis, so that several replicas share
+// their certificates, challenges and locks.
+package redis
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/arthurweinmann/go-https-hug/pkg/storage"
+	goredis "github.com/redis/go-redis/v9"
+)
+
+var (
+	_ storage.Store             = (*Store)(nil)
+	_ storage.Lister            = (*Store)(nil)
+	_ storage.CompareAndSwapper = (*Store)(nil)
+)
+
+// renewScript extends a lock only if it is still held by the lease
+var renewScript = goredis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+// unlockScript deletes a lock only if it is still held by the lease
+var unlockScript = goredis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+// casScript sets KEYS[1] to ARGV[3], expiring after ARGV[4] milliseconds if not zero, only if its value is ARGV[2],
+// or if it does not exist when ARGV[1] is 1
+var casScript = goredis.NewScript(`
+local cur = redis.call('GET', KEYS[1])
+if ARGV[1] == '1' then
+	if cur then
+		return 0
+	end
+elseif cur ~= ARGV[2] then
+	return 0
+end
+if tonumber(ARGV[4]) > 0 then
+	redis.call('SET', KEYS[1], ARGV[3], 'PX', ARGV[4])
+else
+	redis.call('SET', KEYS[1], ARGV[3])
+end
+return 1
+`)
+
+// reservedPrefix starts the keys of the locks, their fencing token counters and their epochs,
+// they are not listed by ListKV and SetKV, DeleteKV and CompareAndSwapKV refuse to write them.
+const reservedPrefix = ".hug-"
+
+// checkKey returns an error if key is reserved to the locks
+func checkKey(key string) error {
+	if strings.HasPrefix(key, reservedPrefix) {
+		return fmt.Errorf("redis: key %s is reserved, keys must not start with %s", key, reservedPrefix)
+	}
+	return nil
+}
+
+type Store struct {
+	client goredis.UniversalClient
+	prefix string
+	ctx    context.Context
+}
+
+// NewStore returns a Store on client, a *redis.Client or *redis.ClusterClient for example.
+// Every key is prefixed with prefix, for example myapp/, so that several applications may share a Redis.
+// Locks are stored under <prefix>.hug-locks/, their fencing token counters under <prefix>.hug-locktokens/
+// and the epochs of the counters under <prefix>.hug-lockepochs/.
+func NewStore(client goredis.UniversalClient, prefix string) (*Store, error) {
+	s := &Store{
+		client: client,
+		prefix: prefix,
+		ctx:    context.Background(),
+	}
+
+	err := client.Ping(s.ctx).Err()
+	if err != nil {
+		return nil, fmt.Errorf("could not reach redis: %v", err)
+	}
+
+	return s, nil
+}
+
+func (s *Store) SetKV(key string, value []byte, expiration time.Duration) error {
+	err := checkKey(key)
+	if err != nil {
+		return err
+	}
+
+	return s.client.Set(s.ctx, s.prefix+key, value, expiration).Err()
+}
+
+func (s *Store) GetKV(key string) ([]byte, error) {
+	b, err := s.client.Get(s.ctx, s.prefix+key).Bytes()
+	if err == goredis.Nil {
+		return nil, storage.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (s *Store) DeleteKV(key string) error {
+	err := checkKey(key)
+	if err != nil {
+		return err
+	}
+
+	n, err := s.client.Del(s.ctx, s.prefix+key).Result()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return storage.ErrNotFound
+	}
+	return nil
+}
+
+func (s *Store) lockKey(domain string) string {
+	return s.prefix + reservedPrefix + "locks/" + domain
+}
+
+func lockValue(lease *storage.Lease) string {
+	return lease.Owner + "#" + strconv.FormatUint(lease.Token, 10)
+}
+
+func (s *Store) LockCert(domain, owner string, ttl time.Duration) (*storage.Lease, error) {
+	// the counter only ever increases, even when the lock is held and the token is wasted
+	token, err := s.client.Incr(s.ctx, s.prefix+reservedPrefix+"locktokens/"+domain).Uint64()
+	if err != nil {
+		return nil, err
+	}
+
+	epoch, err := s.lockEpoch(domain, token)
+	if err != nil {
+		return nil, err
+	}
+
+	lease := &storage.Lease{
+		Domain:   domain,
+		Owner:    owner,
+		Token:    token,
+		Epoch:    epoch,
+		Deadline: time.Now().Add(ttl),
+	}
+
+	ok, err := s.client.SetNX(s.ctx, s.lockKey(domain), lockValue(lease), ttl).Result()
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, storage.ErrLockHeld
+	}
+
+	return lease, nil
+}
+
+// lockEpoch returns the epoch of the token counter of domain. A counter starting over, for example after
+// the keys were flushed, gets a new one, and so do the counters created before epochs were kept.
+func (s *Store) lockEpoch(domain string, token uint64) (string, error) {
+	key := s.prefix + reservedPrefix + "lockepochs/" + domain
+
+	var err error
+	if token == 1 {
+		err = s.client.Set(s.ctx, key, storage.NewEpoch(), 0).Err()
+	} else {
+		err = s.client.SetNX(s.ctx, key, storage.NewEpoch(), 0).Err()
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return s.client.Get(s.ctx, key).Result()
+}
+
+func (s *Store) RenewCertLock(lease *storage.Lease, ttl time.Duration) error {
+	deadline := time.Now().Add(ttl)
+
+	n, err := renewScript.Run(s.ctx, s.client, []string{s.lockKey(lease.Domain)}, lockValue(lease), ttl.Milliseconds()).Int()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return storage.ErrLeaseLost
+	}
+
+	lease.Deadline = deadline
+
+	return nil
+}
+
+func (s *Store) UnlockCert(lease *storage.Lease) error {
+	n, err := unlockScript.Run(s.ctx, s.client, []string{s.lockKey(lease.Domain)}, lockValue(lease)).Int()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return storage.ErrLeaseLost
+	}
+	return nil
+}
+
+// ListKV scans every master of a *redis.ClusterClient, the keys being sharded between them.
+// The keys of the locks are left out.
+func (s *Store) ListKV(prefix string) ([]string, error) {
+	match := escapePattern(s.prefix+prefix) + "*"
+
+	cluster, ok := s.client.(*goredis.ClusterClient)
+	if !ok {
+		return s.scan(s.ctx, s.client, match)
+	}
+
+	var mu sync.Mutex
+	var keys []string
+
+	err := cluster.ForEachMaster(s.ctx, func(ctx context.Context, client *goredis.Client) error {
+		nodeKeys, err := s.scan(ctx, client, match)
+		if err != nil {
+			return err
+		}
+
+		mu.Lock()
+		keys = append(keys, nodeKeys...)
+		mu.Unlock()
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+func (s *Store) scan(ctx context.Context, client goredis.Cmdable, match string) ([]string, error) {
+	var keys []string
+
+	iter := client.Scan(ctx, 0, match, 1000).Iterator()
+	for iter.Next(ctx) {
+		key := strings.TrimPrefix(iter.Val(), s.prefix)
+		if strings.HasPrefix(key, reservedPrefix) {
+			continue
+		}
+		keys = append(keys, key)
+	}
+
+	err := iter.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+func (s *Store) CompareAndSwapKV(key string, old, value []byte, expiration time.Duration) (bool, error) {
+	err := checkKey(key)
+	if err != nil {
+		return false, err
+	}
+
+	mustNotExist := "0"
+	if old == nil {
+		mustNotExist = "1"
+	}
+
+	n, err := casScript.Run(s.ctx, s.client, []string{s.prefix + key}, mustNotExist, old, value, expiration.Milliseconds()).Int()
+	if err != nil {
+		return false, err
+	}
+
+	return n == 1, nil
+}
+
+// escapePattern escapes the glob special characters of SCAN MATCH patterns
+func escapePattern(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		switch c {
+		case '*', '?', '[', ']', '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
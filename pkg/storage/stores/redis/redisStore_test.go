@@ -0,0 +1,106 @@
+package redis
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/arthurweinmann/go-https-hug/pkg/storage"
+	"github.com/arthurweinmann/go-https-hug/pkg/storage/storagetest"
+	goredis "github.com/redis/go-redis/v9"
+)
+
+// newTestStore uses the redis-server at REDIS_ADDR if set, an in-process miniredis otherwise.
+// wait lets time pass for expirations.
+func newTestStore(t *testing.T) (s *Store, wait func(time.Duration)) {
+	t.Helper()
+
+	addr := os.Getenv("REDIS_ADDR")
+	wait = time.Sleep
+
+	if addr == "" {
+		mr := miniredis.RunT(t)
+		addr = mr.Addr()
+		wait = mr.FastForward
+	}
+
+	client := goredis.NewClient(&goredis.Options{Addr: addr})
+	t.Cleanup(func() { client.Close() })
+
+	return newPrefixedStore(t, client), wait
+}
+
+// newTestClusterStore uses the Redis Cluster at the comma separated REDIS_CLUSTER_ADDRS if set,
+// an in-process miniredis, which answers as a cluster of one node, otherwise
+func newTestClusterStore(t *testing.T) (s *Store, wait func(time.Duration)) {
+	t.Helper()
+
+	addrs := os.Getenv("REDIS_CLUSTER_ADDRS")
+	wait = time.Sleep
+
+	if addrs == "" {
+		mr := miniredis.RunT(t)
+		addrs = mr.Addr()
+		wait = mr.FastForward
+	}
+
+	client := goredis.NewClusterClient(&goredis.ClusterOptions{Addrs: strings.Split(addrs, ",")})
+	t.Cleanup(func() { client.Close() })
+
+	return newPrefixedStore(t, client), wait
+}
+
+func newPrefixedStore(t *testing.T, client goredis.UniversalClient) *Store {
+	t.Helper()
+
+	s, err := NewStore(client, "test-"+t.Name()+"-"+time.Now().Format("150405.000000")+"/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+func TestConformance(t *testing.T) {
+	storagetest.RunConformance(t, func(t *testing.T) (storage.Store, func(time.Duration)) {
+		return newTestStore(t)
+	})
+}
+
+func TestClusterConformance(t *testing.T) {
+	storagetest.RunConformance(t, func(t *testing.T) (storage.Store, func(time.Duration)) {
+		return newTestClusterStore(t)
+	})
+}
+
+func TestReservedKeys(t *testing.T) {
+	s, _ := newTestStore(t)
+
+	_, err := s.LockCert("example.com", "owner", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{
+		strings.TrimPrefix(s.lockKey("example.com"), s.prefix),
+		reservedPrefix + "locktokens/example.com",
+		reservedPrefix + "lockepochs/example.com",
+	} {
+		if err := s.SetKV(key, []byte("a"), 0); err == nil {
+			t.Fatalf("expected SetKV to refuse %s", key)
+		}
+		if _, err := s.CompareAndSwapKV(key, nil, []byte("a"), 0); err == nil {
+			t.Fatalf("expected CompareAndSwapKV to refuse %s", key)
+		}
+		if err := s.DeleteKV(key); err == nil {
+			t.Fatalf("expected DeleteKV to refuse %s", key)
+		}
+	}
+
+	_, err = s.LockCert("example.com", "other", time.Minute)
+	if err != storage.ErrLockHeld {
+		t.Fatalf("expected the lease to be kept, got %v", err)
+	}
+}
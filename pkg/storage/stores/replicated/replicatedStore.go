@@ -0,0 +1,249 @@
+// Package replicated implements a storage.Store mirroring its keys to several Stores, for disaster recovery.
+package replicated
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/arthurweinmann/go-https-hug/pkg/storage"
+)
+
+var (
+	_ storage.Store             = (*Store)(nil)
+	_ storage.Lister            = (*Store)(nil)
+	_ storage.Stater            = (*Store)(nil)
+	_ storage.CompareAndSwapper = (*Store)(nil)
+	_ storage.Refresher         = (*Store)(nil)
+)
+
+const defaultRetryAfter = 30 * time.Second
+
+type Config struct {
+	// Backends receive every write, reads are served by the first healthy one, in order
+	Backends []storage.Store
+
+	// MinWrites is the number of Backends a write must succeed on, all of them by default.
+	// Lower it so that writes go on while a replica is down, at the cost of the replica missing them.
+	MinWrites int
+
+	// Locks is the Store the locks are delegated to, the first of Backends by default.
+	// Locks are not replicated: it must be shared by every node, and may be none of Backends,
+	// for example a redis.Store in front of backends without efficient locks.
+	Locks storage.Store
+
+	// RetryAfter is how long a backend is skipped by reads after an error, 30 seconds by default
+	RetryAfter time.Duration
+}
+
+// Store writes to every backend in order. CompareAndSwapKV compares and swaps on the first healthy backend,
+// then writes the new value to the others: it is atomic as long as it is the same backend for every node.
+type Store struct {
+	backends   []storage.Store
+	minWrites  int
+	locks      storage.Store
+	retryAfter time.Duration
+
+	mu             sync.Mutex
+	unhealthyUntil []time.Time
+}
+
+func NewStore(config *Config) (*Store, error) {
+	if len(config.Backends) == 0 {
+		return nil, fmt.Errorf("at least one backend is required")
+	}
+	if config.MinWrites < 0 || config.MinWrites > len(config.Backends) {
+		return nil, fmt.Errorf("MinWrites must be between 0, for all of them, and the number of backends, got %d", config.MinWrites)
+	}
+
+	s := &Store{
+		backends:       config.Backends,
+		minWrites:      config.MinWrites,
+		locks:          config.Locks,
+		retryAfter:     config.RetryAfter,
+		unhealthyUntil: make([]time.Time, len(config.Backends)),
+	}
+	if s.minWrites == 0 {
+		s.minWrites = len(s.backends)
+	}
+	if s.locks == nil {
+		s.locks = s.backends[0]
+	}
+	if s.retryAfter <= 0 {
+		s.retryAfter = defaultRetryAfter
+	}
+
+	return s, nil
+}
+
+func (s *Store) markUnhealthy(i int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.unhealthyUntil[i] = time.Now().Add(s.retryAfter)
+}
+
+func (s *Store) markHealthy(i int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.unhealthyUntil[i] = time.Time{}
+}
+
+// order returns the indexes of the backends to read from: the healthy ones first, in order, then the others
+func (s *Store) order() []int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+
+	ret := make([]int, 0, len(s.backends))
+	var unhealthy []int
+	for i, until := range s.unhealthyUntil {
+		if now.Before(until) {
+			unhealthy = append(unhealthy, i)
+		} else {
+			ret = append(ret, i)
+		}
+	}
+
+	return append(ret, unhealthy...)
+}
+
+// failed reports whether err means the backend is unhealthy, as opposed to an answer about the key
+func failed(err error) bool {
+	return err != nil && err != storage.ErrNotFound && !errors.Is(err, errors.ErrUnsupported)
+}
+
+// read runs fn with the index of the first healthy backend answering it, trying the next ones on failures
+func read[T any](s *Store, fn func(i int) (T, error)) (T, error) {
+	var ret T
+	var err error
+	for _, i := range s.order() {
+		ret, err = fn(i)
+		if !failed(err) {
+			s.markHealthy(i)
+			return ret, err
+		}
+		s.markUnhealthy(i)
+	}
+	return ret, err
+}
+
+// write runs fn on every backend except skip, or on all of them if skip is negative, and returns an error
+// unless it succeeded on at least MinWrites of them, counting done successful writes made beforehand
+func (s *Store) write(skip, done int, fn func(b storage.Store) error) error {
+	var errs []string
+	succeeded := done
+	for i, b := range s.backends {
+		if i == skip {
+			continue
+		}
+
+		err := fn(b)
+		if failed(err) {
+			s.markUnhealthy(i)
+			errs = append(errs, fmt.Sprintf("backend %d: %v", i, err))
+			continue
+		}
+		succeeded++
+	}
+
+	if succeeded < s.minWrites {
+		return fmt.Errorf("the write succeeded on %d backends out of the %d required: %s", succeeded, s.minWrites, strings.Join(errs, ", "))
+	}
+
+	return nil
+}
+
+func (s *Store) SetKV(key string, value []byte, expiration time.Duration) error {
+	return s.write(-1, 0, func(b storage.Store) error {
+		return b.SetKV(key, value, expiration)
+	})
+}
+
+func (s *Store) GetKV(key string) ([]byte, error) {
+	return read(s, func(i int) ([]byte, error) {
+		return s.backends[i].GetKV(key)
+	})
+}
+
+// DeleteKV returns storage.ErrNotFound if none of the backends had the key
+func (s *Store) DeleteKV(key string) error {
+	found := false
+	err := s.write(-1, 0, func(b storage.Store) error {
+		err := b.DeleteKV(key)
+		if err == nil {
+			found = true
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if !found {
+		return storage.ErrNotFound
+	}
+
+	return nil
+}
+
+// RefreshKV reads key with RefreshKV from the backends implementing storage.Refresher, with GetKV from the others
+func (s *Store) RefreshKV(key string) ([]byte, error) {
+	return read(s, func(i int) ([]byte, error) {
+		return storage.GetFresh(s.backends[i], key)
+	})
+}
+
+func (s *Store) LockCert(domain, owner string, ttl time.Duration) (*storage.Lease, error) {
+	return s.locks.LockCert(domain, owner, ttl)
+}
+
+func (s *Store) RenewCertLock(lease *storage.Lease, ttl time.Duration) error {
+	return s.locks.RenewCertLock(lease, ttl)
+}
+
+func (s *Store) UnlockCert(lease *storage.Lease) error {
+	return s.locks.UnlockCert(lease)
+}
+
+func (s *Store) ListKV(prefix string) ([]string, error) {
+	return read(s, func(i int) ([]string, error) {
+		l, ok := s.backends[i].(storage.Lister)
+		if !ok {
+			return nil, errors.ErrUnsupported
+		}
+		return l.ListKV(prefix)
+	})
+}
+
+func (s *Store) StatKV(key string) (*storage.KeyInfo, error) {
+	return read(s, func(i int) (*storage.KeyInfo, error) {
+		st, ok := s.backends[i].(storage.Stater)
+		if !ok {
+			return nil, errors.ErrUnsupported
+		}
+		return st.StatKV(key)
+	})
+}
+
+// CompareAndSwapKV returns true with an error if the swap succeeded but could not be replicated to MinWrites backends
+func (s *Store) CompareAndSwapKV(key string, old, value []byte, expiration time.Duration) (bool, error) {
+	primary := -1
+	swapped, err := read(s, func(i int) (bool, error) {
+		c, ok := s.backends[i].(storage.CompareAndSwapper)
+		if !ok {
+			return false, errors.ErrUnsupported
+		}
+		primary = i
+		return c.CompareAndSwapKV(key, old, value, expiration)
+	})
+	if err != nil || !swapped {
+		return swapped, err
+	}
+
+	return true, s.write(primary, 1, func(b storage.Store) error {
+		return b.SetKV(key, value, expiration)
+	})
+}
@@ -0,0 +1,114 @@
+package replicated
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/arthurweinmann/go-https-hug/pkg/storage"
+	"github.com/arthurweinmann/go-https-hug/pkg/storage/storagetest"
+	"github.com/arthurweinmann/go-https-hug/pkg/storage/stores/memory"
+)
+
+func TestConformance(t *testing.T) {
+	storagetest.RunConformance(t, func(t *testing.T) (storage.Store, func(time.Duration)) {
+		s, err := NewStore(&Config{Backends: []storage.Store{memory.NewStore(), memory.NewStore()}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s, nil
+	})
+}
+
+// flaky fails every operation while down is set
+type flaky struct {
+	*memory.Store
+	down atomic.Bool
+}
+
+var errDown = errors.New("backend down")
+
+func (f *flaky) SetKV(key string, value []byte, expiration time.Duration) error {
+	if f.down.Load() {
+		return errDown
+	}
+	return f.Store.SetKV(key, value, expiration)
+}
+
+func (f *flaky) GetKV(key string) ([]byte, error) {
+	if f.down.Load() {
+		return nil, errDown
+	}
+	return f.Store.GetKV(key)
+}
+
+func TestFailover(t *testing.T) {
+	primary := &flaky{Store: memory.NewStore()}
+	secondary := memory.NewStore()
+	locks := memory.NewStore()
+
+	s, err := NewStore(&Config{
+		Backends:  []storage.Store{primary, secondary},
+		MinWrites: 1,
+		Locks:     locks,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.SetKV("certificates/example.com", []byte("cert"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	primary.down.Store(true)
+
+	// reads fail over to the secondary
+	b, err := s.GetKV("certificates/example.com")
+	if err != nil || string(b) != "cert" {
+		t.Fatalf("expected the secondary to answer, got %q %v", b, err)
+	}
+
+	// writes go on with MinWrites 1
+	err = s.SetKV("certificates/example.com", []byte("renewed"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the primary is skipped until RetryAfter, even once back up
+	primary.down.Store(false)
+	b, err = s.GetKV("certificates/example.com")
+	if err != nil || string(b) != "renewed" {
+		t.Fatalf("expected the secondary to answer, got %q %v", b, err)
+	}
+
+	// locks are delegated
+	lease, err := s.LockCert("example.com", "a", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = locks.LockCert("example.com", "b", time.Minute)
+	if err != storage.ErrLockHeld {
+		t.Fatalf("expected the lock to be held in the lock store, got %v", err)
+	}
+	_, err = primary.LockCert("example.com", "b", time.Minute)
+	if err != nil {
+		t.Fatalf("expected the backends not to hold the lock, got %v", err)
+	}
+	err = s.UnlockCert(lease)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// with every backend required, a write fails while one is down
+	strict, err := NewStore(&Config{Backends: []storage.Store{primary, secondary}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	primary.down.Store(true)
+	err = strict.SetKV("certificates/example.com", []byte("lost"), 0)
+	if err == nil {
+		t.Fatal("expected the write to fail")
+	}
+}
@@ -0,0 +1,490 @@
+// Package s3 implements a storage.Store on an S3-compatible bucket, for stateless deployments.
+// Objects keys mirror the keys of the Store, for example certificates/example.com or user/account.json.
+package s3
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/arthurweinmann/go-https-hug/pkg/storage"
+	"github.com/minio/minio-go/v7"
+)
+
+var (
+	_ storage.Store             = (*Store)(nil)
+	_ storage.Lister            = (*Store)(nil)
+	_ storage.Stater            = (*Store)(nil)
+	_ storage.CompareAndSwapper = (*Store)(nil)
+)
+
+// expirationMeta is the user metadata holding the expiration of an object, in unix nanoseconds
+const expirationMeta = "Expiration"
+
+// reservedPrefix starts the keys of the lease objects, they are not listed by ListKV
+// and SetKV, DeleteKV and CompareAndSwapKV refuse to write them.
+const reservedPrefix = ".hug-"
+
+// checkKey returns an error if key is reserved to the leases
+func checkKey(key string) error {
+	if strings.HasPrefix(key, reservedPrefix) {
+		return fmt.Errorf("s3: key %s is reserved, keys must not start with %s", key, reservedPrefix)
+	}
+	return nil
+}
+
+type Store struct {
+	client *minio.Client
+	bucket string
+	prefix string
+	logger *slog.Logger
+	ctx    context.Context
+}
+
+type Config struct {
+	Client *minio.Client
+
+	// Bucket must exist
+	Bucket string
+
+	// Prefix is prepended to every object key, for example myapp/
+	Prefix string
+
+	// Logger receives the errors of StartSweeper, slog.Default() by default
+	Logger *slog.Logger
+}
+
+// NewStore returns a Store on config.Bucket. The leases of LockCert are objects under <prefix>.hug-locks/, written with
+// conditional requests (If-None-Match and If-Match), which the S3 implementation must support. Their deadlines rely
+// on the clocks of the nodes being roughly in sync.
+// Expired keys are hidden from reads and listings but stay in the bucket until DeleteExpired removes them,
+// call StartSweeper on one node or configure a lifecycle rule on the bucket so that they do not pile up.
+func NewStore(config *Config) (*Store, error) {
+	if config.Client == nil {
+		return nil, fmt.Errorf("a client is required")
+	}
+
+	s := &Store{
+		client: config.Client,
+		bucket: config.Bucket,
+		prefix: config.Prefix,
+		logger: config.Logger,
+		ctx:    context.Background(),
+	}
+	if s.logger == nil {
+		s.logger = slog.Default()
+	}
+
+	ok, err := s.client.BucketExists(s.ctx, s.bucket)
+	if err != nil {
+		return nil, fmt.Errorf("could not reach the bucket %s: %v", s.bucket, err)
+	}
+	if !ok {
+		return nil, fmt.Errorf("the bucket %s does not exist", s.bucket)
+	}
+
+	return s, nil
+}
+
+func isNotFound(err error) bool {
+	resp := minio.ToErrorResponse(err)
+	return resp.StatusCode == http.StatusNotFound || resp.Code == "NoSuchKey"
+}
+
+func isPreconditionFailed(err error) bool {
+	resp := minio.ToErrorResponse(err)
+	return resp.StatusCode == http.StatusPreconditionFailed || resp.Code == "PreconditionFailed"
+}
+
+func expirationOf(info minio.ObjectInfo) time.Time {
+	v := info.Metadata.Get("X-Amz-Meta-" + expirationMeta)
+	if v == "" {
+		v = info.UserMetadata[expirationMeta]
+	}
+	if v == "" {
+		return time.Time{}
+	}
+
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+
+	return time.Unix(0, n)
+}
+
+func expired(info minio.ObjectInfo) bool {
+	e := expirationOf(info)
+	return !e.IsZero() && time.Now().After(e)
+}
+
+// get returns the value and ETag of the object of key, or storage.ErrNotFound
+func (s *Store) get(key string) ([]byte, minio.ObjectInfo, error) {
+	obj, err := s.client.GetObject(s.ctx, s.bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		if isNotFound(err) {
+			return nil, minio.ObjectInfo{}, storage.ErrNotFound
+		}
+		return nil, minio.ObjectInfo{}, err
+	}
+	defer obj.Close()
+
+	info, err := obj.Stat()
+	if err != nil {
+		if isNotFound(err) {
+			return nil, minio.ObjectInfo{}, storage.ErrNotFound
+		}
+		return nil, minio.ObjectInfo{}, err
+	}
+
+	b, err := io.ReadAll(obj)
+	if err != nil {
+		return nil, minio.ObjectInfo{}, err
+	}
+
+	return b, info, nil
+}
+
+func (s *Store) put(key string, value []byte, expiration time.Duration, opts minio.PutObjectOptions) error {
+	if expiration > 0 {
+		opts.UserMetadata = map[string]string{
+			expirationMeta: strconv.FormatInt(time.Now().Add(expiration).UnixNano(), 10),
+		}
+	}
+
+	_, err := s.client.PutObject(s.ctx, s.bucket, key, bytes.NewReader(value), int64(len(value)), opts)
+	return err
+}
+
+func (s *Store) SetKV(key string, value []byte, expiration time.Duration) error {
+	err := checkKey(key)
+	if err != nil {
+		return err
+	}
+
+	return s.put(s.prefix+key, value, expiration, minio.PutObjectOptions{})
+}
+
+func (s *Store) GetKV(key string) ([]byte, error) {
+	b, info, err := s.get(s.prefix + key)
+	if err != nil {
+		return nil, err
+	}
+
+	// S3 deletes are not conditional, deleting it here could delete a value written meanwhile by another node
+	if expired(info) {
+		return nil, storage.ErrNotFound
+	}
+
+	return b, nil
+}
+
+func (s *Store) DeleteKV(key string) error {
+	err := checkKey(key)
+	if err != nil {
+		return err
+	}
+
+	// S3 deletes succeed on missing objects
+	info, err := s.client.StatObject(s.ctx, s.bucket, s.prefix+key, minio.StatObjectOptions{})
+	if err != nil {
+		if isNotFound(err) {
+			return storage.ErrNotFound
+		}
+		return err
+	}
+
+	err = s.client.RemoveObject(s.ctx, s.bucket, s.prefix+key, minio.RemoveObjectOptions{})
+	if err != nil {
+		return err
+	}
+
+	if expired(info) {
+		return storage.ErrNotFound
+	}
+
+	return nil
+}
+
+// ListKV stats every object, listings do not return their metadata on every S3 implementation.
+// The lease objects are left out.
+func (s *Store) ListKV(prefix string) ([]string, error) {
+	var keys []string
+	for obj := range s.client.ListObjects(s.ctx, s.bucket, minio.ListObjectsOptions{Prefix: s.prefix + prefix, Recursive: true}) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		if strings.HasPrefix(obj.Key, s.prefix+reservedPrefix) {
+			continue
+		}
+
+		info, err := s.client.StatObject(s.ctx, s.bucket, obj.Key, minio.StatObjectOptions{})
+		if err != nil {
+			if isNotFound(err) {
+				continue
+			}
+			return nil, err
+		}
+		if expired(info) {
+			continue
+		}
+
+		keys = append(keys, strings.TrimPrefix(obj.Key, s.prefix))
+	}
+	return keys, nil
+}
+
+// DeleteExpired deletes the expired keys and returns how many were. S3 deletes are not conditional,
+// so a key expired and written again by another node between our stat and the delete is deleted too.
+func (s *Store) DeleteExpired() (int, error) {
+	var n int
+	for obj := range s.client.ListObjects(s.ctx, s.bucket, minio.ListObjectsOptions{Prefix: s.prefix, Recursive: true}) {
+		if obj.Err != nil {
+			return n, obj.Err
+		}
+		if strings.HasPrefix(obj.Key, s.prefix+reservedPrefix) {
+			continue
+		}
+
+		info, err := s.client.StatObject(s.ctx, s.bucket, obj.Key, minio.StatObjectOptions{})
+		if err != nil {
+			if isNotFound(err) {
+				continue
+			}
+			return n, err
+		}
+		if !expired(info) {
+			continue
+		}
+
+		err = s.client.RemoveObject(s.ctx, s.bucket, obj.Key, minio.RemoveObjectOptions{})
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// StartSweeper runs DeleteExpired every interval until ctx is done
+func (s *Store) StartSweeper(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			_, err := s.DeleteExpired()
+			if err != nil {
+				s.logger.Error("s3: could not delete expired keys", slog.String("error", err.Error()))
+			}
+		}
+	}()
+}
+
+func (s *Store) StatKV(key string) (*storage.KeyInfo, error) {
+	info, err := s.client.StatObject(s.ctx, s.bucket, s.prefix+key, minio.StatObjectOptions{})
+	if err != nil {
+		if isNotFound(err) {
+			return nil, storage.ErrNotFound
+		}
+		return nil, err
+	}
+	if expired(info) {
+		return nil, storage.ErrNotFound
+	}
+
+	return &storage.KeyInfo{
+		Key:        key,
+		Size:       info.Size,
+		ModTime:    info.LastModified,
+		Expiration: expirationOf(info),
+	}, nil
+}
+
+func (s *Store) CompareAndSwapKV(key string, old, value []byte, expiration time.Duration) (bool, error) {
+	err := checkKey(key)
+	if err != nil {
+		return false, err
+	}
+
+	opts := minio.PutObjectOptions{}
+
+	current, info, err := s.get(s.prefix + key)
+	if err != nil && err != storage.ErrNotFound {
+		return false, err
+	}
+
+	switch {
+	case err == storage.ErrNotFound:
+		if old != nil {
+			return false, nil
+		}
+		opts.SetMatchETagExcept("*")
+
+	case expired(info):
+		// an expired key does not exist anymore
+		if old != nil {
+			return false, nil
+		}
+		opts.SetMatchETag(info.ETag)
+
+	default:
+		if old == nil || !bytes.Equal(current, old) {
+			return false, nil
+		}
+		opts.SetMatchETag(info.ETag)
+	}
+
+	err = s.put(s.prefix+key, value, expiration, opts)
+	if err != nil {
+		if isPreconditionFailed(err) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return true, nil
+}
+
+// lockObject is the content of lease objects. They are never deleted, so that their Token keeps increasing,
+// a released lock has a zero Deadline.
+type lockObject struct {
+	Owner    string
+	Token    uint64
+	Epoch    string
+	Deadline time.Time
+}
+
+func (l *lockObject) lease(domain string) *storage.Lease {
+	return &storage.Lease{Domain: domain, Owner: l.Owner, Token: l.Token, Epoch: l.Epoch, Deadline: l.Deadline}
+}
+
+func (s *Store) lockKey(domain string) string {
+	return s.prefix + reservedPrefix + "locks/" + domain
+}
+
+func (s *Store) getLock(domain string) (*lockObject, string, error) {
+	b, info, err := s.get(s.lockKey(domain))
+	if err != nil {
+		return nil, "", err
+	}
+
+	l := &lockObject{}
+	err = json.Unmarshal(b, l)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid lease object for %s: %v", domain, err)
+	}
+
+	return l, info.ETag, nil
+}
+
+func (s *Store) putLock(domain string, l *lockObject, opts minio.PutObjectOptions) error {
+	b, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	return s.put(s.lockKey(domain), b, 0, opts)
+}
+
+func (s *Store) LockCert(domain, owner string, ttl time.Duration) (*storage.Lease, error) {
+	now := time.Now()
+	opts := minio.PutObjectOptions{}
+
+	prev, etag, err := s.getLock(domain)
+	if err != nil && err != storage.ErrNotFound {
+		return nil, err
+	}
+
+	var token uint64 = 1
+	var epoch string
+	if err == storage.ErrNotFound {
+		opts.SetMatchETagExcept("*")
+	} else {
+		if now.Before(prev.Deadline) {
+			return nil, storage.ErrLockHeld
+		}
+		token = prev.Token + 1
+		epoch = prev.Epoch
+		opts.SetMatchETag(etag)
+	}
+	// objects written before epochs were kept get one as well
+	if epoch == "" {
+		epoch = storage.NewEpoch()
+	}
+
+	l := &lockObject{
+		Owner:    owner,
+		Token:    token,
+		Epoch:    epoch,
+		Deadline: now.Add(ttl),
+	}
+
+	err = s.putLock(domain, l, opts)
+	if err != nil {
+		if isPreconditionFailed(err) {
+			// someone else acquired it in between
+			return nil, storage.ErrLockHeld
+		}
+		return nil, err
+	}
+
+	return l.lease(domain), nil
+}
+
+// updateLock replaces the lease object of lease with deadline, if lease still holds it
+func (s *Store) updateLock(lease *storage.Lease, deadline time.Time) error {
+	cur, etag, err := s.getLock(lease.Domain)
+	if err == storage.ErrNotFound {
+		return storage.ErrLeaseLost
+	}
+	if err != nil {
+		return err
+	}
+
+	if !lease.Held(cur.lease(lease.Domain), time.Now()) {
+		return storage.ErrLeaseLost
+	}
+
+	opts := minio.PutObjectOptions{}
+	opts.SetMatchETag(etag)
+
+	err = s.putLock(lease.Domain, &lockObject{Owner: cur.Owner, Token: cur.Token, Epoch: cur.Epoch, Deadline: deadline}, opts)
+	if err != nil {
+		if isPreconditionFailed(err) {
+			return storage.ErrLeaseLost
+		}
+		return err
+	}
+
+	return nil
+}
+
+func (s *Store) RenewCertLock(lease *storage.Lease, ttl time.Duration) error {
+	deadline := time.Now().Add(ttl)
+
+	err := s.updateLock(lease, deadline)
+	if err != nil {
+		return err
+	}
+
+	lease.Deadline = deadline
+
+	return nil
+}
+
+func (s *Store) UnlockCert(lease *storage.Lease) error {
+	return s.updateLock(lease, time.Time{})
+}
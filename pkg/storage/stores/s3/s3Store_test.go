@@ -0,0 +1,434 @@
+package s3
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/arthurweinmann/go-https-hug/pkg/storage"
+	"github.com/arthurweinmann/go-https-hug/pkg/storage/storagetest"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+type fakeObject struct {
+	value    []byte
+	etag     string
+	meta     http.Header
+	modified time.Time
+}
+
+// fakeS3 is an in-process S3 with one bucket, implementing the requests of the Store and the
+// If-Match and If-None-Match preconditions of PutObject
+type fakeS3 struct {
+	bucket string
+
+	mu      sync.Mutex
+	objects map[string]*fakeObject
+
+	// beforePut, if set, runs before the preconditions of every PutObject are checked, with mu held
+	beforePut func(key string)
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != f.bucket {
+		f.error(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if key == "" {
+		switch {
+		case r.Method == http.MethodHead:
+		case r.Method == http.MethodGet && r.URL.Query().Get("list-type") == "2":
+			f.list(w, r.URL.Query().Get("prefix"))
+		default:
+			f.error(w, http.StatusNotImplemented, "NotImplemented")
+		}
+		return
+	}
+
+	obj := f.objects[key]
+
+	switch r.Method {
+	case http.MethodHead, http.MethodGet:
+		if obj == nil {
+			f.error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		for k, v := range obj.meta {
+			w.Header()[k] = v
+		}
+		w.Header().Set("ETag", `"`+obj.etag+`"`)
+		w.Header().Set("Last-Modified", obj.modified.UTC().Format(http.TimeFormat))
+		w.Header().Set("Content-Length", strconv.Itoa(len(obj.value)))
+		w.Header().Set("Content-Type", "application/octet-stream")
+		if r.Method == http.MethodGet {
+			w.Write(obj.value)
+		}
+
+	case http.MethodPut:
+		if f.beforePut != nil {
+			f.beforePut(key)
+			obj = f.objects[key]
+		}
+		if m := r.Header.Get("If-None-Match"); m == "*" && obj != nil {
+			f.error(w, http.StatusPreconditionFailed, "PreconditionFailed")
+			return
+		}
+		if m := r.Header.Get("If-Match"); m != "" && (obj == nil || strings.Trim(m, `"`) != obj.etag) {
+			f.error(w, http.StatusPreconditionFailed, "PreconditionFailed")
+			return
+		}
+
+		b, err := io.ReadAll(r.Body)
+		if err != nil {
+			f.error(w, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+
+		meta := http.Header{}
+		for k, v := range r.Header {
+			if strings.HasPrefix(k, "X-Amz-Meta-") {
+				meta[k] = v
+			}
+		}
+
+		f.put(key, b, meta)
+		w.Header().Set("ETag", `"`+f.objects[key].etag+`"`)
+
+	case http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		f.error(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+// put writes an object with a new ETag, f.mu must be held
+func (f *fakeS3) put(key string, value []byte, meta http.Header) {
+	sum := md5.Sum(append(value, []byte(time.Now().String())...))
+	f.objects[key] = &fakeObject{value: value, etag: hex.EncodeToString(sum[:]), meta: meta, modified: time.Now()}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, prefix string) {
+	type content struct {
+		Key          string
+		LastModified time.Time
+		ETag         string
+		Size         int
+	}
+	res := struct {
+		XMLName  xml.Name `xml:"ListBucketResult"`
+		Name     string
+		Prefix   string
+		KeyCount int
+		MaxKeys  int
+		Contents []content
+	}{Name: f.bucket, Prefix: prefix, MaxKeys: 1000}
+
+	for k, obj := range f.objects {
+		if strings.HasPrefix(k, prefix) {
+			res.Contents = append(res.Contents, content{Key: k, LastModified: obj.modified.UTC(), ETag: `"` + obj.etag + `"`, Size: len(obj.value)})
+		}
+	}
+	sort.Slice(res.Contents, func(i, j int) bool { return res.Contents[i].Key < res.Contents[j].Key })
+	res.KeyCount = len(res.Contents)
+
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(res)
+}
+
+func (f *fakeS3) error(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	xml.NewEncoder(w).Encode(struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string
+	}{Code: code})
+}
+
+// newTestStore uses a local MinIO if MINIO_ENDPOINT is set, for example:
+//
+//	docker run -p 9000:9000 minio/minio server /data
+//	MINIO_ENDPOINT=localhost:9000 MINIO_ACCESS_KEY=minioadmin MINIO_SECRET_KEY=minioadmin go test
+//
+// and a fakeS3 otherwise
+func newTestStore(t *testing.T) *Store {
+	t.Helper()
+
+	endpoint := os.Getenv("MINIO_ENDPOINT")
+	bucket := os.Getenv("MINIO_BUCKET")
+	if bucket == "" {
+		bucket = "go-https-hug-test"
+	}
+
+	if endpoint == "" {
+		s, _ := newFakeStore(t)
+		return s
+	}
+
+	client, err := minio.New(endpoint, &minio.Options{
+		Creds: credentials.NewStaticV4(os.Getenv("MINIO_ACCESS_KEY"), os.Getenv("MINIO_SECRET_KEY"), ""),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	ok, err := client.BucketExists(ctx, bucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		err = client.MakeBucket(ctx, bucket, minio.MakeBucketOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s, err := NewStore(&Config{Client: client, Bucket: bucket, Prefix: t.Name() + "-" + time.Now().Format("150405.000000") + "/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+func newFakeStore(t *testing.T) (*Store, *fakeS3) {
+	t.Helper()
+
+	f := &fakeS3{bucket: "go-https-hug-test", objects: map[string]*fakeObject{}}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+
+	client, err := minio.New(strings.TrimPrefix(srv.URL, "http://"), &minio.Options{
+		Creds:        credentials.NewStaticV4("", "", ""),
+		Region:       "us-east-1",
+		BucketLookup: minio.BucketLookupPath,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewStore(&Config{Client: client, Bucket: f.bucket, Prefix: "test/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s, f
+}
+
+func TestConformance(t *testing.T) {
+	storagetest.RunConformance(t, func(t *testing.T) (storage.Store, func(time.Duration)) {
+		return newTestStore(t), nil
+	})
+}
+
+func TestDeleteExpired(t *testing.T) {
+	s := newTestStore(t)
+
+	err := s.SetKV("challenges/expired", []byte("a"), 100*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.SetKV("challenges/live", []byte("b"), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+
+	n, err := s.DeleteExpired()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("expected one expired key to be deleted, got %d", n)
+	}
+
+	_, err = s.client.StatObject(s.ctx, s.bucket, s.prefix+"challenges/expired", minio.StatObjectOptions{})
+	if !isNotFound(err) {
+		t.Fatalf("expected the expired object to be deleted, got %v", err)
+	}
+
+	b, err := s.GetKV("challenges/live")
+	if err != nil || string(b) != "b" {
+		t.Fatalf("expected the live key to be kept, got %q %v", b, err)
+	}
+}
+
+func TestExpirationOf(t *testing.T) {
+	at := time.Unix(0, 1700000000123456789)
+	n := strconv.FormatInt(at.UnixNano(), 10)
+
+	tests := []struct {
+		name    string
+		info    minio.ObjectInfo
+		want    time.Time
+		expired bool
+	}{
+		{name: "none", info: minio.ObjectInfo{}},
+		{name: "header", info: minio.ObjectInfo{Metadata: http.Header{"X-Amz-Meta-Expiration": {n}}}, want: at, expired: true},
+		{name: "user metadata", info: minio.ObjectInfo{UserMetadata: minio.StringMap{expirationMeta: n}}, want: at, expired: true},
+		{name: "invalid", info: minio.ObjectInfo{Metadata: http.Header{"X-Amz-Meta-Expiration": {"soon"}}}},
+		{
+			name: "future",
+			info: minio.ObjectInfo{Metadata: http.Header{"X-Amz-Meta-Expiration": {strconv.FormatInt(time.Now().Add(time.Hour).Truncate(time.Second).UnixNano(), 10)}}},
+			want: time.Now().Add(time.Hour).Truncate(time.Second),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := expirationOf(tt.info); !got.Equal(tt.want) {
+				t.Fatalf("expirationOf: expected %v, got %v", tt.want, got)
+			}
+			if got := expired(tt.info); got != tt.expired {
+				t.Fatalf("expired: expected %v, got %v", tt.expired, got)
+			}
+		})
+	}
+}
+
+// TestPreconditions writes an object between the read and the conditional write of the Store
+func TestPreconditions(t *testing.T) {
+	s, f := newFakeStore(t)
+
+	race := func(key string, value []byte) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.beforePut = func(k string) {
+			if k == key {
+				f.put(k, value, http.Header{})
+				f.beforePut = nil
+			}
+		}
+	}
+
+	// If-None-Match: * on a key created meanwhile
+	race("test/certificates/a.com", []byte("other"))
+	swapped, err := s.CompareAndSwapKV("certificates/a.com", nil, []byte("mine"), 0)
+	if err != nil || swapped {
+		t.Fatalf("expected the creation to fail, got %v %v", swapped, err)
+	}
+
+	// If-Match on a key replaced meanwhile
+	race("test/certificates/a.com", []byte("another"))
+	swapped, err = s.CompareAndSwapKV("certificates/a.com", []byte("other"), []byte("mine"), 0)
+	if err != nil || swapped {
+		t.Fatalf("expected the swap to fail, got %v %v", swapped, err)
+	}
+	b, err := s.GetKV("certificates/a.com")
+	if err != nil || string(b) != "another" {
+		t.Fatalf("expected the concurrent write to be kept, got %q %v", b, err)
+	}
+
+	// If-Match on an expired key replaced meanwhile
+	err = s.SetKV("challenges/a.com", []byte("old"), time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	race("test/challenges/a.com", []byte("new"))
+	swapped, err = s.CompareAndSwapKV("challenges/a.com", nil, []byte("mine"), 0)
+	if err != nil || swapped {
+		t.Fatalf("expected the creation over an expired key to fail, got %v %v", swapped, err)
+	}
+
+	// a lock created meanwhile
+	race(s.lockKey("a.com"), []byte(`{"Owner":"b","Token":1,"Deadline":"2100-01-01T00:00:00Z"}`))
+	_, err = s.LockCert("a.com", "a", time.Minute)
+	if err != storage.ErrLockHeld {
+		t.Fatalf("expected ErrLockHeld, got %v", err)
+	}
+
+	// an expired lock taken over meanwhile
+	f.mu.Lock()
+	f.put(s.lockKey("b.com"), []byte(`{"Owner":"b","Token":1,"Deadline":"2000-01-01T00:00:00Z"}`), http.Header{})
+	f.mu.Unlock()
+	race(s.lockKey("b.com"), []byte(`{"Owner":"c","Token":2,"Deadline":"2100-01-01T00:00:00Z"}`))
+	_, err = s.LockCert("b.com", "a", time.Minute)
+	if err != storage.ErrLockHeld {
+		t.Fatalf("expected ErrLockHeld, got %v", err)
+	}
+
+	// a lease renewed after it was taken over
+	lease, err := s.LockCert("c.com", "a", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	race(s.lockKey("c.com"), []byte(`{"Owner":"b","Token":2,"Deadline":"2100-01-01T00:00:00Z"}`))
+	err = s.RenewCertLock(lease, time.Minute)
+	if err != storage.ErrLeaseLost {
+		t.Fatalf("expected ErrLeaseLost, got %v", err)
+	}
+}
+
+func TestSweeper(t *testing.T) {
+	s, f := newFakeStore(t)
+
+	err := s.SetKV("challenges/expired", []byte("a"), time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.StartSweeper(ctx, 10*time.Millisecond)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		f.mu.Lock()
+		_, ok := f.objects["test/challenges/expired"]
+		f.mu.Unlock()
+		if !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the sweeper to delete the expired object")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReservedKeys(t *testing.T) {
+	s := newTestStore(t)
+
+	_, err := s.LockCert("example.com", "owner", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := strings.TrimPrefix(s.lockKey("example.com"), s.prefix)
+
+	if err := s.SetKV(key, []byte("a"), 0); err == nil {
+		t.Fatalf("expected SetKV to refuse the key of a lease")
+	}
+	if _, err := s.CompareAndSwapKV(key, nil, []byte("a"), 0); err == nil {
+		t.Fatalf("expected CompareAndSwapKV to refuse the key of a lease")
+	}
+	if err := s.DeleteKV(key); err == nil {
+		t.Fatalf("expected DeleteKV to refuse the key of a lease")
+	}
+
+	_, err = s.LockCert("example.com", "other", time.Minute)
+	if err != storage.ErrLockHeld {
+		t.Fatalf("expected the lease to be kept, got %v", err)
+	}
+}
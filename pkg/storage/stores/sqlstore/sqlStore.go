@@ -0,0 +1,400 @@
+// Package sqlstore implements a storage.Store on database/sql, for PostgreSQL and SQLite.
+// It does not import any driver, open the *sql.DB with the one of your choice.
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/arthurweinmann/go-https-hug/pkg/storage"
+)
+
+var (
+	_ storage.Store             = (*Store)(nil)
+	_ storage.Lister            = (*Store)(nil)
+	_ storage.Stater            = (*Store)(nil)
+	_ storage.CompareAndSwapper = (*Store)(nil)
+)
+
+type Dialect int
+
+const (
+	Postgres Dialect = iota
+	// SQLite needs version 3.35 or later
+	SQLite
+)
+
+// migrations are applied in order, the schema version being the number of migrations applied
+var migrations = map[Dialect][]string{
+	Postgres: {
+		`CREATE TABLE https_hug_kv (
+			key TEXT PRIMARY KEY,
+			value BYTEA NOT NULL,
+			expires_at BIGINT,
+			modified_at BIGINT NOT NULL
+		)`,
+		`CREATE INDEX https_hug_kv_expires_at ON https_hug_kv (expires_at) WHERE expires_at IS NOT NULL`,
+		`CREATE TABLE https_hug_locks (
+			domain TEXT PRIMARY KEY,
+			owner TEXT NOT NULL,
+			token BIGINT NOT NULL,
+			deadline BIGINT NOT NULL
+		)`,
+		`ALTER TABLE https_hug_locks ADD COLUMN epoch TEXT NOT NULL DEFAULT ''`,
+	},
+	SQLite: {
+		`CREATE TABLE https_hug_kv (
+			key TEXT PRIMARY KEY,
+			value BLOB NOT NULL,
+			expires_at INTEGER,
+			modified_at INTEGER NOT NULL
+		)`,
+		`CREATE INDEX https_hug_kv_expires_at ON https_hug_kv (expires_at) WHERE expires_at IS NOT NULL`,
+		`CREATE TABLE https_hug_locks (
+			domain TEXT PRIMARY KEY,
+			owner TEXT NOT NULL,
+			token INTEGER NOT NULL,
+			deadline INTEGER NOT NULL
+		)`,
+		`ALTER TABLE https_hug_locks ADD COLUMN epoch TEXT NOT NULL DEFAULT ''`,
+	},
+}
+
+// Store keeps the keys in the https_hug_kv table, with their expiration as a column, and the leases
+// of LockCert as rows of the https_hug_locks table. Times are stored as unix nanoseconds.
+// Expired keys are ignored by reads and deleted by Sweep.
+type Store struct {
+	db      *sql.DB
+	dialect Dialect
+	logger  *slog.Logger
+	ctx     context.Context
+}
+
+type Config struct {
+	DB      *sql.DB
+	Dialect Dialect
+
+	// Logger receives the errors of StartSweeper, slog.Default() by default
+	Logger *slog.Logger
+}
+
+// NewStore returns a Store on config.DB after running Migrate
+func NewStore(config *Config) (*Store, error) {
+	if config.DB == nil {
+		return nil, fmt.Errorf("a database is required")
+	}
+	if _, ok := migrations[config.Dialect]; !ok {
+		return nil, fmt.Errorf("unknown dialect %d", config.Dialect)
+	}
+
+	s := &Store{
+		db:      config.DB,
+		dialect: config.Dialect,
+		logger:  config.Logger,
+		ctx:     context.Background(),
+	}
+	if s.logger == nil {
+		s.logger = slog.Default()
+	}
+
+	err := s.Migrate()
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Migrate creates or upgrades the schema, it does nothing when it is up to date.
+// The schema version is kept in the https_hug_schema table.
+func (s *Store) Migrate() error {
+	_, err := s.db.ExecContext(s.ctx, `CREATE TABLE IF NOT EXISTS https_hug_schema (version INTEGER NOT NULL)`)
+	if err != nil {
+		return fmt.Errorf("could not create the schema table: %v", err)
+	}
+
+	tx, err := s.db.BeginTx(s.ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if s.dialect == Postgres {
+		// concurrent replicas starting up wait for each other
+		_, err = tx.ExecContext(s.ctx, `LOCK TABLE https_hug_schema IN EXCLUSIVE MODE`)
+		if err != nil {
+			return err
+		}
+	}
+
+	var version int
+	err = tx.QueryRowContext(s.ctx, `SELECT version FROM https_hug_schema`).Scan(&version)
+	if err == sql.ErrNoRows {
+		_, err = tx.ExecContext(s.ctx, `INSERT INTO https_hug_schema (version) VALUES (0)`)
+	}
+	if err != nil {
+		return fmt.Errorf("could not read the schema version: %v", err)
+	}
+
+	ms := migrations[s.dialect]
+	if version > len(ms) {
+		return fmt.Errorf("the schema version %d is more recent than this code", version)
+	}
+
+	for i := version; i < len(ms); i++ {
+		_, err = tx.ExecContext(s.ctx, ms[i])
+		if err != nil {
+			return fmt.Errorf("migration %d: %v", i+1, err)
+		}
+	}
+
+	_, err = tx.ExecContext(s.ctx, s.rebind(`UPDATE https_hug_schema SET version = ?`), len(ms))
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// rebind replaces the ? placeholders of query with the ones of the dialect
+func (s *Store) rebind(query string) string {
+	if s.dialect != Postgres {
+		return query
+	}
+
+	var b strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+
+	return b.String()
+}
+
+func (s *Store) exec(query string, args ...any) (int64, error) {
+	res, err := s.db.ExecContext(s.ctx, s.rebind(query), args...)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func expiresAt(now time.Time, expiration time.Duration) sql.NullInt64 {
+	if expiration <= 0 {
+		return sql.NullInt64{}
+	}
+	return sql.NullInt64{Int64: now.Add(expiration).UnixNano(), Valid: true}
+}
+
+func (s *Store) SetKV(key string, value []byte, expiration time.Duration) error {
+	now := time.Now()
+
+	_, err := s.exec(`INSERT INTO https_hug_kv (key, value, expires_at, modified_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT (key) DO UPDATE SET value = excluded.value, expires_at = excluded.expires_at, modified_at = excluded.modified_at`,
+		key, value, expiresAt(now, expiration), now.UnixNano())
+
+	return err
+}
+
+func (s *Store) GetKV(key string) ([]byte, error) {
+	var value []byte
+	err := s.db.QueryRowContext(s.ctx, s.rebind(`SELECT value FROM https_hug_kv WHERE key = ? AND (expires_at IS NULL OR expires_at > ?)`),
+		key, time.Now().UnixNano()).Scan(&value)
+	if err == sql.ErrNoRows {
+		return nil, storage.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+func (s *Store) DeleteKV(key string) error {
+	n, err := s.exec(`DELETE FROM https_hug_kv WHERE key = ? AND (expires_at IS NULL OR expires_at > ?)`, key, time.Now().UnixNano())
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		// the key may still be there, expired
+		_, err = s.exec(`DELETE FROM https_hug_kv WHERE key = ?`, key)
+		if err != nil {
+			return err
+		}
+		return storage.ErrNotFound
+	}
+
+	return nil
+}
+
+func (s *Store) ListKV(prefix string) ([]string, error) {
+	escaped := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(prefix)
+
+	rows, err := s.db.QueryContext(s.ctx, s.rebind(`SELECT key FROM https_hug_kv WHERE key LIKE ? ESCAPE '\' AND (expires_at IS NULL OR expires_at > ?)`),
+		escaped+"%", time.Now().UnixNano())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []string
+	for rows.Next() {
+		var k string
+		err = rows.Scan(&k)
+		if err != nil {
+			return nil, err
+		}
+		// LIKE is case insensitive with SQLite
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+
+	return keys, rows.Err()
+}
+
+func (s *Store) StatKV(key string) (*storage.KeyInfo, error) {
+	var size, modifiedAt int64
+	var expires sql.NullInt64
+
+	err := s.db.QueryRowContext(s.ctx, s.rebind(`SELECT length(value), modified_at, expires_at FROM https_hug_kv
+		WHERE key = ? AND (expires_at IS NULL OR expires_at > ?)`), key, time.Now().UnixNano()).
+		Scan(&size, &modifiedAt, &expires)
+	if err == sql.ErrNoRows {
+		return nil, storage.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	info := &storage.KeyInfo{
+		Key:     key,
+		Size:    size,
+		ModTime: time.Unix(0, modifiedAt),
+	}
+	if expires.Valid {
+		info.Expiration = time.Unix(0, expires.Int64)
+	}
+
+	return info, nil
+}
+
+func (s *Store) CompareAndSwapKV(key string, old, value []byte, expiration time.Duration) (bool, error) {
+	now := time.Now()
+
+	var n int64
+	var err error
+	if old == nil {
+		// an expired key does not exist anymore
+		n, err = s.exec(`INSERT INTO https_hug_kv (key, value, expires_at, modified_at) VALUES (?, ?, ?, ?)
+			ON CONFLICT (key) DO UPDATE SET value = excluded.value, expires_at = excluded.expires_at, modified_at = excluded.modified_at
+			WHERE https_hug_kv.expires_at IS NOT NULL AND https_hug_kv.expires_at <= ?`,
+			key, value, expiresAt(now, expiration), now.UnixNano(), now.UnixNano())
+	} else {
+		n, err = s.exec(`UPDATE https_hug_kv SET value = ?, expires_at = ?, modified_at = ?
+			WHERE key = ? AND value = ? AND (expires_at IS NULL OR expires_at > ?)`,
+			value, expiresAt(now, expiration), now.UnixNano(), key, old, now.UnixNano())
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return n == 1, nil
+}
+
+// Sweep deletes the expired keys and returns how many were
+func (s *Store) Sweep() (int64, error) {
+	return s.exec(`DELETE FROM https_hug_kv WHERE expires_at IS NOT NULL AND expires_at <= ?`, time.Now().UnixNano())
+}
+
+// StartSweeper runs Sweep every interval until ctx is done
+func (s *Store) StartSweeper(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			_, err := s.Sweep()
+			if err != nil {
+				s.logger.Error("sqlstore: could not sweep expired keys", slog.String("error", err.Error()))
+			}
+		}
+	}()
+}
+
+// LockCert upserts the lease row of domain, only if the current one expired. Rows are never deleted,
+// so that their token keeps increasing, a released lease has a zero deadline. The rows created before
+// the epoch column was added get one on their next acquisition.
+func (s *Store) LockCert(domain, owner string, ttl time.Duration) (*storage.Lease, error) {
+	now := time.Now()
+	deadline := now.Add(ttl)
+
+	var token int64
+	var epoch string
+	err := s.db.QueryRowContext(s.ctx, s.rebind(`INSERT INTO https_hug_locks (domain, owner, token, epoch, deadline) VALUES (?, ?, 1, ?, ?)
+		ON CONFLICT (domain) DO UPDATE SET owner = excluded.owner, token = https_hug_locks.token + 1,
+			epoch = CASE WHEN https_hug_locks.epoch = '' THEN excluded.epoch ELSE https_hug_locks.epoch END,
+			deadline = excluded.deadline
+		WHERE https_hug_locks.deadline <= ?
+		RETURNING token, epoch`),
+		domain, owner, storage.NewEpoch(), deadline.UnixNano(), now.UnixNano()).Scan(&token, &epoch)
+	if err == sql.ErrNoRows {
+		return nil, storage.ErrLockHeld
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &storage.Lease{
+		Domain:   domain,
+		Owner:    owner,
+		Token:    uint64(token),
+		Epoch:    epoch,
+		Deadline: deadline,
+	}, nil
+}
+
+func (s *Store) updateLease(lease *storage.Lease, deadline time.Time) error {
+	n, err := s.exec(`UPDATE https_hug_locks SET deadline = ? WHERE domain = ? AND owner = ? AND token = ? AND epoch = ? AND deadline > ?`,
+		deadline.UnixNano(), lease.Domain, lease.Owner, int64(lease.Token), lease.Epoch, time.Now().UnixNano())
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return storage.ErrLeaseLost
+	}
+	return nil
+}
+
+func (s *Store) RenewCertLock(lease *storage.Lease, ttl time.Duration) error {
+	deadline := time.Now().Add(ttl)
+
+	err := s.updateLease(lease, deadline)
+	if err != nil {
+		return err
+	}
+
+	lease.Deadline = deadline
+
+	return nil
+}
+
+func (s *Store) UnlockCert(lease *storage.Lease) error {
+	return s.updateLease(lease, time.Unix(0, 0))
+}
@@ -0,0 +1,153 @@
+package sqlstore
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/arthurweinmann/go-https-hug/pkg/storage"
+	"github.com/arthurweinmann/go-https-hug/pkg/storage/storagetest"
+	_ "github.com/jackc/pgx/v5/stdlib"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// dialects are the ones testable here: SQLite always, in a temporary directory,
+// PostgreSQL on the database of POSTGRES_DSN if set
+func dialects() map[string]Dialect {
+	ret := map[string]Dialect{"sqlite": SQLite}
+	if os.Getenv("POSTGRES_DSN") != "" {
+		ret["postgres"] = Postgres
+	}
+	return ret
+}
+
+// newTestStore returns a Store on a new database. The PostgreSQL tables are dropped on cleanup,
+// so the tests using it must not run in parallel.
+func newTestStore(t *testing.T, dialect Dialect) *Store {
+	t.Helper()
+
+	var db *sql.DB
+	var err error
+	switch dialect {
+	case SQLite:
+		db, err = sql.Open("sqlite3", filepath.Join(t.TempDir(), "store.db")+"?_busy_timeout=5000&_journal_mode=WAL")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { db.Close() })
+	case Postgres:
+		db, err = sql.Open("pgx", os.Getenv("POSTGRES_DSN"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			db.Exec(`DROP TABLE IF EXISTS https_hug_kv, https_hug_locks, https_hug_schema`)
+			db.Close()
+		})
+	}
+
+	s, err := NewStore(&Config{DB: db, Dialect: dialect})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+func TestConformance(t *testing.T) {
+	for name, dialect := range dialects() {
+		t.Run(name, func(t *testing.T) {
+			storagetest.RunConformance(t, func(t *testing.T) (storage.Store, func(time.Duration)) {
+				return newTestStore(t, dialect), nil
+			})
+		})
+	}
+}
+
+func TestMigrateAndSweep(t *testing.T) {
+	for name, dialect := range dialects() {
+		t.Run(name, func(t *testing.T) {
+			s := newTestStore(t, dialect)
+
+			// migrating again is a no-op
+			err := s.Migrate()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = s.SetKV("certificates/example.com", []byte("cert"), 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = s.SetKV("challenges/example.com_token", []byte("keyauth"), 100*time.Millisecond)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			time.Sleep(200 * time.Millisecond)
+
+			n, err := s.Sweep()
+			if err != nil || n != 1 {
+				t.Fatalf("expected one key to be swept, got %d %v", n, err)
+			}
+
+			_, err = s.GetKV("certificates/example.com")
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// syncBuffer is a bytes.Buffer safe for the logger of the sweeper to write to
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestSweeperLogger(t *testing.T) {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "store.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var logs syncBuffer
+	s, err := NewStore(&Config{DB: db, Dialect: SQLite, Logger: slog.New(slog.NewTextHandler(&logs, nil))})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// every sweep fails on a closed database
+	db.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.StartSweeper(ctx, 10*time.Millisecond)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(logs.String(), "could not sweep expired keys") {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the sweeper to log its error to the configured logger")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
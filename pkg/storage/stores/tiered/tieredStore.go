@@ -0,0 +1,227 @@
+// Package tiered implements a storage.Store caching a remote Store, shared by several nodes, in a local one.
+package tiered
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/arthurweinmann/go-https-hug/pkg/storage"
+)
+
+var (
+	_ storage.Store             = (*Store)(nil)
+	_ storage.Lister            = (*Store)(nil)
+	_ storage.Stater            = (*Store)(nil)
+	_ storage.CompareAndSwapper = (*Store)(nil)
+	_ storage.Refresher         = (*Store)(nil)
+)
+
+const defaultLocalTTL = time.Minute
+
+type Config struct {
+	// Local is the fast tier, for example a memory.Store or a filesystem.Store. It must not be shared.
+	Local storage.Store
+
+	// Remote is the Store shared by every node. It is authoritative for the values and holds the locks.
+	Remote storage.Store
+
+	// LocalTTL is how long a value is kept in Local, 1 minute by default, or less if it expires sooner in Remote.
+	// A value changed in Remote by another node may be read from Local until then, RefreshKV reads it from Remote.
+	LocalTTL time.Duration
+}
+
+// Store reads through and writes through its local tier. The optional capabilities are the ones of Remote,
+// errors.ErrUnsupported is returned when it does not implement them. A failed CompareAndSwapKV removes the key
+// from the local tier, so that the next read of the caller is the value of Remote it must compare with.
+type Store struct {
+	local    storage.Store
+	remote   storage.Store
+	localTTL time.Duration
+
+	// mu serializes the writes to the local tier, and generation counts them, so that a read of Remote
+	// racing with a write does not put the previous value back in the local tier
+	mu         sync.Mutex
+	generation uint64
+}
+
+func NewStore(config *Config) (*Store, error) {
+	if config.Local == nil || config.Remote == nil {
+		return nil, fmt.Errorf("both a local and a remote Store are required")
+	}
+
+	s := &Store{
+		local:    config.Local,
+		remote:   config.Remote,
+		localTTL: config.LocalTTL,
+	}
+	if s.localTTL <= 0 {
+		s.localTTL = defaultLocalTTL
+	}
+
+	return s, nil
+}
+
+// ttl returns the expiration in the local tier of a value expiring after expiration in Remote
+func (s *Store) ttl(expiration time.Duration) time.Duration {
+	if expiration > 0 && expiration < s.localTTL {
+		return expiration
+	}
+	return s.localTTL
+}
+
+// updateLocal sets key to value in the local tier, or deletes it if value is nil, after a write to Remote
+func (s *Store) updateLocal(key string, value []byte, expiration time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.generation++
+
+	var err error
+	if value != nil {
+		err = s.local.SetKV(key, value, s.ttl(expiration))
+	}
+	if value == nil || err != nil {
+		// a value missing from the local tier is read from Remote, a stale one would not be
+		err = s.local.DeleteKV(key)
+		if err == storage.ErrNotFound {
+			err = nil
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("could not update the local tier, it may serve a stale value of %s: %v", key, err)
+	}
+
+	return nil
+}
+
+func (s *Store) SetKV(key string, value []byte, expiration time.Duration) error {
+	err := s.remote.SetKV(key, value, expiration)
+	if err != nil {
+		return err
+	}
+
+	return s.updateLocal(key, value, expiration)
+}
+
+// remoteTTL returns how long key has left before expiring in Remote, zero if it does not expire
+// or if Remote cannot tell, in which case the value is kept LocalTTL in the local tier
+func (s *Store) remoteTTL(key string) time.Duration {
+	st, ok := s.remote.(storage.Stater)
+	if !ok {
+		return 0
+	}
+
+	info, err := st.StatKV(key)
+	if err != nil || info.Expiration.IsZero() {
+		return 0
+	}
+
+	return max(time.Until(info.Expiration), time.Millisecond)
+}
+
+func (s *Store) GetKV(key string) ([]byte, error) {
+	b, err := s.local.GetKV(key)
+	if err == nil {
+		return b, nil
+	}
+
+	s.mu.Lock()
+	generation := s.generation
+	s.mu.Unlock()
+
+	b, err = s.remote.GetKV(key)
+	if err != nil {
+		return nil, err
+	}
+	ttl := s.ttl(s.remoteTTL(key))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// the local tier is only a cache, failing to fill it is not an error
+	if s.generation == generation {
+		s.local.SetKV(key, b, ttl)
+	}
+
+	return b, nil
+}
+
+// RefreshKV reads key from Remote and replaces its value in the local tier
+func (s *Store) RefreshKV(key string) ([]byte, error) {
+	b, err := s.remote.GetKV(key)
+	if err != nil && err != storage.ErrNotFound {
+		return nil, err
+	}
+
+	var ttl time.Duration
+	if err == nil {
+		ttl = s.remoteTTL(key)
+	}
+
+	// as in GetKV, failing to update the local tier is not an error of the read
+	s.updateLocal(key, b, ttl)
+
+	return b, err
+}
+
+func (s *Store) DeleteKV(key string) error {
+	err := s.remote.DeleteKV(key)
+	if err != nil && err != storage.ErrNotFound {
+		return err
+	}
+
+	lerr := s.updateLocal(key, nil, 0)
+	if lerr != nil {
+		return lerr
+	}
+
+	return err
+}
+
+func (s *Store) LockCert(domain, owner string, ttl time.Duration) (*storage.Lease, error) {
+	return s.remote.LockCert(domain, owner, ttl)
+}
+
+func (s *Store) RenewCertLock(lease *storage.Lease, ttl time.Duration) error {
+	return s.remote.RenewCertLock(lease, ttl)
+}
+
+func (s *Store) UnlockCert(lease *storage.Lease) error {
+	return s.remote.UnlockCert(lease)
+}
+
+func (s *Store) ListKV(prefix string) ([]string, error) {
+	l, ok := s.remote.(storage.Lister)
+	if !ok {
+		return nil, errors.ErrUnsupported
+	}
+	return l.ListKV(prefix)
+}
+
+func (s *Store) StatKV(key string) (*storage.KeyInfo, error) {
+	st, ok := s.remote.(storage.Stater)
+	if !ok {
+		return nil, errors.ErrUnsupported
+	}
+	return st.StatKV(key)
+}
+
+func (s *Store) CompareAndSwapKV(key string, old, value []byte, expiration time.Duration) (bool, error) {
+	c, ok := s.remote.(storage.CompareAndSwapper)
+	if !ok {
+		return false, errors.ErrUnsupported
+	}
+
+	swapped, err := c.CompareAndSwapKV(key, old, value, expiration)
+	if err != nil {
+		return false, err
+	}
+	if !swapped {
+		// old may have been read from a stale local tier
+		return false, s.updateLocal(key, nil, 0)
+	}
+
+	return true, s.updateLocal(key, value, expiration)
+}
@@ -0,0 +1,128 @@
+package tiered
+
+import (
+	"testing"
+	"time"
+
+	"github.com/arthurweinmann/go-https-hug/pkg/storage"
+	"github.com/arthurweinmann/go-https-hug/pkg/storage/storagetest"
+	"github.com/arthurweinmann/go-https-hug/pkg/storage/stores/memory"
+)
+
+func TestConformance(t *testing.T) {
+	storagetest.RunConformance(t, func(t *testing.T) (storage.Store, func(time.Duration)) {
+		s, err := NewStore(&Config{Local: memory.NewStore(), Remote: memory.NewStore()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s, nil
+	})
+}
+
+func TestLocalTier(t *testing.T) {
+	remote := memory.NewStore()
+
+	s, err := NewStore(&Config{Local: memory.NewStore(), Remote: remote, LocalTTL: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = remote.SetKV("certificates/example.com", []byte("cert"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// read through
+	b, err := s.GetKV("certificates/example.com")
+	if err != nil || string(b) != "cert" {
+		t.Fatalf("unexpected value %q %v", b, err)
+	}
+
+	// another node renews the certificate, the local tier serves the previous one until LocalTTL
+	err = remote.SetKV("certificates/example.com", []byte("renewed"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err = s.GetKV("certificates/example.com")
+	if err != nil || string(b) != "cert" {
+		t.Fatalf("expected the cached value, got %q %v", b, err)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+
+	b, err = s.GetKV("certificates/example.com")
+	if err != nil || string(b) != "renewed" {
+		t.Fatalf("expected the remote value after LocalTTL, got %q %v", b, err)
+	}
+
+	// write through
+	err = s.SetKV("certificates/example.com", []byte("mine"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err = remote.GetKV("certificates/example.com")
+	if err != nil || string(b) != "mine" {
+		t.Fatalf("expected the write to reach the remote tier, got %q %v", b, err)
+	}
+}
+
+func TestStaleLocalTier(t *testing.T) {
+	remote := memory.NewStore()
+
+	s, err := NewStore(&Config{Local: memory.NewStore(), Remote: remote, LocalTTL: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// values are not cached past their remote expiration
+	err = remote.SetKV("challenges/example.com_token", []byte("keyauth"), 100*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := s.GetKV("challenges/example.com_token")
+	if err != nil || string(b) != "keyauth" {
+		t.Fatalf("unexpected value %q %v", b, err)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+
+	_, err = s.GetKV("challenges/example.com_token")
+	if err != storage.ErrNotFound {
+		t.Fatalf("expected the challenge to expire in the local tier, got %v", err)
+	}
+
+	// another node renews a cached certificate
+	err = s.SetKV("certificates/example.com", []byte("cert"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = remote.SetKV("certificates/example.com", []byte("renewed"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a compare-and-swap with the stale value fails, and drops it from the local tier
+	swapped, err := s.CompareAndSwapKV("certificates/example.com", []byte("cert"), []byte("mine"), 0)
+	if err != nil || swapped {
+		t.Fatalf("expected the swap to fail, got %v %v", swapped, err)
+	}
+	b, err = s.GetKV("certificates/example.com")
+	if err != nil || string(b) != "renewed" {
+		t.Fatalf("expected the remote value after a failed swap, got %q %v", b, err)
+	}
+
+	// RefreshKV reads through the local tier
+	err = remote.SetKV("certificates/example.com", []byte("renewed again"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err = s.RefreshKV("certificates/example.com")
+	if err != nil || string(b) != "renewed again" {
+		t.Fatalf("expected the remote value from RefreshKV, got %q %v", b, err)
+	}
+	b, err = s.GetKV("certificates/example.com")
+	if err != nil || string(b) != "renewed again" {
+		t.Fatalf("expected RefreshKV to update the local tier, got %q %v", b, err)
+	}
+}
@@ -0,0 +1,184 @@
+// Package tlspolicy configures the TLS protocol of our HTTPS listeners: versions, cipher suites,
+// curves, ALPN protocols and session tickets, globally and per SNI domain.
+package tlspolicy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/arthurweinmann/go-https-hug/internal/utils"
+	"github.com/go-acme/lego/v4/challenge/tlsalpn01"
+)
+
+type Policy struct {
+	// MinVersion and MaxVersion, for example tls.VersionTLS12, use the Go defaults if zero
+	MinVersion uint16
+	MaxVersion uint16
+
+	// CipherSuites used up to TLS 1.2, TLS 1.3 suites are not configurable.
+	// Uses the Go defaults if empty.
+	CipherSuites []uint16
+
+	// CurvePreferences in order of preference, uses the Go defaults if empty
+	CurvePreferences []tls.CurveID
+
+	// NextProtos are the ALPN protocols offered, in order of preference, for example h2 and http/1.1.
+	// The acme-tls/1 protocol is always added so that tls-alpn-01 challenges keep working.
+	// If empty, the listener keeps its own.
+	NextProtos []string
+
+	SessionTicketsDisabled bool
+}
+
+// Modern follows the Mozilla modern configuration: TLS 1.3 only
+func Modern() *Policy {
+	return &Policy{
+		MinVersion:       tls.VersionTLS13,
+		CurvePreferences: []tls.CurveID{tls.X25519MLKEM768, tls.X25519, tls.CurveP256, tls.CurveP384},
+	}
+}
+
+// Intermediate follows the Mozilla intermediate configuration: TLS 1.2 with forward secret AEAD suites, and TLS 1.3
+func Intermediate() *Policy {
+	return &Policy{
+		MinVersion: tls.VersionTLS12,
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+		},
+		CurvePreferences: []tls.CurveID{tls.X25519MLKEM768, tls.X25519, tls.CurveP256, tls.CurveP384},
+	}
+}
+
+func (p *Policy) Validate() error {
+	if p.MinVersion != 0 && p.MaxVersion != 0 && p.MinVersion > p.MaxVersion {
+		return fmt.Errorf("MinVersion %s is greater than MaxVersion %s", tls.VersionName(p.MinVersion), tls.VersionName(p.MaxVersion))
+	}
+
+	for _, v := range []uint16{p.MinVersion, p.MaxVersion} {
+		if v != 0 && (v < tls.VersionTLS10 || v > tls.VersionTLS13) {
+			return fmt.Errorf("unknown TLS version %#04x", v)
+		}
+	}
+
+	if len(p.CipherSuites) > 0 && p.MinVersion == tls.VersionTLS13 {
+		return fmt.Errorf("CipherSuites are not configurable with TLS 1.3 only")
+	}
+
+	for _, id := range p.CipherSuites {
+		if !knownCipherSuite(id) {
+			return fmt.Errorf("unknown cipher suite %#04x", id)
+		}
+	}
+
+	return nil
+}
+
+func knownCipherSuite(id uint16) bool {
+	for _, cs := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		if cs.ID == id && slices.Contains(cs.SupportedVersions, tls.VersionTLS12) {
+			return true
+		}
+	}
+	return false
+}
+
+// Apply sets the settings of p on c. It does not touch the certificates or client authentication of c.
+func (p *Policy) Apply(c *tls.Config) {
+	c.MinVersion = p.MinVersion
+	c.MaxVersion = p.MaxVersion
+	c.CipherSuites = p.CipherSuites
+	c.CurvePreferences = p.CurvePreferences
+	c.SessionTicketsDisabled = p.SessionTicketsDisabled
+
+	if len(p.NextProtos) > 0 {
+		c.NextProtos = slices.Clone(p.NextProtos)
+	}
+	if len(c.NextProtos) > 0 && !slices.Contains(c.NextProtos, tlsalpn01.ACMETLS1Protocol) {
+		c.NextProtos = append(c.NextProtos, tlsalpn01.ACMETLS1Protocol)
+	}
+}
+
+// Policies holds a default Policy and per domain ones
+type Policies struct {
+	// Default applies to the domains without their own policy, the Go defaults are used if nil
+	Default *Policy
+
+	// Domains maps domain names, which may be wildcards such as *.example.com, to their policy
+	Domains map[string]*Policy
+}
+
+func (ps *Policies) Validate() error {
+	if ps.Default != nil {
+		err := ps.Default.Validate()
+		if err != nil {
+			return fmt.Errorf("invalid default TLS policy: %v", err)
+		}
+	}
+
+	for d, p := range ps.Domains {
+		if p == nil {
+			return fmt.Errorf("the TLS policy of %s is nil", d)
+		}
+		err := p.Validate()
+		if err != nil {
+			return fmt.Errorf("invalid TLS policy for %s: %v", d, err)
+		}
+	}
+
+	return nil
+}
+
+// For returns the policy of servername, an exact match taking precedence over wildcards, or the Default
+func (ps *Policies) For(servername string) *Policy {
+	servername = strings.ToLower(strings.TrimSuffix(servername, "."))
+
+	for d, p := range ps.Domains {
+		if strings.EqualFold(d, servername) {
+			return p
+		}
+	}
+
+	for d, p := range ps.Domains {
+		if strings.HasPrefix(d, "*.") && utils.MatchCertificateDomain(d, servername) {
+			return p
+		}
+	}
+
+	return ps.Default
+}
+
+// Config applies the Default policy to base and sets its GetConfigForClient to apply the per domain ones by SNI.
+// base should have been fully configured beforehand, it is cloned for every per domain policy.
+func (ps *Policies) Config(base *tls.Config) {
+	if ps.Default != nil {
+		ps.Default.Apply(base)
+	}
+
+	if len(ps.Domains) == 0 {
+		return
+	}
+
+	configs := map[*Policy]*tls.Config{}
+	for _, p := range ps.Domains {
+		if _, ok := configs[p]; !ok {
+			c := base.Clone()
+			p.Apply(c)
+			configs[p] = c
+		}
+	}
+
+	base.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		p := ps.For(hello.ServerName)
+		if p == nil || p == ps.Default {
+			return nil, nil
+		}
+		return configs[p], nil
+	}
+}
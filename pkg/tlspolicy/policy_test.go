@@ -0,0 +1,51 @@
+package tlspolicy
+
+import (
+	"crypto/tls"
+	"slices"
+	"testing"
+)
+
+func TestPolicies(t *testing.T) {
+	modern, intermediate := Modern(), Intermediate()
+
+	ps := &Policies{
+		Default: intermediate,
+		Domains: map[string]*Policy{
+			"*.internal.example.com":      modern,
+			"legacy.internal.example.com": {MinVersion: tls.VersionTLS12, MaxVersion: tls.VersionTLS12},
+		},
+	}
+
+	err := ps.Validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ps.For("api.internal.example.com") != modern {
+		t.Fatalf("expected the wildcard policy")
+	}
+	if p := ps.For("Legacy.Internal.Example.Com"); p == nil || p.MaxVersion != tls.VersionTLS12 {
+		t.Fatalf("expected the exact policy to take precedence over the wildcard")
+	}
+	if ps.For("example.com") != intermediate {
+		t.Fatalf("expected the default policy")
+	}
+
+	c := &tls.Config{NextProtos: []string{"http/1.1"}}
+	(&Policy{NextProtos: []string{"h2", "http/1.1"}}).Apply(c)
+	if !slices.Equal(c.NextProtos, []string{"h2", "http/1.1", "acme-tls/1"}) {
+		t.Fatalf("expected acme-tls/1 to be kept, got %v", c.NextProtos)
+	}
+
+	invalid := []*Policy{
+		{MinVersion: tls.VersionTLS13, MaxVersion: tls.VersionTLS12},
+		{MinVersion: tls.VersionTLS13, CipherSuites: []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}},
+		{CipherSuites: []uint16{tls.TLS_AES_128_GCM_SHA256}},
+	}
+	for i, p := range invalid {
+		if p.Validate() == nil {
+			t.Fatalf("expected policy %d to be invalid", i)
+		}
+	}
+}